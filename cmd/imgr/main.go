@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -54,11 +61,120 @@ func main() {
 	}
 	storage := &imgr.DB{DB: conn}
 
-	imageServer, err := imgr.NewLocalImageServer(
-		storage,
-		imgr.WithStaticFolder(staticStoragePath),
-		imgr.WithLogger(log),
-	)
+	// S3 compatible storage is used when bucket is configured, otherwise images are kept in local folder
+	var blobStore imgr.BlobStore
+	if bucket := os.Getenv("S3_BUCKET"); bucket != "" {
+		pathStyle, errP := strconv.ParseBool(os.Getenv("S3_PATH_STYLE"))
+		if errP != nil && os.Getenv("S3_PATH_STYLE") != "" {
+			log.Fatal(errP)
+		}
+		blobStore, err = imgr.NewS3BlobStore(imgr.S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          bucket,
+			Prefix:          os.Getenv("S3_PREFIX"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			PathStyle:       pathStyle,
+		})
+	} else {
+		blobStore, err = imgr.NewFolderBlobStore(staticStoragePath)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	options := []imgr.Option{imgr.WithBlobStore(blobStore), imgr.WithLogger(log)}
+
+	// Derivatives are comma separated descriptions, e.g. "thumb 128x128 cover,medium 1024w"
+	if descriptions := os.Getenv("DERIVATIVES"); descriptions != "" {
+		derivatives := make([]imgr.Derivative, 0)
+		for _, description := range strings.Split(descriptions, ",") {
+			derivative, errD := imgr.ParseDerivative(description)
+			if errD != nil {
+				log.Fatal(errD)
+			}
+			derivatives = append(derivatives, derivative)
+		}
+		options = append(options, imgr.WithDerivatives(derivatives...))
+	}
+	if workers := os.Getenv("DERIVATIVE_WORKERS"); workers != "" {
+		number, errW := strconv.Atoi(workers)
+		if errW != nil {
+			log.Fatal(errW)
+		}
+		options = append(options, imgr.WithDerivativeWorkers(number))
+	}
+	if delay := os.Getenv("DERIVATIVE_RETRY_DELAY"); delay != "" {
+		duration, errD := time.ParseDuration(delay)
+		if errD != nil {
+			log.Fatal(errD)
+		}
+		options = append(options, imgr.WithDerivativeRetryDelay(duration))
+	}
+
+	if size := os.Getenv("RENDITION_MAX_DIMENSION"); size != "" {
+		number, errR := strconv.Atoi(size)
+		if errR != nil {
+			log.Fatal(errR)
+		}
+		options = append(options, imgr.WithMaxRenditionDimension(number))
+	}
+
+	// Default quota limits, zero or missing limit means no limit
+	quota := imgr.Quota{}
+	for env, limit := range map[string]*int64{"QUOTA_MAX_BYTES": &quota.MaxBytes, "QUOTA_MAX_IMAGES": &quota.MaxImages} {
+		if value := os.Getenv(env); value != "" {
+			var errQ error
+			if *limit, errQ = strconv.ParseInt(value, 10, 64); errQ != nil {
+				log.Fatal(errQ)
+			}
+		}
+	}
+	options = append(options, imgr.WithQuota(quota))
+
+	// Empty list of kept EXIF tags removes all of them
+	if tags, ok := os.LookupEnv("EXIF_KEEP_TAGS"); ok {
+		kept := make([]string, 0)
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				kept = append(kept, tag)
+			}
+		}
+		options = append(options, imgr.WithKeptEXIFTags(kept...))
+	}
+
+	// Share links are signed by secret derived from JWT secret unless separate secret is configured,
+	// so share tokens can't be used as JWT signatures and the other way around
+	shareSecret := []byte(os.Getenv("SHARE_SECRET"))
+	if len(shareSecret) == 0 {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte("imgr share links"))
+		shareSecret = mac.Sum(nil)
+	}
+	options = append(options, imgr.WithShareSecret(shareSecret))
+
+	if ttl := os.Getenv("UPLOAD_SESSION_TTL"); ttl != "" {
+		duration, errT := time.ParseDuration(ttl)
+		if errT != nil {
+			log.Fatal(errT)
+		}
+		options = append(options, imgr.WithUploadSessionTTL(duration))
+	}
+
+	// Images are imported only from public addresses unless their networks are allow-listed
+	if timeout := os.Getenv("IMPORT_TIMEOUT"); timeout != "" {
+		duration, errT := time.ParseDuration(timeout)
+		if errT != nil {
+			log.Fatal(errT)
+		}
+		options = append(options, imgr.WithImportTimeout(duration))
+	}
+	if allowList := os.Getenv("IMPORT_ALLOW_LIST"); allowList != "" {
+		options = append(options, imgr.WithImportAllowList(strings.Split(allowList, ",")...))
+	}
+
+	imageServer, err := imgr.NewLocalImageServer(storage, options...)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -66,9 +182,35 @@ func main() {
 	mux := goji.NewMux()
 	mux.HandleFunc(pat.Get("/images"), imageServer.ListImages)
 	mux.HandleFunc(pat.Post("/images"), imageServer.PostImage)
+	mux.HandleFunc(pat.Post("/images/import"), imageServer.PostImport)
+	// Usage, tags and archive routes are registered before image route, so they aren't treated as filenames
+	mux.HandleFunc(pat.Get("/images/usage"), imageServer.GetUsage)
+	mux.HandleFunc(pat.Get("/images/tags"), imageServer.ListTags)
+	mux.HandleFunc(pat.Get("/images/archive"), imageServer.GetArchive)
+	sharedImage := pat.Get("/images/:filename")
+	mux.HandleFunc(sharedImage, imageServer.GetImage)
+	mux.HandleFunc(pat.Get("/images/:filename/thumbnail"), imageServer.GetThumbnail)
+	mux.HandleFunc(pat.Put("/images/:filename/tags"), imageServer.PutImageTags)
+	mux.HandleFunc(pat.Post("/images/:filename/share"), imageServer.PostShare)
+	mux.HandleFunc(pat.Delete("/images/:filename/share/:share"), imageServer.DeleteShare)
+	mux.HandleFunc(pat.Patch("/images/:filename"), imageServer.PatchImage)
+	mux.HandleFunc(pat.Delete("/images/:filename"), imageServer.DeleteImage)
+	mux.HandleFunc(pat.Get("/albums"), imageServer.ListAlbums)
+	mux.HandleFunc(pat.Post("/albums"), imageServer.PostAlbum)
+	mux.HandleFunc(pat.Patch("/albums/:album"), imageServer.PatchAlbum)
+	mux.HandleFunc(pat.Delete("/albums/:album"), imageServer.DeleteAlbum)
+	mux.HandleFunc(pat.Get("/albums/:album/images"), imageServer.ListAlbumImages)
+	mux.HandleFunc(pat.Put("/albums/:album/images/:filename"), imageServer.PutAlbumImage)
+	mux.HandleFunc(pat.Delete("/albums/:album/images/:filename"), imageServer.DeleteAlbumImage)
+	mux.HandleFunc(pat.Post("/uploads"), imageServer.PostUpload)
+	mux.HandleFunc(pat.Head("/uploads/:upload"), imageServer.HeadUpload)
+	mux.HandleFunc(pat.Patch("/uploads/:upload"), imageServer.PatchUpload)
+	mux.HandleFunc(pat.Post("/uploads/:upload/finalize"), imageServer.FinalizeUpload)
+	mux.HandleFunc(pat.Delete("/uploads/:upload"), imageServer.DeleteUpload)
 	mux.Use(util.RequestID(log))
 	mux.Use(util.Logger(log))
-	mux.Use(util.CheckJWT([]byte(secret), issuer, log))
+	// Shared images are authorized by share token instead of JWT
+	mux.Use(imgr.SkipForShared(sharedImage, util.CheckJWT([]byte(secret), issuer, log)))
 
 	srv := &http.Server{
 		ReadTimeout:  durations["HTTP_READ_TIMEOUT"],
@@ -77,5 +219,26 @@ func main() {
 		Handler:      mux,
 		Addr:         serverHost,
 	}
-	log.Fatal(srv.ListenAndServe())
+
+	// Server is shut down on interrupt, so requests and background work of image server are finished
+	shutdown := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), durations["HTTP_WRITE_TIMEOUT"])
+		defer cancel()
+		if errS := srv.Shutdown(ctx); errS != nil {
+			log.Error(errS)
+		}
+		close(shutdown)
+	}()
+	if err = srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdown
+	if err = imageServer.Close(); err != nil {
+		log.Error(err)
+	}
+	util.CloseAndCheck(conn, log)
 }
@@ -28,18 +28,73 @@ import (
 
 const imgrSchema = `{
     "$schema": "http://json-schema.org/schema#",
-    "type": "array",
-    "items": {
-        "type": "object",
-        "properties": {
-            "filename": {
-                "type": "string"
+    "type": "object",
+    "properties": {
+        "items": {
+            "type": "array",
+            "items": {
+                "type": "object",
+                "properties": {
+                    "id": {
+                        "type": "integer"
+                    },
+                    "filename": {
+                        "type": "string"
+                    },
+                    "original_name": {
+                        "type": "string"
+                    },
+                    "content_type": {
+                        "type": "string"
+                    },
+                    "size_bytes": {
+                        "type": "integer"
+                    },
+                    "width": {
+                        "type": "integer"
+                    },
+                    "height": {
+                        "type": "integer"
+                    },
+                    "sha256": {
+                        "type": "string"
+                    },
+                    "created_at": {
+                        "type": "string"
+                    }
+                },
+                "required": [
+                    "id",
+                    "filename",
+                    "original_name",
+                    "content_type",
+                    "size_bytes",
+                    "width",
+                    "height",
+                    "sha256",
+                    "created_at"
+                ]
             }
         },
-        "required": [
-            "filename"
-        ]
-    }
+        "total": {
+            "type": "integer"
+        },
+        "limit": {
+            "type": "integer"
+        },
+        "offset": {
+            "type": "integer"
+        },
+        "next_cursor": {
+            "type": "string"
+        }
+    },
+    "required": [
+        "items",
+        "total",
+        "limit",
+        "offset"
+    ]
 }`
 
 func setupAuthServer(t *testing.T, secret []byte, issuer string) (http.Handler, *sqlx.DB) {
@@ -88,6 +143,7 @@ func setupImageServer(t *testing.T, secret []byte, issuer, staticStorage string)
 		storage,
 		imgr.WithStaticFolder(staticStorage),
 		imgr.WithLogger(log),
+		imgr.WithShareSecret(secret),
 	)
 	if err != nil {
 		t.Fatal(err)
@@ -96,9 +152,33 @@ func setupImageServer(t *testing.T, secret []byte, issuer, staticStorage string)
 	mux := goji.NewMux()
 	mux.HandleFunc(pat.Get("/images"), imgrServer.ListImages)
 	mux.HandleFunc(pat.Post("/images"), imgrServer.PostImage)
+	mux.HandleFunc(pat.Post("/images/import"), imgrServer.PostImport)
+	mux.HandleFunc(pat.Get("/images/usage"), imgrServer.GetUsage)
+	mux.HandleFunc(pat.Get("/images/tags"), imgrServer.ListTags)
+	mux.HandleFunc(pat.Get("/images/archive"), imgrServer.GetArchive)
+	sharedImage := pat.Get("/images/:filename")
+	mux.HandleFunc(sharedImage, imgrServer.GetImage)
+	mux.HandleFunc(pat.Get("/images/:filename/thumbnail"), imgrServer.GetThumbnail)
+	mux.HandleFunc(pat.Put("/images/:filename/tags"), imgrServer.PutImageTags)
+	mux.HandleFunc(pat.Post("/images/:filename/share"), imgrServer.PostShare)
+	mux.HandleFunc(pat.Delete("/images/:filename/share/:share"), imgrServer.DeleteShare)
+	mux.HandleFunc(pat.Patch("/images/:filename"), imgrServer.PatchImage)
+	mux.HandleFunc(pat.Delete("/images/:filename"), imgrServer.DeleteImage)
+	mux.HandleFunc(pat.Get("/albums"), imgrServer.ListAlbums)
+	mux.HandleFunc(pat.Post("/albums"), imgrServer.PostAlbum)
+	mux.HandleFunc(pat.Patch("/albums/:album"), imgrServer.PatchAlbum)
+	mux.HandleFunc(pat.Delete("/albums/:album"), imgrServer.DeleteAlbum)
+	mux.HandleFunc(pat.Get("/albums/:album/images"), imgrServer.ListAlbumImages)
+	mux.HandleFunc(pat.Put("/albums/:album/images/:filename"), imgrServer.PutAlbumImage)
+	mux.HandleFunc(pat.Delete("/albums/:album/images/:filename"), imgrServer.DeleteAlbumImage)
+	mux.HandleFunc(pat.Post("/uploads"), imgrServer.PostUpload)
+	mux.HandleFunc(pat.Head("/uploads/:upload"), imgrServer.HeadUpload)
+	mux.HandleFunc(pat.Patch("/uploads/:upload"), imgrServer.PatchUpload)
+	mux.HandleFunc(pat.Post("/uploads/:upload/finalize"), imgrServer.FinalizeUpload)
+	mux.HandleFunc(pat.Delete("/uploads/:upload"), imgrServer.DeleteUpload)
 	mux.Use(util.RequestID(log))
 	mux.Use(util.Logger(log))
-	mux.Use(util.CheckJWT(secret, issuer, log))
+	mux.Use(imgr.SkipForShared(sharedImage, util.CheckJWT(secret, issuer, log)))
 
 	return mux, conn
 }
@@ -157,11 +237,11 @@ func multipleUsersAuthUploadList(t *testing.T, authExpect, imgrExpect *httpexpec
 	imgrExpect.POST("/images").WithMultipart().WithFile("image", createImage(t, folder, "login1")).
 		WithHeader("Authorization", token).
 		Expect().
-		Status(http.StatusCreated).NoContent()
+		Status(http.StatusCreated).JSON().Object().ContainsKey("filename").ContainsKey("url")
 	imgrExpect.POST("/images").WithMultipart().WithFile("image", createImage(t, folder, "login1")).
 		WithHeader("Authorization", token).
 		Expect().
-		Status(http.StatusCreated).NoContent()
+		Status(http.StatusCreated).JSON().Object().ContainsKey("filename").ContainsKey("url")
 
 	// Sign up second user
 	authResp = authExpect.POST("/users/sign_up").WithFormField("login", "login2").WithFormField("password", "password2").
@@ -174,7 +254,7 @@ func multipleUsersAuthUploadList(t *testing.T, authExpect, imgrExpect *httpexpec
 	imgrExpect.POST("/images").WithMultipart().WithFile("image", createImage(t, folder, "login2")).
 		WithHeader("Authorization", token).
 		Expect().
-		Status(http.StatusCreated).NoContent()
+		Status(http.StatusCreated).JSON().Object().ContainsKey("filename").ContainsKey("url")
 
 	// Sign in first user
 	authResp = authExpect.POST("/users/sign_in").WithFormField("login", "login1").WithFormField("password", "password1").
@@ -188,7 +268,7 @@ func multipleUsersAuthUploadList(t *testing.T, authExpect, imgrExpect *httpexpec
 		Expect().
 		Status(http.StatusOK).JSON()
 	imgResp.Schema(imgrSchema)
-	imgResp.Array().Length().Equal(2)
+	imgResp.Object().Value("items").Array().Length().Equal(2)
 	for _, img := range imgResp.Path("$..filename").Array().Iter() {
 		img.String().Match("login1")
 	}
@@ -205,7 +285,7 @@ func multipleUsersAuthUploadList(t *testing.T, authExpect, imgrExpect *httpexpec
 		Expect().
 		Status(http.StatusOK).JSON()
 	imgResp.Schema(imgrSchema)
-	imgResp.Array().Length().Equal(1)
+	imgResp.Object().Value("items").Array().Length().Equal(1)
 	for _, img := range imgResp.Path("$..filename").Array().Iter() {
 		img.String().Match("login2")
 	}
@@ -232,32 +312,32 @@ func singleUserAuthUploadList(t *testing.T, authExpect, imgrExpect *httpexpect.E
 		Expect().
 		Status(http.StatusOK).JSON()
 	imgResp.Schema(imgrSchema)
-	imgResp.Array().Length().Equal(0)
+	imgResp.Object().Value("items").Array().Length().Equal(0)
 
 	// Post images for user
 	imgrExpect.POST("/images").WithMultipart().WithFile("image", createImage(t, folder, "first")).
 		WithHeader("Authorization", token).
 		Expect().
-		Status(http.StatusCreated).NoContent()
+		Status(http.StatusCreated).JSON().Object().ContainsKey("filename").ContainsKey("url")
 	imgrExpect.POST("/images").WithMultipart().WithFile("image", createImage(t, folder, "second")).
 		WithHeader("Authorization", token).
 		Expect().
-		Status(http.StatusCreated).NoContent()
+		Status(http.StatusCreated).JSON().Object().ContainsKey("filename").ContainsKey("url")
 	imgrExpect.POST("/images").WithMultipart().WithFile("image", createImage(t, folder, "third")).
 		WithHeader("Authorization", token).
 		Expect().
-		Status(http.StatusCreated).NoContent()
+		Status(http.StatusCreated).JSON().Object().ContainsKey("filename").ContainsKey("url")
 	imgrExpect.POST("/images").WithMultipart().WithFile("image", createImage(t, folder, "fourth")).
 		WithHeader("Authorization", token).
 		Expect().
-		Status(http.StatusCreated).NoContent()
+		Status(http.StatusCreated).JSON().Object().ContainsKey("filename").ContainsKey("url")
 
 	// Check user images with params
 	imgResp = imgrExpect.GET("/images").WithQuery("limit", 2).WithQuery("offset", 1).WithHeader("Authorization", token).
 		Expect().
 		Status(http.StatusOK).JSON()
 	imgResp.Schema(imgrSchema)
-	imgResp.Array().Length().Equal(2)
+	imgResp.Object().Value("items").Array().Length().Equal(2)
 	for _, img := range imgResp.Path("$..filename").Array().Iter() {
 		img.String().Match("(second)|(third)")
 	}
@@ -0,0 +1,326 @@
+package imgr
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sp4rd4/go-imager/util"
+	"goji.io/pat"
+)
+
+// maxAlbumNameLength is max number of characters in album name.
+const maxAlbumNameLength = 100
+
+// Album is named collection of user images that is stored in database.
+type Album struct {
+	ID        uint64    `json:"id" db:"id"`
+	Name      string    `json:"name" db:"name"`
+	URL       string    `json:"url" db:"-"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UserID    uint64    `json:"-" db:"user_id"`
+}
+
+// albumList is json envelope of albums list.
+type albumList struct {
+	Items []Album `json:"items"`
+}
+
+// albumURL returns URL of album resource.
+func albumURL(id uint64) string {
+	return "/albums/" + strconv.FormatUint(id, 10)
+}
+
+// parseAlbumName returns trimmed album name from form, it should be present and not too long.
+func parseAlbumName(r *http.Request) (string, error) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || utf8.RuneCountInString(name) > maxAlbumNameLength {
+		return "", fmt.Errorf("album name %q is invalid", name)
+	}
+	return name, nil
+}
+
+// loadAlbum loads album from URL path of the current user, sql.ErrNoRows is returned for invalid IDs.
+func (is *LocalImageServer) loadAlbum(r *http.Request, userID uint64) (*Album, error) {
+	id, err := strconv.ParseUint(pat.Param(r, "album"), 10, 64)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	album := &Album{ID: id, UserID: userID}
+	if err = is.storage.LoadAlbum(album); err != nil {
+		return nil, err
+	}
+	return album, nil
+}
+
+// loadAlbumImage loads album and image from URL path, both should belong to the current user.
+func (is *LocalImageServer) loadAlbumImage(r *http.Request, userID uint64) (*Album, *Image, error) {
+	album, err := is.loadAlbum(r, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	image := &Image{Filename: pat.Param(r, "filename"), UserID: userID}
+	if err = is.storage.LoadImage(image); err != nil {
+		return nil, nil, err
+	}
+	return album, image, nil
+}
+
+// writeAlbum writes album as json with given status.
+func writeAlbum(w http.ResponseWriter, status int, album *Album, requestLogger *log.Entry) {
+	album.URL = albumURL(album.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(album); err != nil {
+		requestLogger.Error(err)
+	}
+}
+
+// ListAlbums returns json formatted list of albums of the current user ordered by name.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 no albums will be loaded.
+func (is *LocalImageServer) ListAlbums(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	list := albumList{Items: make([]Album, 0)}
+	if err = is.storage.LoadAlbums(&list.Items, userID); err != nil && err != sql.ErrNoRows {
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+	for i := range list.Items {
+		list.Items[i].URL = albumURL(list.Items[i].ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(list); err != nil {
+		requestLogger.Error(err)
+	}
+}
+
+// PostAlbum creates album of the current user, created album is returned as json
+// with Location header pointing to its URL. Album names are unique for user.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 album will not be created.
+// * name (required) form value with up to 100 characters
+func (is *LocalImageServer) PostAlbum(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	name, err := parseAlbumName(r)
+	if err != nil {
+		requestLogger.Info(err)
+		util.JSONResponse(w, http.StatusUnprocessableEntity, `{"error":"Album name is invalid"}`, requestLogger)
+		return
+	}
+	album := &Album{Name: name, UserID: userID}
+	if err = is.storage.CreateAlbum(album); err != nil {
+		if _, ok := err.(ErrUniqueIndexConflict); ok {
+			requestLogger.Info(err)
+			util.JSONResponse(w, http.StatusConflict, `{"error":"Album name is taken"}`, requestLogger)
+			return
+		}
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+
+	w.Header().Set("Location", albumURL(album.ID))
+	writeAlbum(w, http.StatusCreated, album, requestLogger)
+}
+
+// PatchAlbum renames album of the current user, renamed album is returned as json.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 album will not be renamed.
+// Albums of other users are reported as missing.
+// * album (required) URL path parameter with album ID
+// * name (required) form value with up to 100 characters
+func (is *LocalImageServer) PatchAlbum(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	album, err := is.loadAlbum(r, userID)
+	if err == nil {
+		var name string
+		if name, err = parseAlbumName(r); err != nil {
+			requestLogger.Info(err)
+			util.JSONResponse(w, http.StatusUnprocessableEntity, `{"error":"Album name is invalid"}`, requestLogger)
+			return
+		}
+		album.Name = name
+		err = is.storage.RenameAlbum(album)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			util.JSONResponse(w, http.StatusNotFound, `{"error":"Album not found"}`, requestLogger)
+			return
+		}
+		if _, ok := err.(ErrUniqueIndexConflict); ok {
+			requestLogger.Info(err)
+			util.JSONResponse(w, http.StatusConflict, `{"error":"Album name is taken"}`, requestLogger)
+			return
+		}
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+
+	writeAlbum(w, http.StatusOK, album, requestLogger)
+}
+
+// DeleteAlbum removes album of the current user, images of album are kept.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 album will not be deleted.
+// Albums of other users are reported as missing.
+// * album (required) URL path parameter with album ID
+func (is *LocalImageServer) DeleteAlbum(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	id, err := strconv.ParseUint(pat.Param(r, "album"), 10, 64)
+	if err != nil {
+		err = sql.ErrNoRows
+	} else {
+		err = is.storage.DeleteAlbum(id, userID)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			util.JSONResponse(w, http.StatusNotFound, `{"error":"Album not found"}`, requestLogger)
+			return
+		}
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListAlbumImages returns json formatted list of images in album of the current user,
+// it's paginated, sorted and filtered the same way as ListImages.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 no images will be loaded.
+// Albums of other users are reported as missing.
+// * album (required) URL path parameter with album ID
+// * limit, offset, cursor, sort, content_type, created_after, created_before, name_contains, tag, tag_match
+// Query parameters described by ListImages
+func (is *LocalImageServer) ListAlbumImages(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	album, err := is.loadAlbum(r, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			util.JSONResponse(w, http.StatusNotFound, `{"error":"Album not found"}`, requestLogger)
+			return
+		}
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+	query, err := parseImageQuery(r.URL.Query(), userID)
+	if err != nil {
+		requestLogger.Info(err)
+		body := fmt.Sprintf(`{"error":"Invalid query parameter %s"}`, string(err.(queryParamError)))
+		util.JSONResponse(w, http.StatusBadRequest, body, requestLogger)
+		return
+	}
+	query.AlbumID = album.ID
+	is.writeImageList(w, r, query, requestLogger)
+}
+
+// PutAlbumImage adds image to album, both of them should belong to the current user.
+// Adding image that is already in album succeeds.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 image will not be added.
+// Albums and images of other users are reported as missing.
+// * album (required) URL path parameter with album ID
+// * filename (required) URL path parameter
+func (is *LocalImageServer) PutAlbumImage(w http.ResponseWriter, r *http.Request) {
+	is.changeAlbumImage(w, r, func(album *Album, image *Image) error {
+		return is.storage.AddAlbumImage(album.ID, image.ID)
+	})
+}
+
+// DeleteAlbumImage removes image from album, both of them should belong to the current user.
+// Image itself is kept.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 image will not be removed.
+// Albums and images of other users and images that aren't in album are reported as missing.
+// * album (required) URL path parameter with album ID
+// * filename (required) URL path parameter
+func (is *LocalImageServer) DeleteAlbumImage(w http.ResponseWriter, r *http.Request) {
+	is.changeAlbumImage(w, r, func(album *Album, image *Image) error {
+		return is.storage.RemoveAlbumImage(album.ID, image.ID)
+	})
+}
+
+// changeAlbumImage applies change to album and image from URL path of the current user.
+func (is *LocalImageServer) changeAlbumImage(
+	w http.ResponseWriter, r *http.Request, change func(album *Album, image *Image) error,
+) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	album, image, err := is.loadAlbumImage(r, userID)
+	if err == nil {
+		err = change(album, image)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			util.JSONResponse(w, http.StatusNotFound, `{"error":"Album or image not found"}`, requestLogger)
+			return
+		}
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
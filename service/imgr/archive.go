@@ -0,0 +1,172 @@
+package imgr
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sp4rd4/go-imager/util"
+)
+
+// archiveManifest is name of archive entry describing archived images.
+const archiveManifest = "manifest.json"
+
+// archivePageSize is number of images loaded at once while archive is written.
+const archivePageSize = 100
+
+// imageManifest is json manifest of archived images.
+type imageManifest struct {
+	Items     []Image   `json:"items"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GetArchive streams zip archive of images uploaded by the current user, it's built while it's sent,
+// so images are loaded by pages and their content is copied from blob store to response without temporary files.
+// Archive that fails after it's started is aborted, so client doesn't get incomplete archive as complete one.
+// Every image is stored under its filename, archive ends with manifest.json listing metadata of archived images.
+// Images that are deleted while archive is sent are skipped.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 no images will be archived.
+// Albums of other users are reported as missing.
+// * album (optional) Query parameter with album ID, only images of album are archived
+// * sort, content_type, created_after, created_before, name_contains, tag, tag_match
+// Query parameters described by ListImages
+func (is *LocalImageServer) GetArchive(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	params := r.URL.Query()
+	query, err := parseImageQuery(params, userID)
+	if err == nil && params.Get("album") != "" {
+		if query.AlbumID, err = strconv.ParseUint(params.Get("album"), 10, 64); err != nil {
+			err = queryParamError("album")
+		}
+	}
+	if err != nil {
+		requestLogger.Info(err)
+		body := fmt.Sprintf(`{"error":"Invalid query parameter %s"}`, string(err.(queryParamError)))
+		util.JSONResponse(w, http.StatusBadRequest, body, requestLogger)
+		return
+	}
+	if query.AlbumID > 0 {
+		if err = is.storage.LoadAlbum(&Album{ID: query.AlbumID, UserID: userID}); err != nil {
+			if err == sql.ErrNoRows {
+				util.JSONResponse(w, http.StatusNotFound, `{"error":"Album not found"}`, requestLogger)
+				return
+			}
+			requestLogger.Error(err)
+			util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+			return
+		}
+	}
+	// Archive includes all selected images, so pagination of request is ignored,
+	// first page is loaded before response is started, so its failure is still reported
+	query.Limit, query.Offset, query.After = archivePageSize, 0, nil
+	images, err := is.loadArchivePage(query)
+	if err != nil {
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="images.zip"`)
+	w.WriteHeader(http.StatusOK)
+	if err = is.writeArchive(r, w, query, images, requestLogger); err != nil {
+		requestLogger.Error(err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// loadArchivePage loads page of archived images along with their variants and tags.
+func (is *LocalImageServer) loadArchivePage(query ImageQuery) ([]Image, error) {
+	images := make([]Image, 0)
+	err := is.storage.LoadImages(&images, query)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	for i := range images {
+		images[i].URL = imageURL(images[i].Filename)
+	}
+	if err == nil {
+		err = is.setVariants(images)
+	}
+	if err == nil {
+		err = is.setTags(images)
+	}
+	return images, err
+}
+
+// writeArchive writes zip archive of images and their manifest, images is the first page of query,
+// following pages are loaded after previous ones are written.
+func (is *LocalImageServer) writeArchive(
+	r *http.Request, w io.Writer, query ImageQuery, images []Image, requestLogger *log.Entry,
+) error {
+	zw := zip.NewWriter(w)
+	manifest := imageManifest{Items: make([]Image, 0, len(images)), CreatedAt: time.Now().UTC()}
+	for len(images) > 0 {
+		for _, image := range images {
+			blob, err := is.blobs.Get(r.Context(), image.blobKey())
+			if err == ErrBlobNotFound {
+				requestLogger.Warnf("content of %s is missing, image isn't archived", image.Filename)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			err = writeArchiveEntry(zw, image, blob)
+			if errC := blob.Close(); errC != nil && err == nil {
+				err = errC
+			}
+			if err != nil {
+				return err
+			}
+			manifest.Items = append(manifest.Items, image)
+		}
+		if uint64(len(images)) < query.Limit {
+			break
+		}
+		query.After = &images[len(images)-1]
+		var err error
+		if images, err = is.loadArchivePage(query); err != nil {
+			return err
+		}
+	}
+
+	// Manifest is written last, so it lists only archived images
+	header := &zip.FileHeader{Name: archiveManifest, Method: zip.Deflate, Modified: manifest.CreatedAt}
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// writeArchiveEntry copies image content to archive entry named by its filename,
+// images are compressed already, so their content is stored as is.
+func writeArchiveEntry(zw *zip.Writer, image Image, content io.Reader) error {
+	entry, err := zw.CreateHeader(&zip.FileHeader{Name: image.Filename, Method: zip.Store, Modified: image.CreatedAt})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, content)
+	return err
+}
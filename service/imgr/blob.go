@@ -0,0 +1,280 @@
+package imgr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBlobNotFound is returned by BlobStore methods when there is no blob with given key.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore defines storage for uploaded images content.
+// Keys are slash separated relative paths, e.g. "filename.png" or "renditions/filename.png".
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (BlobInfo, error)
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+}
+
+// BlobInfo describes blob stored in BlobStore.
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// FolderBlobStore is BlobStore that keeps blobs as files in local folder.
+type FolderBlobStore struct {
+	path string
+}
+
+// tempPrefix marks files that are being written by FolderBlobStore.
+const tempPrefix = ".upload-"
+
+// NewFolderBlobStore creates FolderBlobStore for existing folder.
+func NewFolderBlobStore(folder string) (*FolderBlobStore, error) {
+	fileInfo, err := os.Stat(folder)
+	if err != nil {
+		return nil, err
+	}
+	if !fileInfo.IsDir() {
+		return nil, errors.New("path is not pointing to folder")
+	}
+	return &FolderBlobStore{folder}, nil
+}
+
+// Put writes blob into file, file is replaced atomically after whole content is written.
+func (fs *FolderBlobStore) Put(ctx context.Context, key string, r io.Reader) (err error) {
+	name, err := fs.filename(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// Get opens blob file for reading.
+func (fs *FolderBlobStore) Get(_ context.Context, key string) (io.ReadSeekCloser, error) {
+	name, err := fs.filename(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return file, err
+}
+
+// Delete removes blob file.
+func (fs *FolderBlobStore) Delete(_ context.Context, key string) error {
+	name, err := fs.filename(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(name)
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+// Stat returns info about blob file.
+func (fs *FolderBlobStore) Stat(_ context.Context, key string) (BlobInfo, error) {
+	name, err := fs.filename(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	fileInfo, err := os.Stat(name)
+	if os.IsNotExist(err) || (err == nil && fileInfo.IsDir()) {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{key, fileInfo.Size(), fileInfo.ModTime()}, nil
+}
+
+// List returns info about blobs which keys start with prefix, ordered by key.
+// Only folder of prefix is walked, so blobs of other folders aren't visited.
+func (fs *FolderBlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	blobs := make([]BlobInfo, 0)
+	root := fs.path
+	if dir := prefix[:strings.LastIndex(prefix, "/")+1]; dir != "" {
+		name, err := fs.filename(strings.TrimSuffix(dir, "/"))
+		if err != nil {
+			return nil, err
+		}
+		root = name
+	}
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return blobs, nil
+	}
+	err := filepath.Walk(root, func(name string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if fileInfo.IsDir() || strings.HasPrefix(fileInfo.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(fs.path, name)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			blobs = append(blobs, BlobInfo{key, fileInfo.Size(), fileInfo.ModTime()})
+		}
+		return nil
+	})
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Key < blobs[j].Key })
+	return blobs, err
+}
+
+func (fs *FolderBlobStore) filename(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(fs.path, filepath.FromSlash(key)), nil
+}
+
+// checkKey doesn't allow keys that could point outside of store or conflict with temporary files.
+func checkKey(key string) error {
+	if key == "" || path.IsAbs(key) || path.Clean(key) != key {
+		return errors.New("invalid blob key")
+	}
+	for _, part := range strings.Split(key, "/") {
+		if strings.HasPrefix(part, ".") || strings.ContainsRune(part, '\\') {
+			return errors.New("invalid blob key")
+		}
+	}
+	return nil
+}
+
+// MemoryBlobStore is BlobStore that keeps blobs in memory, it is safe for concurrent use.
+type MemoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string]memoryBlob
+}
+
+type memoryBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+type memoryBlobReader struct {
+	*bytes.Reader
+}
+
+func (memoryBlobReader) Close() error {
+	return nil
+}
+
+// NewMemoryBlobStore creates empty MemoryBlobStore.
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{blobs: make(map[string]memoryBlob)}
+}
+
+// Put reads whole content and saves it under key.
+func (ms *MemoryBlobStore) Put(ctx context.Context, key string, r io.Reader) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.blobs[key] = memoryBlob{data, time.Now()}
+	return nil
+}
+
+// Get returns reader over blob content.
+func (ms *MemoryBlobStore) Get(_ context.Context, key string) (io.ReadSeekCloser, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	blob, ok := ms.blobs[key]
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	return memoryBlobReader{bytes.NewReader(blob.data)}, nil
+}
+
+// Delete removes blob.
+func (ms *MemoryBlobStore) Delete(_ context.Context, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.blobs[key]; !ok {
+		return ErrBlobNotFound
+	}
+	delete(ms.blobs, key)
+	return nil
+}
+
+// Stat returns info about blob.
+func (ms *MemoryBlobStore) Stat(_ context.Context, key string) (BlobInfo, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	blob, ok := ms.blobs[key]
+	if !ok {
+		return BlobInfo{}, ErrBlobNotFound
+	}
+	return BlobInfo{key, int64(len(blob.data)), blob.modTime}, nil
+}
+
+// List returns info about blobs which keys start with prefix, ordered by key.
+func (ms *MemoryBlobStore) List(_ context.Context, prefix string) ([]BlobInfo, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	blobs := make([]BlobInfo, 0)
+	for key, blob := range ms.blobs {
+		if strings.HasPrefix(key, prefix) {
+			blobs = append(blobs, BlobInfo{key, int64(len(blob.data)), blob.modTime})
+		}
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Key < blobs[j].Key })
+	return blobs, nil
+}
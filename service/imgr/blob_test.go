@@ -0,0 +1,149 @@
+package imgr_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sp4rd4/go-imager/service/imgr"
+)
+
+func TestNewFolderBlobStore(t *testing.T) {
+	folder, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(folder)
+	file, err := ioutil.TempFile(folder, "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	examples := []struct {
+		name    string
+		path    string
+		wantErr error
+	}{
+		{"Invalid path", "/missingfolder", errors.New("stat /missingfolder: no such file or directory")},
+		{"File path", file.Name(), errors.New("path is not pointing to folder")},
+		{"OK", folder, nil},
+	}
+	for _, ex := range examples {
+		t.Run(ex.name, func(t *testing.T) {
+			_, err := imgr.NewFolderBlobStore(ex.path)
+			if ex.wantErr != nil {
+				assert.EqualError(t, err, ex.wantErr.Error(), "Expected different error")
+			} else {
+				assert.Nil(t, err, "Expected different error")
+			}
+		})
+	}
+}
+
+func TestFolderBlobStore(t *testing.T) {
+	folder, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal("Unable to create temp dir")
+	}
+	defer os.RemoveAll(folder)
+	store, err := imgr.NewFolderBlobStore(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store)
+}
+
+func TestMemoryBlobStore(t *testing.T) {
+	testBlobStore(t, imgr.NewMemoryBlobStore())
+}
+
+// testBlobStore checks behaviour every BlobStore implementation should have.
+func testBlobStore(t *testing.T, store imgr.BlobStore) {
+	ctx := context.Background()
+	blobs := map[string]string{
+		"image1.png":              "first",
+		"image2.png":              "second",
+		"renditions/image1.png/a": "rendition",
+	}
+	for key, content := range blobs {
+		if err := store.Put(ctx, key, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Get", func(t *testing.T) {
+		blob, err := store.Get(ctx, "renditions/image1.png/a")
+		if assert.Nil(t, err, "Existing blob should be returned") {
+			defer blob.Close()
+			b, err := ioutil.ReadAll(blob)
+			assert.Nil(t, err, "Blob should be readable")
+			assert.Equal(t, "rendition", string(b), "Blob content is not as expected")
+		}
+		_, err = store.Get(ctx, "missing.png")
+		assert.Equal(t, imgr.ErrBlobNotFound, err, "Missing blob should be reported")
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		if err := store.Put(ctx, "image2.png", strings.NewReader("replaced")); err != nil {
+			t.Fatal(err)
+		}
+		info, err := store.Stat(ctx, "image2.png")
+		assert.Nil(t, err, "Existing blob should be described")
+		assert.Equal(t, "image2.png", info.Key, "Blob key is not as expected")
+		assert.Equal(t, int64(len("replaced")), info.Size, "Blob size is not as expected")
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		info, err := store.Stat(ctx, "image1.png")
+		assert.Nil(t, err, "Existing blob should be described")
+		assert.Equal(t, imgr.BlobInfo{Key: "image1.png", Size: 5, ModTime: info.ModTime}, info)
+		assert.False(t, info.ModTime.IsZero(), "Blob modification time should be set")
+		_, err = store.Stat(ctx, "missing.png")
+		assert.Equal(t, imgr.ErrBlobNotFound, err, "Missing blob should be reported")
+	})
+
+	t.Run("List", func(t *testing.T) {
+		infos, err := store.List(ctx, "image")
+		assert.Nil(t, err, "Blobs should be listed")
+		keys := make([]string, 0)
+		for _, info := range infos {
+			keys = append(keys, info.Key)
+		}
+		assert.Equal(t, []string{"image1.png", "image2.png"}, keys, "Listed blobs are not as expected")
+
+		infos, err = store.List(ctx, "renditions/")
+		assert.Nil(t, err, "Blobs should be listed")
+		assert.Equal(t, 1, len(infos), "Listed blobs are not as expected")
+
+		infos, err = store.List(ctx, "missing/")
+		assert.Nil(t, err, "Missing folder should be listed")
+		assert.Empty(t, infos, "Missing folder should have no blobs")
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		assert.Nil(t, store.Delete(ctx, "image1.png"), "Existing blob should be deleted")
+		_, err := store.Get(ctx, "image1.png")
+		assert.Equal(t, imgr.ErrBlobNotFound, err, "Deleted blob should be missing")
+		assert.Equal(t, imgr.ErrBlobNotFound, store.Delete(ctx, "image1.png"), "Missing blob should be reported")
+	})
+
+	t.Run("Invalid keys", func(t *testing.T) {
+		for _, key := range []string{"", "../image.png", "/image.png", "a//b", ".hidden"} {
+			assert.NotNil(t, store.Put(ctx, key, strings.NewReader("content")), "Key %q should be rejected", key)
+		}
+	})
+
+	t.Run("Canceled context", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		assert.NotNil(t, store.Put(canceled, "canceled.png", strings.NewReader("content")), "Put should fail")
+		_, err := store.Stat(ctx, "canceled.png")
+		assert.Equal(t, imgr.ErrBlobNotFound, err, "Canceled blob should not be stored")
+	})
+}
@@ -1,7 +1,9 @@
 package imgr_test
 
 import (
+	"database/sql"
 	"errors"
+	"time"
 
 	"github.com/sp4rd4/go-imager/service/imgr"
 )
@@ -36,9 +38,7 @@ var examplesDBCreateImage = []struct {
 var examplesDBLoadImages = []struct {
 	name    string
 	initial []imgr.Image
-	limit   uint64
-	offset  uint64
-	userID  uint64
+	query   imgr.ImageQuery
 	want    []imgr.Image
 	wantErr error
 }{
@@ -49,9 +49,7 @@ var examplesDBLoadImages = []struct {
 			{Filename: "filename2", UserID: 1},
 			{Filename: "filename3", UserID: 2},
 		},
-		limit:  0,
-		offset: 0,
-		userID: 1,
+		query: imgr.ImageQuery{UserID: 1},
 		want: []imgr.Image{
 			{Filename: "filename1", UserID: 1},
 			{Filename: "filename2", UserID: 1},
@@ -65,9 +63,7 @@ var examplesDBLoadImages = []struct {
 			{Filename: "filename3", UserID: 2},
 			{Filename: "filename4", UserID: 1},
 		},
-		limit:   1,
-		offset:  0,
-		userID:  1,
+		query:   imgr.ImageQuery{UserID: 1, Limit: 1},
 		want:    []imgr.Image{{Filename: "filename1", UserID: 1}},
 		wantErr: nil,
 	},
@@ -79,15 +75,112 @@ var examplesDBLoadImages = []struct {
 			{Filename: "filename3", UserID: 2},
 			{Filename: "filename4", UserID: 1},
 		},
-		limit:  2,
-		offset: 1,
-		userID: 1,
+		query: imgr.ImageQuery{UserID: 1, Limit: 2, Offset: 1},
 		want: []imgr.Image{
 			{Filename: "filename2", UserID: 1},
 			{Filename: "filename4", UserID: 1},
 		},
 		wantErr: nil,
 	},
+	{
+		name: "Two records after filename with limit 2",
+		initial: []imgr.Image{
+			{Filename: "filename1", UserID: 1},
+			{Filename: "filename2", UserID: 1},
+			{Filename: "filename3", UserID: 2},
+			{Filename: "filename4", UserID: 1},
+			{Filename: "filename5", UserID: 1},
+			{Filename: "filename6", UserID: 1},
+		},
+		query: imgr.ImageQuery{UserID: 1, After: &imgr.Image{Filename: "filename2"}, Limit: 2},
+		want: []imgr.Image{
+			{Filename: "filename4", UserID: 1},
+			{Filename: "filename5", UserID: 1},
+		},
+		wantErr: nil,
+	},
+	{
+		name: "Sorted by size after image",
+		initial: []imgr.Image{
+			{Filename: "filename1", Size: 30, UserID: 1},
+			{Filename: "filename2", Size: 10, UserID: 1},
+			{Filename: "filename3", Size: 20, UserID: 1},
+			{Filename: "filename4", Size: 10, UserID: 1},
+			{Filename: "filename5", Size: 20, UserID: 2},
+		},
+		query: imgr.ImageQuery{UserID: 1, Sort: "size", After: &imgr.Image{Filename: "filename2", Size: 10}},
+		want: []imgr.Image{
+			{Filename: "filename4", Size: 10, UserID: 1},
+			{Filename: "filename3", Size: 20, UserID: 1},
+			{Filename: "filename1", Size: 30, UserID: 1},
+		},
+		wantErr: nil,
+	},
+	{
+		name: "Sorted by creation time descending with limit 2",
+		initial: []imgr.Image{
+			{Filename: "filename1", CreatedAt: time.Date(2018, 4, 1, 0, 0, 0, 0, time.UTC), UserID: 1},
+			{Filename: "filename2", CreatedAt: time.Date(2018, 4, 3, 0, 0, 0, 0, time.UTC), UserID: 1},
+			{Filename: "filename3", CreatedAt: time.Date(2018, 4, 2, 0, 0, 0, 0, time.UTC), UserID: 1},
+		},
+		query: imgr.ImageQuery{UserID: 1, Sort: "-created_at", Limit: 2},
+		want: []imgr.Image{
+			{Filename: "filename2", UserID: 1},
+			{Filename: "filename3", UserID: 1},
+		},
+		wantErr: nil,
+	},
+	{
+		name: "Filtered",
+		initial: []imgr.Image{
+			{
+				Filename:     "filename1",
+				OriginalName: "Cat.png",
+				ContentType:  "image/png",
+				CreatedAt:    time.Date(2018, 4, 2, 0, 0, 0, 0, time.UTC),
+				UserID:       1,
+			},
+			{
+				Filename:     "filename2",
+				OriginalName: "cat.gif",
+				ContentType:  "image/gif",
+				CreatedAt:    time.Date(2018, 4, 2, 0, 0, 0, 0, time.UTC),
+				UserID:       1,
+			},
+			{
+				Filename:     "filename3",
+				OriginalName: "dog.png",
+				ContentType:  "image/png",
+				CreatedAt:    time.Date(2018, 4, 2, 0, 0, 0, 0, time.UTC),
+				UserID:       1,
+			},
+			{
+				Filename:     "filename4",
+				OriginalName: "bobcat.png",
+				ContentType:  "image/png",
+				CreatedAt:    time.Date(2018, 4, 5, 0, 0, 0, 0, time.UTC),
+				UserID:       1,
+			},
+		},
+		query: imgr.ImageQuery{
+			UserID:        1,
+			ContentType:   "image/png",
+			CreatedAfter:  time.Date(2018, 4, 1, 0, 0, 0, 0, time.UTC),
+			CreatedBefore: time.Date(2018, 4, 3, 0, 0, 0, 0, time.UTC),
+			NameContains:  "CAT",
+		},
+		want: []imgr.Image{
+			{Filename: "filename1", OriginalName: "Cat.png", ContentType: "image/png", UserID: 1},
+		},
+		wantErr: nil,
+	},
+	{
+		name:    "Unknown sort",
+		initial: []imgr.Image{{Filename: "filename1", UserID: 1}},
+		query:   imgr.ImageQuery{UserID: 1, Sort: "-size"},
+		want:    []imgr.Image{},
+		wantErr: errors.New("sort -size isn't supported"),
+	},
 	{
 		name: "No records",
 		initial: []imgr.Image{
@@ -96,10 +189,154 @@ var examplesDBLoadImages = []struct {
 			{Filename: "filename3", UserID: 2},
 			{Filename: "filename4", UserID: 5},
 		},
-		limit:   2,
-		offset:  1,
-		userID:  1,
+		query:   imgr.ImageQuery{UserID: 1, Limit: 2, Offset: 1},
 		want:    []imgr.Image{},
 		wantErr: nil,
 	},
 }
+
+var examplesDBCountImages = []struct {
+	name    string
+	initial []imgr.Image
+	query   imgr.ImageQuery
+	want    uint64
+	wantErr error
+}{
+	{
+		name: "Own images",
+		initial: []imgr.Image{
+			{Filename: "filename1", UserID: 1},
+			{Filename: "filename2", UserID: 2},
+			{Filename: "filename3", UserID: 1},
+		},
+		query:   imgr.ImageQuery{UserID: 1, Limit: 1, Offset: 1},
+		want:    2,
+		wantErr: nil,
+	},
+	{
+		name: "Filtered images",
+		initial: []imgr.Image{
+			{Filename: "filename1", ContentType: "image/png", UserID: 1},
+			{Filename: "filename2", ContentType: "image/gif", UserID: 1},
+			{Filename: "filename3", ContentType: "image/png", UserID: 1},
+		},
+		query:   imgr.ImageQuery{UserID: 1, ContentType: "image/gif"},
+		want:    1,
+		wantErr: nil,
+	},
+	{
+		name:    "No images",
+		initial: []imgr.Image{{Filename: "filename1", UserID: 2}},
+		query:   imgr.ImageQuery{UserID: 1},
+		want:    0,
+		wantErr: nil,
+	},
+}
+
+var examplesDBLoadImage = []struct {
+	name    string
+	initial []imgr.Image
+	input   *imgr.Image
+	want    *imgr.Image
+	wantErr error
+}{
+	{
+		name: "Own image",
+		initial: []imgr.Image{
+			{Filename: "filename1", UserID: 1},
+			{Filename: "filename2", UserID: 2},
+		},
+		input:   &imgr.Image{Filename: "filename1", UserID: 1},
+		want:    &imgr.Image{Filename: "filename1", UserID: 1},
+		wantErr: nil,
+	},
+	{
+		name: "Image with metadata",
+		initial: []imgr.Image{{
+			Filename:     "filename1",
+			OriginalName: "photo.png",
+			ContentType:  "image/png",
+			Size:         1024,
+			Width:        640,
+			Height:       480,
+			SHA256:       "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+			UserID:       1,
+		}},
+		input: &imgr.Image{Filename: "filename1", UserID: 1},
+		want: &imgr.Image{
+			Filename:     "filename1",
+			OriginalName: "photo.png",
+			ContentType:  "image/png",
+			Size:         1024,
+			Width:        640,
+			Height:       480,
+			SHA256:       "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+			UserID:       1,
+		},
+		wantErr: nil,
+	},
+	{
+		name: "Image of other user",
+		initial: []imgr.Image{
+			{Filename: "filename1", UserID: 1},
+			{Filename: "filename2", UserID: 2},
+		},
+		input:   &imgr.Image{Filename: "filename2", UserID: 1},
+		want:    &imgr.Image{Filename: "filename2", UserID: 1},
+		wantErr: sql.ErrNoRows,
+	},
+	{
+		name:    "Empty filename",
+		initial: []imgr.Image{{Filename: "filename1", UserID: 1}},
+		input:   &imgr.Image{UserID: 1},
+		want:    &imgr.Image{UserID: 1},
+		wantErr: sql.ErrNoRows,
+	},
+	{
+		name:    "Missing image",
+		initial: []imgr.Image{},
+		input:   nil,
+		want:    nil,
+		wantErr: errors.New("image required"),
+	},
+}
+
+var examplesDBDeleteImage = []struct {
+	name     string
+	initial  []imgr.Image
+	filename string
+	userID   uint64
+	want     []imgr.Image
+	wantErr  error
+}{
+	{
+		name: "Own image",
+		initial: []imgr.Image{
+			{Filename: "filename1", UserID: 1},
+			{Filename: "filename2", UserID: 1},
+		},
+		filename: "filename1",
+		userID:   1,
+		want:     []imgr.Image{{Filename: "filename2", UserID: 1}},
+		wantErr:  nil,
+	},
+	{
+		name: "Image of other user",
+		initial: []imgr.Image{
+			{Filename: "filename1", UserID: 1},
+			{Filename: "filename2", UserID: 2},
+		},
+		filename: "filename2",
+		userID:   1,
+		want:     []imgr.Image{{Filename: "filename1", UserID: 1}},
+		wantErr:  sql.ErrNoRows,
+	},
+	{
+		name:     "Missing image",
+		initial:  []imgr.Image{{Filename: "filename1", UserID: 1}},
+		filename: "filename3",
+		userID:   1,
+		want:     []imgr.Image{{Filename: "filename1", UserID: 1}},
+		wantErr:  sql.ErrNoRows,
+	},
+}
@@ -2,7 +2,9 @@ package imgr_test
 
 import (
 	"net/http"
+	"strings"
 
+	"github.com/sp4rd4/go-imager/service/imgr"
 	"github.com/sp4rd4/go-imager/util"
 )
 
@@ -11,6 +13,9 @@ const (
 	fileValid
 	fileBroken
 	fileNonImage
+	fileMalformed
+	fileGIF
+	fileEXIF
 )
 
 type requestPost struct {
@@ -20,6 +25,50 @@ type requestPost struct {
 type requestList struct {
 	limit   uint64
 	offset  uint64
+	cursor  string
+	filters map[string]string
+	tags    []string
+	context map[util.RequestKey]interface{}
+}
+
+type requestGet struct {
+	filename string
+	headers  map[string]string
+	context  map[util.RequestKey]interface{}
+}
+
+type requestAlbum struct {
+	method  string
+	path    string
+	name    string
+	context map[util.RequestKey]interface{}
+}
+
+type requestTags struct {
+	method  string
+	path    string
+	tags    []string
+	context map[util.RequestKey]interface{}
+}
+
+type requestShare struct {
+	method  string
+	path    string
+	form    map[string]string
+	context map[util.RequestKey]interface{}
+}
+
+type requestUpload struct {
+	method  string
+	path    string
+	headers map[string]string
+	context map[util.RequestKey]interface{}
+}
+
+type requestDetails struct {
+	path    string
+	form    map[string]string
+	ifMatch string
 	context map[util.RequestKey]interface{}
 }
 
@@ -36,28 +85,30 @@ func (u stubUser) ID() uint64 {
 }
 
 var examplesLocalImageServerPostImage = []struct {
-	name       string
-	staticPath bool
-	storage    bool
+	name      string
+	blobStore bool
+	storage   bool
+	options   []imgr.Option
 	requestPost
 	want
 }{
 	{
-		name:       "OK",
-		staticPath: true,
-		storage:    true,
+		name:      "OK",
+		blobStore: true,
+		storage:   true,
 		requestPost: requestPost{
 			file:    fileValid,
 			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
 		},
 		want: want{
+			body:       `"url":"/images/[0-9A-Z]{26}image.png"`,
 			statusCode: http.StatusCreated,
 		},
 	},
 	{
-		name:       "No user",
-		staticPath: true,
-		storage:    true,
+		name:      "No user",
+		blobStore: true,
+		storage:   true,
 		requestPost: requestPost{
 			file:    fileValid,
 			context: map[util.RequestKey]interface{}{},
@@ -69,9 +120,9 @@ var examplesLocalImageServerPostImage = []struct {
 		},
 	},
 	{
-		name:       "No body",
-		staticPath: true,
-		storage:    true,
+		name:      "No body",
+		blobStore: true,
+		storage:   true,
 		requestPost: requestPost{
 			file:    fileMissing,
 			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
@@ -83,37 +134,108 @@ var examplesLocalImageServerPostImage = []struct {
 		},
 	},
 	{
-		name:       "Not image",
-		staticPath: true,
-		storage:    true,
+		name:      "Not image",
+		blobStore: true,
+		storage:   true,
 		requestPost: requestPost{
 			file:    fileNonImage,
 			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
 		},
 		want: want{
-			body:       `{"error":"No image is present"}`,
-			statusCode: http.StatusUnprocessableEntity,
-			logMessage: "content type is incorrect",
+			body:       `{"error":"Unsupported image format"}`,
+			statusCode: http.StatusUnsupportedMediaType,
+			logMessage: "image: unknown format",
 		},
 	},
 	{
-		name:       "Invalid form",
-		staticPath: true,
-		storage:    true,
+		name:      "Invalid form",
+		blobStore: true,
+		storage:   true,
 		requestPost: requestPost{
 			file:    fileBroken,
 			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
 		},
 		want: want{
-			body:       `{"error":"No image is present"}`,
+			body:       `{"error":"Unsupported image format"}`,
+			statusCode: http.StatusUnsupportedMediaType,
+			logMessage: "image: unknown format",
+		},
+	},
+	{
+		name:      "GIF",
+		blobStore: true,
+		storage:   true,
+		requestPost: requestPost{
+			file:    fileGIF,
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			statusCode: http.StatusCreated,
+		},
+	},
+	{
+		name:      "Not allowed format",
+		blobStore: true,
+		storage:   true,
+		options:   []imgr.Option{imgr.WithAllowedFormats("jpeg", "gif")},
+		requestPost: requestPost{
+			file:    fileValid,
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Unsupported image format"}`,
+			statusCode: http.StatusUnsupportedMediaType,
+			logMessage: "format png isn't allowed",
+		},
+	},
+	{
+		name:      "Malformed image",
+		blobStore: true,
+		storage:   true,
+		requestPost: requestPost{
+			file:    fileMalformed,
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Image is malformed"}`,
 			statusCode: http.StatusUnprocessableEntity,
-			logMessage: "content type is incorrect",
+			logMessage: "image header is malformed",
 		},
 	},
 	{
-		name:       "Bad static folder",
-		staticPath: false,
-		storage:    true,
+		name:      "Dimensions too large",
+		blobStore: true,
+		storage:   true,
+		options:   []imgr.Option{imgr.WithMaxDimensions(40, 100)},
+		requestPost: requestPost{
+			file:    fileValid,
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Image dimensions are too large"}`,
+			statusCode: http.StatusUnprocessableEntity,
+			logMessage: "image dimensions 50x50 exceed 40x100",
+		},
+	},
+	{
+		name:      "Too large",
+		blobStore: true,
+		storage:   true,
+		options:   []imgr.Option{imgr.WithMaxUploadSize(64)},
+		requestPost: requestPost{
+			file:    fileValid,
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Image is too large"}`,
+			statusCode: http.StatusRequestEntityTooLarge,
+			logMessage: "image exceeds max upload size",
+		},
+	},
+	{
+		name:      "Bad blob store",
+		blobStore: false,
+		storage:   true,
 		requestPost: requestPost{
 			file:    fileValid,
 			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
@@ -121,13 +243,13 @@ var examplesLocalImageServerPostImage = []struct {
 		want: want{
 			body:       `{"error":"Internal server error"}`,
 			statusCode: http.StatusInternalServerError,
-			logMessage: "no such file or directory",
+			logMessage: "blob store error",
 		},
 	},
 	{
-		name:       "Bad storage",
-		staticPath: true,
-		storage:    false,
+		name:      "Bad storage",
+		blobStore: true,
+		storage:   false,
 		requestPost: requestPost{
 			file:    fileValid,
 			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
@@ -168,6 +290,219 @@ var examplesLocalImageServerListImages = []struct {
 			statusCode: http.StatusOK,
 		},
 	},
+	{
+		name:    "Next cursor",
+		storage: true,
+		requestList: requestList{
+			limit:   2,
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `"next_cursor":"[\w-]+"`,
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "Invalid cursor",
+		storage: true,
+		requestList: requestList{
+			limit:   2,
+			cursor:  "filename2",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Invalid query parameter cursor"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter cursor",
+		},
+	},
+	{
+		name:    "Cursor of other sort",
+		storage: true,
+		requestList: requestList{
+			limit:   2,
+			cursor:  "eyJvIjoic2l6ZSIsImYiOiJmaWxlbmFtZTIifQ",
+			filters: map[string]string{"sort": "filename"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Invalid query parameter cursor"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter cursor",
+		},
+	},
+	{
+		name:    "Sort and filters",
+		storage: true,
+		requestList: requestList{
+			filters: map[string]string{
+				"sort":           "-created_at",
+				"content_type":   "image/png",
+				"created_after":  "2018-04-01T00:00:00Z",
+				"created_before": "2018-05-01T00:00:00+03:00",
+				"name_contains":  "cat",
+			},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "Tag filter",
+		storage: true,
+		requestList: requestList{
+			tags:    []string{"Cats", "outdoor"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"items":\[{"id":2,"filename":"filename2",[^{}]*"tags":\["cats","outdoor"\]}\]`,
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "Any tag filter",
+		storage: true,
+		requestList: requestList{
+			tags:    []string{"cats", "outdoor"},
+			filters: map[string]string{"tag_match": "any"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"items":\[{"id":1,"filename":"filename1",[^{}]*"tags":\["cats"\]},{"id":2,[^{}]*}\]`,
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "Invalid tag",
+		storage: true,
+		requestList: requestList{
+			tags:    []string{"cats", "big cats"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Invalid query parameter tag"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter tag",
+		},
+	},
+	{
+		name:    "Invalid tag match",
+		storage: true,
+		requestList: requestList{
+			filters: map[string]string{"tag_match": "some"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Invalid query parameter tag_match"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter tag_match",
+		},
+	},
+	{
+		name:    "Invalid limit",
+		storage: true,
+		requestList: requestList{
+			filters: map[string]string{"limit": "-1"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Invalid query parameter limit"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter limit",
+		},
+	},
+	{
+		name:    "Invalid offset",
+		storage: true,
+		requestList: requestList{
+			filters: map[string]string{"offset": "first"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Invalid query parameter offset"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter offset",
+		},
+	},
+	{
+		name:    "Too big limit",
+		storage: true,
+		requestList: requestList{
+			filters: map[string]string{"limit": "9223372036854775808"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Invalid query parameter limit"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter limit",
+		},
+	},
+	{
+		name:    "Too big offset",
+		storage: true,
+		requestList: requestList{
+			filters: map[string]string{"offset": "9223372036854775808"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Invalid query parameter offset"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter offset",
+		},
+	},
+	{
+		name:    "Unknown sort",
+		storage: true,
+		requestList: requestList{
+			filters: map[string]string{"sort": "-size"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Invalid query parameter sort"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter sort",
+		},
+	},
+	{
+		name:    "Unknown content type",
+		storage: true,
+		requestList: requestList{
+			filters: map[string]string{"content_type": "text/plain"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Invalid query parameter content_type"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter content_type",
+		},
+	},
+	{
+		name:    "Invalid created after",
+		storage: true,
+		requestList: requestList{
+			filters: map[string]string{"created_after": "yesterday"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Invalid query parameter created_after"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter created_after",
+		},
+	},
+	{
+		name:    "Invalid created before",
+		storage: true,
+		requestList: requestList{
+			filters: map[string]string{"created_before": "2018-04-01"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Invalid query parameter created_before"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter created_before",
+		},
+	},
 	{
 		name:    "No user",
 		storage: true,
@@ -195,3 +530,1532 @@ var examplesLocalImageServerListImages = []struct {
 		},
 	},
 }
+
+var examplesLocalImageServerGetImageConversion = []struct {
+	name     string
+	query    string
+	wantType string
+	requestGet
+	want
+}{
+	{
+		name:     "Original",
+		wantType: "image/png",
+		want: want{
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:     "Format",
+		query:    "format=jpeg",
+		wantType: "image/jpeg",
+		want: want{
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:     "Quality",
+		query:    "format=jpeg&quality=40",
+		wantType: "image/jpeg",
+		want: want{
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:     "Accept",
+		wantType: "image/gif",
+		requestGet: requestGet{
+			headers: map[string]string{"Accept": "image/gif"},
+		},
+		want: want{
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:     "Accept quality values",
+		wantType: "image/jpeg",
+		requestGet: requestGet{
+			headers: map[string]string{"Accept": "image/png;q=0.5, image/jpeg, image/gif;q=0.9"},
+		},
+		want: want{
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:     "Accept wildcard",
+		wantType: "image/png",
+		requestGet: requestGet{
+			headers: map[string]string{"Accept": "image/webp,image/*;q=0.8"},
+		},
+		want: want{
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:     "Format overrides Accept",
+		query:    "format=gif",
+		wantType: "image/gif",
+		requestGet: requestGet{
+			headers: map[string]string{"Accept": "image/png"},
+		},
+		want: want{
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name: "Not acceptable",
+		requestGet: requestGet{
+			headers: map[string]string{"Accept": "text/html, image/png;q=0"},
+		},
+		want: want{
+			body:       `{"error":"Image format is not acceptable"}`,
+			statusCode: http.StatusNotAcceptable,
+			logMessage: "no acceptable image format",
+		},
+	},
+	{
+		name:  "Unknown format",
+		query: "format=bmp",
+		want: want{
+			body:       `{"error":"Invalid query parameter format"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter format",
+		},
+	},
+	{
+		name:  "Quality of PNG",
+		query: "format=png&quality=40",
+		want: want{
+			body:       `{"error":"Invalid query parameter quality"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter quality",
+		},
+	},
+	{
+		name:  "Invalid quality",
+		query: "format=jpeg&quality=101",
+		want: want{
+			body:       `{"error":"Invalid query parameter quality"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter quality",
+		},
+	},
+}
+
+var examplesLocalImageServerGetThumbnail = []struct {
+	name       string
+	storage    bool
+	query      string
+	wantWidth  int
+	wantHeight int
+	wantType   string
+	requestGet
+	want
+}{
+	{
+		name:       "Contain",
+		storage:    true,
+		query:      "w=10&h=10",
+		wantWidth:  10,
+		wantHeight: 5,
+		wantType:   "image/png",
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:       "Cover",
+		storage:    true,
+		query:      "w=10&h=10&fit=cover",
+		wantWidth:  10,
+		wantHeight: 10,
+		wantType:   "image/png",
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:       "Height only",
+		storage:    true,
+		query:      "h=4",
+		wantWidth:  8,
+		wantHeight: 4,
+		wantType:   "image/png",
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:       "Other format",
+		storage:    true,
+		query:      "w=20&format=jpeg",
+		wantWidth:  20,
+		wantHeight: 10,
+		wantType:   "image/jpeg",
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:       "Not upscaled",
+		storage:    true,
+		query:      "w=80&h=80",
+		wantWidth:  40,
+		wantHeight: 20,
+		wantType:   "image/png",
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "Cached",
+		storage: true,
+		query:   "w=10",
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       "^renditions/1/10x0-contain-q0.png content$",
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "Missing size",
+		storage: true,
+		query:   "fit=cover",
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Invalid query parameter w"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter w",
+		},
+	},
+	{
+		name:    "Invalid height",
+		storage: true,
+		query:   "w=10&h=0",
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Invalid query parameter h"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter h",
+		},
+	},
+	{
+		name:    "Too wide",
+		storage: true,
+		query:   "w=100000",
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Invalid query parameter w"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter w",
+		},
+	},
+	{
+		name:    "Over max rendition",
+		storage: true,
+		query:   "w=4096",
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Invalid query parameter w"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter w",
+		},
+	},
+	{
+		name:    "Unknown fit",
+		storage: true,
+		query:   "w=10&fit=fill",
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Invalid query parameter fit"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter fit",
+		},
+	},
+	{
+		name:    "Unknown format",
+		storage: true,
+		query:   "w=10&format=webp",
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Invalid query parameter format"}`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid query parameter format",
+		},
+	},
+	{
+		name:    "Other user image",
+		storage: true,
+		query:   "w=10",
+		requestGet: requestGet{
+			filename: "image2.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Image not found"}`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "Missing file",
+		storage: true,
+		query:   "w=10",
+		requestGet: requestGet{
+			filename: "image4.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Image not found"}`,
+			statusCode: http.StatusNotFound,
+			logMessage: "blob not found",
+		},
+	},
+	{
+		name:    "No user",
+		storage: true,
+		query:   "w=10",
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{},
+		},
+		want: want{
+			body:       `{"error":"Unauthorized"}`,
+			statusCode: http.StatusUnauthorized,
+			logMessage: "no valid user_id provided",
+		},
+	},
+	{
+		name:    "Bad storage",
+		storage: false,
+		query:   "w=10",
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Internal server error"}`,
+			statusCode: http.StatusInternalServerError,
+			logMessage: "storage error",
+		},
+	},
+}
+
+var examplesLocalImageServerGetImage = []struct {
+	name    string
+	storage bool
+	requestGet
+	want
+}{
+	{
+		name:    "OK",
+		storage: true,
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       "image1.png content",
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "Range",
+		storage: true,
+		requestGet: requestGet{
+			filename: "image1.png",
+			headers:  map[string]string{"Range": "bytes=11-17"},
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       "content",
+			statusCode: http.StatusPartialContent,
+		},
+	},
+	{
+		name:    "Not modified",
+		storage: true,
+		requestGet: requestGet{
+			filename: "image1.png",
+			headers: map[string]string{
+				"If-None-Match": `"61ecbb6ea03d0015dcf7336f38772b2e04257a6e79c90fec17bdd0c283d2e4e6-v0"`,
+			},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			statusCode: http.StatusNotModified,
+		},
+	},
+	{
+		name:    "Modified",
+		storage: true,
+		requestGet: requestGet{
+			filename: "image1.png",
+			headers:  map[string]string{"If-None-Match": `"61ecbb6ea03d0015dcf7336f38772b2e04257a6e79c90fec17bdd0c283d2e4e6"`},
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       "image1.png content",
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "Image of other user",
+		storage: true,
+		requestGet: requestGet{
+			filename: "image2.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Image not found"}`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "Missing file",
+		storage: true,
+		requestGet: requestGet{
+			filename: "image3.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Image not found"}`,
+			statusCode: http.StatusNotFound,
+			logMessage: "blob not found",
+		},
+	},
+	{
+		name:    "No user",
+		storage: true,
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{},
+		},
+		want: want{
+			body:       `{"error":"Unauthorized"}`,
+			statusCode: http.StatusUnauthorized,
+			logMessage: "no valid user_id provided",
+		},
+	},
+	{
+		name:    "Bad storage",
+		storage: false,
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Internal server error"}`,
+			statusCode: http.StatusInternalServerError,
+			logMessage: "storage error",
+		},
+	},
+}
+
+var examplesLocalImageServerDeleteImage = []struct {
+	name      string
+	storage   bool
+	blobStore bool
+	requestGet
+	want
+	wantRemoved bool
+}{
+	{
+		name:      "OK",
+		storage:   true,
+		blobStore: true,
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			statusCode: http.StatusNoContent,
+		},
+		wantRemoved: true,
+	},
+	{
+		name:      "Image of other user",
+		storage:   true,
+		blobStore: true,
+		requestGet: requestGet{
+			filename: "image2.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Image not found"}`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:      "Missing file",
+		storage:   true,
+		blobStore: true,
+		requestGet: requestGet{
+			filename: "image3.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			statusCode: http.StatusNoContent,
+		},
+		wantRemoved: true,
+	},
+	{
+		name:      "Unremovable blob",
+		storage:   true,
+		blobStore: false,
+		requestGet: requestGet{
+			filename: "image4.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Internal server error"}`,
+			statusCode: http.StatusInternalServerError,
+			logMessage: "blob store error",
+		},
+	},
+	{
+		name:      "No user",
+		storage:   true,
+		blobStore: true,
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{},
+		},
+		want: want{
+			body:       `{"error":"Unauthorized"}`,
+			statusCode: http.StatusUnauthorized,
+			logMessage: "no valid user_id provided",
+		},
+	},
+	{
+		name:      "Bad storage",
+		storage:   false,
+		blobStore: true,
+		requestGet: requestGet{
+			filename: "image1.png",
+			context:  map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Internal server error"}`,
+			statusCode: http.StatusInternalServerError,
+			logMessage: "storage error",
+		},
+	},
+}
+
+var examplesLocalImageServerGetUsage = []struct {
+	name    string
+	storage bool
+	requestGet
+	want
+}{
+	{
+		name:    "Default quota",
+		storage: true,
+		requestGet: requestGet{
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"used_bytes":2048,"used_images":3,"max_bytes":4096,"max_images":10}` + "\n",
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "Overridden quota",
+		storage: true,
+		requestGet: requestGet{
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(2)},
+		},
+		want: want{
+			body:       `{"used_bytes":2048,"used_images":3,"max_bytes":1048576,"max_images":10}` + "\n",
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "Unauthorized",
+		storage: true,
+		want: want{
+			body:       `{"error":"Unauthorized"}`,
+			statusCode: http.StatusUnauthorized,
+			logMessage: "no valid user_id provided",
+		},
+	},
+	{
+		name:    "Storage error",
+		storage: false,
+		requestGet: requestGet{
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Internal server error"}`,
+			statusCode: http.StatusInternalServerError,
+			logMessage: "storage error",
+		},
+	},
+}
+
+var examplesLocalImageServerAlbums = []struct {
+	name    string
+	storage bool
+	requestAlbum
+	want
+}{
+	{
+		name:    "List albums",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "GET",
+			path:    "/albums",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"items":[{"id":1,"name":"Holidays","url":"/albums/1","created_at":"2018-04-04T00:00:00Z"}]}` + "\n",
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "Create album",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "POST",
+			path:    "/albums",
+			name:    "Summer 2018",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"id":3,"name":"Summer 2018","url":"/albums/3","created_at":"2018-04-04T00:00:00Z"}` + "\n",
+			statusCode: http.StatusCreated,
+		},
+	},
+	{
+		name:    "Create album with trimmed name",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "POST",
+			path:    "/albums",
+			name:    "  Summer  ",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"id":3,"name":"Summer","url":"/albums/3","created_at":"2018-04-04T00:00:00Z"}` + "\n",
+			statusCode: http.StatusCreated,
+		},
+	},
+	{
+		name:    "Create album without name",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "POST",
+			path:    "/albums",
+			name:    "   ",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Album name is invalid"}`,
+			statusCode: http.StatusUnprocessableEntity,
+			logMessage: "album name \"\" is invalid",
+		},
+	},
+	{
+		name:    "Create album with long name",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "POST",
+			path:    "/albums",
+			name:    strings.Repeat("a", 101),
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Album name is invalid"}`,
+			statusCode: http.StatusUnprocessableEntity,
+			logMessage: "album name .* is invalid",
+		},
+	},
+	{
+		name:    "Create album with taken name",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "POST",
+			path:    "/albums",
+			name:    "Taken",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Album name is taken"}`,
+			statusCode: http.StatusConflict,
+			logMessage: "albums",
+		},
+	},
+	{
+		name:    "Rename album",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "PATCH",
+			path:    "/albums/1",
+			name:    "Trips",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"id":1,"name":"Trips","url":"/albums/1","created_at":"2018-04-04T00:00:00Z"}` + "\n",
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "Rename album to taken name",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "PATCH",
+			path:    "/albums/1",
+			name:    "Taken",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Album name is taken"}`,
+			statusCode: http.StatusConflict,
+			logMessage: "albums",
+		},
+	},
+	{
+		name:    "Rename album without name",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "PATCH",
+			path:    "/albums/1",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Album name is invalid"}`,
+			statusCode: http.StatusUnprocessableEntity,
+			logMessage: "album name \"\" is invalid",
+		},
+	},
+	{
+		name:    "Rename album of other user",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "PATCH",
+			path:    "/albums/2",
+			name:    "Trips",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Album not found"}`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "Rename album with invalid ID",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "PATCH",
+			path:    "/albums/first",
+			name:    "Trips",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Album not found"}`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "Delete album",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "DELETE",
+			path:    "/albums/1",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       ``,
+			statusCode: http.StatusNoContent,
+		},
+	},
+	{
+		name:    "Delete album of other user",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "DELETE",
+			path:    "/albums/2",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Album not found"}`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "List album images",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "GET",
+			path:    "/albums/1/images",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"items":[],"total":0,"limit":0,"offset":0}` + "\n",
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "List images of missing album",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "GET",
+			path:    "/albums/5/images",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Album not found"}`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "Add image to album",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "PUT",
+			path:    "/albums/1/images/image1.png",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       ``,
+			statusCode: http.StatusNoContent,
+		},
+	},
+	{
+		name:    "Add image of other user to album",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "PUT",
+			path:    "/albums/1/images/image2.png",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Album or image not found"}`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "Add image to album of other user",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "PUT",
+			path:    "/albums/2/images/image1.png",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Album or image not found"}`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "Remove image from album",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "DELETE",
+			path:    "/albums/1/images/image1.png",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       ``,
+			statusCode: http.StatusNoContent,
+		},
+	},
+	{
+		name:    "Remove image that isn't in album",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method:  "DELETE",
+			path:    "/albums/1/images/image3.png",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Album or image not found"}`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "Unauthorized",
+		storage: true,
+		requestAlbum: requestAlbum{
+			method: "GET",
+			path:   "/albums",
+		},
+		want: want{
+			body:       `{"error":"Unauthorized"}`,
+			statusCode: http.StatusUnauthorized,
+			logMessage: "no valid user_id provided",
+		},
+	},
+	{
+		name:    "Storage error",
+		storage: false,
+		requestAlbum: requestAlbum{
+			method:  "POST",
+			path:    "/albums",
+			name:    "Summer",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Internal server error"}`,
+			statusCode: http.StatusInternalServerError,
+			logMessage: "storage error",
+		},
+	},
+}
+
+var examplesLocalImageServerTags = []struct {
+	name    string
+	storage bool
+	requestTags
+	want
+}{
+	{
+		name:    "Set tags",
+		storage: true,
+		requestTags: requestTags{
+			method:  "PUT",
+			path:    "/images/image1.png/tags",
+			tags:    []string{"Outdoor", " cats", "cats"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"tags":["cats","outdoor"]}` + "\n",
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "Remove tags",
+		storage: true,
+		requestTags: requestTags{
+			method:  "PUT",
+			path:    "/images/image1.png/tags",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"tags":[]}` + "\n",
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "Invalid tag",
+		storage: true,
+		requestTags: requestTags{
+			method:  "PUT",
+			path:    "/images/image1.png/tags",
+			tags:    []string{"cats", "-cats"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Tags are invalid"}`,
+			statusCode: http.StatusUnprocessableEntity,
+			logMessage: "tag \"-cats\" is invalid",
+		},
+	},
+	{
+		name:    "Long tag",
+		storage: true,
+		requestTags: requestTags{
+			method:  "PUT",
+			path:    "/images/image1.png/tags",
+			tags:    []string{strings.Repeat("a", 51)},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Tags are invalid"}`,
+			statusCode: http.StatusUnprocessableEntity,
+			logMessage: "tag \"a+\" is invalid",
+		},
+	},
+	{
+		name:    "Too many tags",
+		storage: true,
+		requestTags: requestTags{
+			method:  "PUT",
+			path:    "/images/image1.png/tags",
+			tags:    strings.Fields("a b c d e f g h i j k l m n o p q r s t u"),
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Tags are invalid"}`,
+			statusCode: http.StatusUnprocessableEntity,
+			logMessage: "image can't have more than 20 tags",
+		},
+	},
+	{
+		name:    "Tags of image of other user",
+		storage: true,
+		requestTags: requestTags{
+			method:  "PUT",
+			path:    "/images/image2.png/tags",
+			tags:    []string{"cats"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Image not found"}`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "List tags",
+		storage: true,
+		requestTags: requestTags{
+			method:  "GET",
+			path:    "/images/tags",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"items":[{"tag":"cats","count":2},{"tag":"outdoor","count":1}]}` + "\n",
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "List tags of user without tags",
+		storage: true,
+		requestTags: requestTags{
+			method:  "GET",
+			path:    "/images/tags",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(2)},
+		},
+		want: want{
+			body:       `{"items":[]}` + "\n",
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "Unauthorized",
+		storage: true,
+		requestTags: requestTags{
+			method: "GET",
+			path:   "/images/tags",
+		},
+		want: want{
+			body:       `{"error":"Unauthorized"}`,
+			statusCode: http.StatusUnauthorized,
+			logMessage: "no valid user_id provided",
+		},
+	},
+	{
+		name:    "Storage error",
+		storage: false,
+		requestTags: requestTags{
+			method:  "PUT",
+			path:    "/images/image1.png/tags",
+			tags:    []string{"cats"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `{"error":"Internal server error"}`,
+			statusCode: http.StatusInternalServerError,
+			logMessage: "storage error",
+		},
+	},
+}
+
+var examplesLocalImageServerShares = []struct {
+	name    string
+	storage bool
+	requestShare
+	want
+}{
+	{
+		name:    "Create share",
+		storage: true,
+		requestShare: requestShare{
+			method:  "POST",
+			path:    "/images/image1.png/share",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"id":1,"url":"/images/image1.png\?share=1\.\d+\.[\w-]+","expires_at":"[^"]+","max_views":0,`,
+			statusCode: http.StatusCreated,
+		},
+	},
+	{
+		name:    "Create share with limits",
+		storage: true,
+		requestShare: requestShare{
+			method:  "POST",
+			path:    "/images/image1.png/share",
+			form:    map[string]string{"expires_in": "60", "max_views": "3"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"id":4,"url":"/images/image1.png\?share=4\.\d+\.[\w-]+","expires_at":"[^"]+","max_views":3,`,
+			statusCode: http.StatusCreated,
+		},
+	},
+	{
+		name:    "Too long expiration",
+		storage: true,
+		requestShare: requestShare{
+			method:  "POST",
+			path:    "/images/image1.png/share",
+			form:    map[string]string{"expires_in": "2592001"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Invalid form value expires_in"}$`,
+			statusCode: http.StatusUnprocessableEntity,
+			logMessage: "invalid form value expires_in",
+		},
+	},
+	{
+		name:    "Negative max views",
+		storage: true,
+		requestShare: requestShare{
+			method:  "POST",
+			path:    "/images/image1.png/share",
+			form:    map[string]string{"max_views": "-1"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Invalid form value max_views"}$`,
+			statusCode: http.StatusUnprocessableEntity,
+			logMessage: "invalid form value max_views",
+		},
+	},
+	{
+		name:    "Share image of other user",
+		storage: true,
+		requestShare: requestShare{
+			method:  "POST",
+			path:    "/images/image2.png/share",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Image not found"}$`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "Revoke share",
+		storage: true,
+		requestShare: requestShare{
+			method:  "DELETE",
+			path:    "/images/image1.png/share/1",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^$`,
+			statusCode: http.StatusNoContent,
+		},
+	},
+	{
+		name:    "Revoke missing share",
+		storage: true,
+		requestShare: requestShare{
+			method:  "DELETE",
+			path:    "/images/image1.png/share/2",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Image or share not found"}$`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "Revoke share with invalid ID",
+		storage: true,
+		requestShare: requestShare{
+			method:  "DELETE",
+			path:    "/images/image1.png/share/first",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Image or share not found"}$`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "Revoke share of image of other user",
+		storage: true,
+		requestShare: requestShare{
+			method:  "DELETE",
+			path:    "/images/image2.png/share/1",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Image or share not found"}$`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "Unauthorized",
+		storage: true,
+		requestShare: requestShare{
+			method: "POST",
+			path:   "/images/image1.png/share",
+		},
+		want: want{
+			body:       `^{"error":"Unauthorized"}$`,
+			statusCode: http.StatusUnauthorized,
+			logMessage: "no valid user_id provided",
+		},
+	},
+	{
+		name:    "Storage error",
+		storage: false,
+		requestShare: requestShare{
+			method:  "POST",
+			path:    "/images/image1.png/share",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Internal server error"}$`,
+			statusCode: http.StatusInternalServerError,
+			logMessage: "storage error",
+		},
+	},
+}
+
+var examplesLocalImageServerUploads = []struct {
+	name    string
+	storage bool
+	requestUpload
+	want
+}{
+	{
+		name:    "Create upload",
+		storage: true,
+		requestUpload: requestUpload{
+			method:  "POST",
+			path:    "/uploads",
+			headers: map[string]string{"Upload-Length": "100", "Upload-Metadata": "filename aW1hZ2UucG5n"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body: `^{"id":"[0-9A-Z]{26}","url":"/uploads/[0-9A-Z]{26}","filename":"image.png","length":100,"offset":0,` +
+				`"created_at":"[^"]+","updated_at":"[^"]+"}\n$`,
+			statusCode: http.StatusCreated,
+		},
+	},
+	{
+		name:    "Upload with other metadata",
+		storage: true,
+		requestUpload: requestUpload{
+			method:  "POST",
+			path:    "/uploads",
+			headers: map[string]string{"Upload-Length": "100", "Upload-Metadata": "type aW1hZ2U=,filename aW1hZ2UucG5n"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"id":"[0-9A-Z]{26}","url":"/uploads/[0-9A-Z]{26}","filename":"image.png","length":100,`,
+			statusCode: http.StatusCreated,
+		},
+	},
+	{
+		name:    "Upload without length",
+		storage: true,
+		requestUpload: requestUpload{
+			method:  "POST",
+			path:    "/uploads",
+			headers: map[string]string{"Upload-Metadata": "filename aW1hZ2UucG5n"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Invalid header Upload-Length"}$`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid header Upload-Length",
+		},
+	},
+	{
+		name:    "Upload exceeding max size",
+		storage: true,
+		requestUpload: requestUpload{
+			method:  "POST",
+			path:    "/uploads",
+			headers: map[string]string{"Upload-Length": "52428801", "Upload-Metadata": "filename aW1hZ2UucG5n"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Image is too large"}$`,
+			statusCode: http.StatusRequestEntityTooLarge,
+			logMessage: "image exceeds max upload size",
+		},
+	},
+	{
+		name:    "Upload without filename",
+		storage: true,
+		requestUpload: requestUpload{
+			method:  "POST",
+			path:    "/uploads",
+			headers: map[string]string{"Upload-Length": "100", "Upload-Metadata": "filename !!!"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Invalid header Upload-Metadata"}$`,
+			statusCode: http.StatusBadRequest,
+			logMessage: "invalid header Upload-Metadata",
+		},
+	},
+	{
+		name:    "Missing upload progress",
+		storage: true,
+		requestUpload: requestUpload{
+			method:  "HEAD",
+			path:    "/uploads/01CAZXMDDNQ63H7ZEA53Y0G4K0",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^$`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "Chunk of missing upload",
+		storage: true,
+		requestUpload: requestUpload{
+			method:  "PATCH",
+			path:    "/uploads/01CAZXMDDNQ63H7ZEA53Y0G4K0",
+			headers: map[string]string{"Upload-Offset": "0", "Content-Type": "application/offset+octet-stream"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Upload not found"}$`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "Finalize missing upload",
+		storage: true,
+		requestUpload: requestUpload{
+			method:  "POST",
+			path:    "/uploads/01CAZXMDDNQ63H7ZEA53Y0G4K0/finalize",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Upload not found"}$`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "Delete missing upload",
+		storage: true,
+		requestUpload: requestUpload{
+			method:  "DELETE",
+			path:    "/uploads/01CAZXMDDNQ63H7ZEA53Y0G4K0",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Upload not found"}$`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "Unauthorized",
+		storage: true,
+		requestUpload: requestUpload{
+			method:  "POST",
+			path:    "/uploads",
+			headers: map[string]string{"Upload-Length": "100", "Upload-Metadata": "filename aW1hZ2UucG5n"},
+		},
+		want: want{
+			body:       `^{"error":"Unauthorized"}$`,
+			statusCode: http.StatusUnauthorized,
+			logMessage: "no valid user_id provided",
+		},
+	},
+	{
+		name:    "Storage error",
+		storage: false,
+		requestUpload: requestUpload{
+			method:  "POST",
+			path:    "/uploads",
+			headers: map[string]string{"Upload-Length": "100", "Upload-Metadata": "filename aW1hZ2UucG5n"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Internal server error"}$`,
+			statusCode: http.StatusInternalServerError,
+			logMessage: "storage error",
+		},
+	},
+}
+
+var examplesLocalImageServerPatchImage = []struct {
+	name    string
+	storage bool
+	requestDetails
+	want
+}{
+	{
+		name:    "Update details",
+		storage: true,
+		requestDetails: requestDetails{
+			path:    "/images/image1.png",
+			form:    map[string]string{"display_name": " Sunset ", "description": "Beach at dusk", "alt_text": "Red sky"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body: `^{"id":1,"filename":"image1.png","url":"/images/image1.png",.*"created_at":"2018-04-04T00:00:00Z",` +
+				`"display_name":"Sunset","description":"Beach at dusk","alt_text":"Red sky","version":1}\n$`,
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "Update matching version",
+		storage: true,
+		requestDetails: requestDetails{
+			path:    "/images/image1.png",
+			form:    map[string]string{"alt_text": "Red sky"},
+			ifMatch: `"v7", "61ecbb6ea03d0015dcf7336f38772b2e04257a6e79c90fec17bdd0c283d2e4e6-v0"`,
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `"alt_text":"Red sky","version":1}\n$`,
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "Update any version",
+		storage: true,
+		requestDetails: requestDetails{
+			path:    "/images/image1.png",
+			form:    map[string]string{"display_name": "Sunset"},
+			ifMatch: "*",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `"display_name":"Sunset","version":1}\n$`,
+			statusCode: http.StatusOK,
+		},
+	},
+	{
+		name:    "Stale version",
+		storage: true,
+		requestDetails: requestDetails{
+			path:    "/images/image1.png",
+			form:    map[string]string{"display_name": "Sunset"},
+			ifMatch: `"v5"`,
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Image was modified"}$`,
+			statusCode: http.StatusPreconditionFailed,
+			logMessage: `image image1.png version 0 doesn't match "v5"`,
+		},
+	},
+	{
+		name:    "Concurrently modified image",
+		storage: true,
+		requestDetails: requestDetails{
+			path:    "/images/image3.png",
+			form:    map[string]string{"display_name": "Sunset"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Image was modified"}$`,
+			statusCode: http.StatusPreconditionFailed,
+			logMessage: "image image3.png is modified since version 0",
+		},
+	},
+	{
+		name:    "Too long display name",
+		storage: true,
+		requestDetails: requestDetails{
+			path:    "/images/image1.png",
+			form:    map[string]string{"display_name": strings.Repeat("a", 256)},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Invalid form value display_name"}$`,
+			statusCode: http.StatusUnprocessableEntity,
+			logMessage: "invalid form value display_name",
+		},
+	},
+	{
+		name:    "Missing details",
+		storage: true,
+		requestDetails: requestDetails{
+			path:    "/images/image1.png",
+			form:    map[string]string{"name": "Sunset"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Image details are missing"}$`,
+			statusCode: http.StatusUnprocessableEntity,
+			logMessage: "image details are missing in form",
+		},
+	},
+	{
+		name:    "Image of other user",
+		storage: true,
+		requestDetails: requestDetails{
+			path:    "/images/image2.png",
+			form:    map[string]string{"display_name": "Sunset"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Image not found"}$`,
+			statusCode: http.StatusNotFound,
+		},
+	},
+	{
+		name:    "Unauthorized",
+		storage: true,
+		requestDetails: requestDetails{
+			path: "/images/image1.png",
+			form: map[string]string{"display_name": "Sunset"},
+		},
+		want: want{
+			body:       `^{"error":"Unauthorized"}$`,
+			statusCode: http.StatusUnauthorized,
+			logMessage: "no valid user_id provided",
+		},
+	},
+	{
+		name:    "Storage error",
+		storage: false,
+		requestDetails: requestDetails{
+			path:    "/images/image1.png",
+			form:    map[string]string{"display_name": "Sunset"},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+		},
+		want: want{
+			body:       `^{"error":"Internal server error"}$`,
+			statusCode: http.StatusInternalServerError,
+			logMessage: "storage error",
+		},
+	},
+}
@@ -0,0 +1,108 @@
+package imgr
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// errNotAcceptable is returned when image can't be converted to any format accepted by client.
+var errNotAcceptable = errors.New("no acceptable image format")
+
+// formatsOrder defines formats preferred for conversion when client accepts several of them equally.
+var formatsOrder = []string{"png", "jpeg", "gif"}
+
+// parseConversion returns rendition image should be converted to, format is taken from format query parameter
+// or negotiated by Accept header. Zero rendition format means that original image should be served.
+func parseConversion(r *http.Request, img *Image) (rendition, error) {
+	original := imageFormat(img)
+	params := r.URL.Query()
+	rn := rendition{format: params.Get("format")}
+	if rn.format != "" {
+		if _, ok := contentTypes[rn.format]; !ok {
+			return rn, queryParamError("format")
+		}
+	} else {
+		var err error
+		if rn.format, err = negotiateFormat(r.Header.Get("Accept"), original); err != nil {
+			return rn, err
+		}
+	}
+
+	if v := params.Get("quality"); v != "" {
+		var err error
+		if rn.quality, err = strconv.Atoi(v); err != nil || rn.quality < 1 || rn.quality > 100 || rn.format != "jpeg" {
+			return rn, queryParamError("quality")
+		}
+	} else if rn.format == original {
+		return rendition{}, nil
+	} else if rn.format == "jpeg" {
+		rn.quality = DefaultJPEGQuality
+	}
+	return rn, nil
+}
+
+// negotiateFormat picks format with highest quality value in Accept header,
+// original format is preferred among equally accepted ones.
+func negotiateFormat(accept, original string) (string, error) {
+	if strings.TrimSpace(accept) == "" {
+		return original, nil
+	}
+	ranges := parseAccept(accept)
+	candidates := append([]string{original}, formatsOrder...)
+	best, bestQ := "", 0.0
+	for _, format := range candidates {
+		if q := acceptQuality(ranges, contentTypes[format]); q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	if best == "" {
+		return "", errNotAcceptable
+	}
+	return best, nil
+}
+
+// mediaRange is media range of Accept header with its quality value.
+type mediaRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept parses Accept header, ranges are ordered from the most specific ones.
+func parseAccept(accept string) []mediaRange {
+	ranges := make([]mediaRange, 0)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mr := mediaRange{strings.ToLower(strings.TrimSpace(params[0])), 1}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil || q < 0 || q > 1 {
+					q = 0
+				}
+				mr.q = q
+			}
+		}
+		if mr.mediaType != "" {
+			ranges = append(ranges, mr)
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return strings.Count(ranges[i].mediaType, "*") < strings.Count(ranges[j].mediaType, "*")
+	})
+	return ranges
+}
+
+// acceptQuality returns quality value of the most specific media range matching content type.
+func acceptQuality(ranges []mediaRange, contentType string) float64 {
+	mainType := strings.SplitN(contentType, "/", 2)[0]
+	for _, mr := range ranges {
+		if mr.mediaType == contentType || mr.mediaType == mainType+"/*" || mr.mediaType == "*/*" {
+			return mr.q
+		}
+	}
+	return 0
+}
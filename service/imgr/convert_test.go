@@ -0,0 +1,33 @@
+package imgr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	examples := []struct {
+		name     string
+		accept   string
+		original string
+		want     string
+		wantErr  error
+	}{
+		{"Missing", "", "gif", "gif", nil},
+		{"Any", "*/*", "jpeg", "jpeg", nil},
+		{"Exact", "image/png", "gif", "png", nil},
+		{"Quality values", "image/png;q=0.4, image/gif;q=0.6", "jpeg", "gif", nil},
+		{"Specific overrides wildcard", "image/*, image/gif;q=0", "gif", "png", nil},
+		{"Original preferred", "image/jpeg, image/png", "png", "png", nil},
+		{"Not acceptable", "text/html, application/json", "png", "", errNotAcceptable},
+		{"Invalid quality", "image/png;q=2", "png", "", errNotAcceptable},
+	}
+	for _, ex := range examples {
+		t.Run(ex.name, func(t *testing.T) {
+			format, err := negotiateFormat(ex.accept, ex.original)
+			assert.Equal(t, ex.wantErr, err, "Incorrect error")
+			assert.Equal(t, ex.want, format, "Incorrect format")
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package imgr
+
+import (
+	"context"
+	"fmt"
+)
+
+// contentKey returns blob key image content with given checksum is stored under,
+// images with identical content share the same blob.
+func contentKey(sha256 string) string {
+	return "content/" + sha256
+}
+
+// uploadKey returns blob key uploaded image is stored under until its checksum is known.
+func uploadKey(id string) string {
+	return "uploads/" + id
+}
+
+// blobKey returns key of image content in blob store.
+// Images uploaded before deduplication own blobs stored under their filenames.
+func (img *Image) blobKey() string {
+	if img.BlobKey == "" {
+		return img.Filename
+	}
+	return img.BlobKey
+}
+
+// storeContent moves uploaded blob to content blob of created image, unless content is already stored.
+// Image record should be created before, so content blob isn't removed by concurrent deletion.
+func (is *LocalImageServer) storeContent(ctx context.Context, upload string, image *Image) (err error) {
+	defer func() {
+		if errD := is.blobs.Delete(ctx, upload); errD != nil && errD != ErrBlobNotFound {
+			if err == nil {
+				err = errD
+			} else {
+				err = fmt.Errorf("First: %s, Second: %s", err, errD)
+			}
+		}
+	}()
+
+	if _, err = is.blobs.Stat(ctx, image.BlobKey); err != ErrBlobNotFound {
+		return err
+	}
+	content, err := is.blobs.Get(ctx, upload)
+	if err != nil {
+		return err
+	}
+	err = is.blobs.Put(ctx, image.BlobKey, content)
+	if errC := content.Close(); errC != nil && err == nil {
+		err = errC
+	}
+	return err
+}
+
+// removeBlob returns function removing blob of deleted image from blob store, it's passed to Storage.DeleteImage,
+// so image record is kept if its blob can't be removed. Missing blob is treated as removed.
+func (is *LocalImageServer) removeBlob(ctx context.Context) func(key string) error {
+	return func(key string) error {
+		if err := is.blobs.Delete(ctx, key); err != nil && err != ErrBlobNotFound {
+			return err
+		}
+		return nil
+	}
+}
@@ -0,0 +1,310 @@
+package imgr
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultDerivativeWorkers is number of workers generating derivatives used by LocalImageServer.
+const DefaultDerivativeWorkers = 2
+
+// derivativeQueueSize is number of derivatives every worker can have waiting for generation.
+const derivativeQueueSize = 16
+
+// DefaultDerivativeRetryDelay is time derivatives stay pending or failed before their generation is queued again
+// unless other time is set.
+const DefaultDerivativeRetryDelay = time.Minute
+
+// maxDerivativeAttempts is number of times generation of derivative is attempted before it's left failed.
+const maxDerivativeAttempts = 3
+
+// Statuses of derivative generation.
+const (
+	DerivativePending = "pending"
+	DerivativeReady   = "ready"
+	DerivativeFailed  = "failed"
+)
+
+// Derivative is named rendition generated for every uploaded image,
+// zero width or height is calculated from the other one keeping aspect ratio.
+type Derivative struct {
+	Name   string
+	Width  int
+	Height int
+	Fit    string
+}
+
+// ImageDerivative describes generation of image derivative that is stored in database.
+type ImageDerivative struct {
+	ImageID uint64 `db:"image_id"`
+	Name    string `db:"name"`
+	Status  string `db:"status"`
+}
+
+// PendingDerivative is derivative that isn't generated yet, it's loaded along with its image.
+type PendingDerivative struct {
+	Image
+	Name string `db:"derivative_name"`
+}
+
+// derivativeJob is derivative of image waiting for generation.
+type derivativeJob struct {
+	image      Image
+	derivative Derivative
+}
+
+var (
+	derivativeNameRegexp = regexp.MustCompile(`^[a-z0-9_-]+$`)
+	derivativeSizeRegexp = regexp.MustCompile(`^(?:(\d+)x(\d+)|(\d+)w|(\d+)h)$`)
+)
+
+// ParseDerivative parses derivative from its description: name followed by size and optional fit,
+// size is either WIDTHxHEIGHT, WIDTHw or HEIGHTh, e.g. "thumb 128x128 cover" or "medium 1024w".
+func ParseDerivative(description string) (Derivative, error) {
+	fields := strings.Fields(description)
+	if len(fields) < 2 || len(fields) > 3 {
+		return Derivative{}, fmt.Errorf("derivative %q should have name, size and optional fit", description)
+	}
+	derivative := Derivative{Name: fields[0], Fit: FitContain}
+	size := derivativeSizeRegexp.FindStringSubmatch(fields[1])
+	if size == nil {
+		return Derivative{}, fmt.Errorf("derivative %q has invalid size", description)
+	}
+	// Only one of size forms is matched, other groups are empty
+	derivative.Width, _ = strconv.Atoi(size[1] + size[3])
+	derivative.Height, _ = strconv.Atoi(size[2] + size[4])
+	if len(fields) == 3 {
+		derivative.Fit = fields[2]
+	}
+	return derivative, nil
+}
+
+// WithDerivatives is functional option for setting derivatives LocalImageServer generates for uploaded images.
+// Derivatives are generated in background after upload and cached as thumbnails.
+func WithDerivatives(derivatives ...Derivative) Option {
+	return func(is *LocalImageServer) error {
+		names := make(map[string]bool)
+		for _, derivative := range derivatives {
+			if !derivativeNameRegexp.MatchString(derivative.Name) || names[derivative.Name] {
+				return fmt.Errorf("derivative name %q is invalid or duplicated", derivative.Name)
+			}
+			if derivative.Width < 0 || derivative.Height < 0 || derivative.Width+derivative.Height == 0 {
+				return fmt.Errorf("derivative %s should have positive size", derivative.Name)
+			}
+			if derivative.Fit != FitContain && derivative.Fit != FitCover {
+				return fmt.Errorf("derivative %s has unknown fit %s", derivative.Name, derivative.Fit)
+			}
+			names[derivative.Name] = true
+		}
+		is.derivatives = derivatives
+		return nil
+	}
+}
+
+// WithDerivativeWorkers is functional option for setting number of LocalImageServer workers generating derivatives,
+// default is DefaultDerivativeWorkers.
+func WithDerivativeWorkers(workers int) Option {
+	return func(is *LocalImageServer) error {
+		if workers <= 0 {
+			return errors.New("derivative workers number should be positive")
+		}
+		is.derivativeWorkers = workers
+		return nil
+	}
+}
+
+// WithDerivativeRetryDelay is functional option for setting time derivatives of LocalImageServer stay pending
+// or failed before their generation is queued again, default is DefaultDerivativeRetryDelay.
+func WithDerivativeRetryDelay(delay time.Duration) Option {
+	return func(is *LocalImageServer) error {
+		if delay <= 0 {
+			return errors.New("derivative retry delay should be positive")
+		}
+		is.derivativeRetryDelay = delay
+		return nil
+	}
+}
+
+// startDerivativeWorkers starts workers generating derivatives from bounded queue until server is closed,
+// derivatives that aren't generated are queued again after retry delay.
+func (is *LocalImageServer) startDerivativeWorkers() {
+	is.derivativeJobs = make(chan derivativeJob, is.derivativeWorkers*derivativeQueueSize)
+	for i := 0; i < is.derivativeWorkers; i++ {
+		is.background.Add(1)
+		go func() {
+			defer is.background.Done()
+			for {
+				select {
+				case <-is.closing:
+					return
+				case job := <-is.derivativeJobs:
+					is.generateDerivative(job)
+				}
+			}
+		}()
+	}
+	is.runPeriodically(is.derivativeRetryDelay, is.retryDerivatives)
+}
+
+// enqueueDerivatives records pending derivatives of uploaded image and queues their generation,
+// derivatives that don't fit into queue stay pending until they are retried.
+func (is *LocalImageServer) enqueueDerivatives(image *Image, requestLogger *log.Entry) {
+	if len(is.derivatives) == 0 {
+		return
+	}
+	names := make([]string, 0, len(is.derivatives))
+	for _, derivative := range is.derivatives {
+		names = append(names, derivative.Name)
+	}
+	if err := is.storage.CreateDerivatives(image.ID, names); err != nil {
+		requestLogger.Error(err)
+		return
+	}
+
+	for _, derivative := range is.derivatives {
+		select {
+		case is.derivativeJobs <- derivativeJob{*image, derivative}:
+		default:
+			requestLogger.Warnf("derivative %s of %s isn't queued, queue is full", derivative.Name, image.Filename)
+		}
+	}
+}
+
+// retryDerivatives queues generation of derivatives that stay pending or failed for retry delay,
+// so derivatives that weren't generated before restart or didn't fit into queue are generated eventually.
+// Derivatives are queued while there is free space in queue.
+func (is *LocalImageServer) retryDerivatives() {
+	free := cap(is.derivativeJobs) - len(is.derivativeJobs)
+	if free <= 0 {
+		return
+	}
+	names := make([]string, 0, len(is.derivatives))
+	derivatives := make(map[string]Derivative)
+	for _, derivative := range is.derivatives {
+		names = append(names, derivative.Name)
+		derivatives[derivative.Name] = derivative
+	}
+	pending := make([]PendingDerivative, 0)
+	before := time.Now().Add(-is.derivativeRetryDelay)
+	if err := is.storage.LoadUnfinishedDerivatives(&pending, names, before, free); err != nil {
+		is.log.Error(err)
+		return
+	}
+
+	for _, p := range pending {
+		// Update time is refreshed, so queued derivative isn't queued again by next retry
+		if err := is.storage.UpdateDerivative(&ImageDerivative{p.ID, p.Name, DerivativePending}); err != nil {
+			is.log.Error(err)
+			continue
+		}
+		select {
+		case is.derivativeJobs <- derivativeJob{p.Image, derivatives[p.Name]}:
+		default:
+			return
+		}
+	}
+}
+
+// generateDerivative renders derivative into blob store and records its status.
+// Derivatives of deleted images aren't generated, rendition stored while image is deleted is removed.
+func (is *LocalImageServer) generateDerivative(job derivativeJob) {
+	jobLogger := is.log.WithFields(log.Fields{"filename": job.image.Filename, "derivative": job.derivative.Name})
+	ctx := context.Background()
+	if err := is.storage.LoadImage(&Image{Filename: job.image.Filename, UserID: job.image.UserID}); err != nil {
+		if err != sql.ErrNoRows {
+			jobLogger.Error(err)
+		}
+		return
+	}
+
+	rn := job.derivative.rendition(&job.image)
+	key := rn.key(job.image.ID)
+	status := DerivativeReady
+	content, err := is.render(ctx, &job.image, rn)
+	if err == nil {
+		err = is.blobs.Put(ctx, key, bytes.NewReader(content))
+	}
+	if err != nil {
+		jobLogger.Error(err)
+		status = DerivativeFailed
+	}
+	err = is.storage.UpdateDerivative(&ImageDerivative{job.image.ID, job.derivative.Name, status})
+	if err == sql.ErrNoRows && status == DerivativeReady {
+		// Derivative record is removed with image, renditions of image could be removed before rendition was stored
+		if err = is.blobs.Delete(ctx, key); err == ErrBlobNotFound {
+			err = nil
+		}
+	}
+	if err != nil {
+		jobLogger.Error(err)
+	}
+}
+
+// setVariants sets URLs of ready derivatives to images.
+func (is *LocalImageServer) setVariants(images []Image) error {
+	if len(is.derivatives) == 0 || len(images) == 0 {
+		return nil
+	}
+	ids := make([]uint64, 0, len(images))
+	for _, image := range images {
+		ids = append(ids, image.ID)
+	}
+	derivatives := make([]ImageDerivative, 0)
+	if err := is.storage.LoadDerivatives(&derivatives, ids); err != nil {
+		return err
+	}
+
+	ready := make(map[uint64]map[string]bool)
+	for _, derivative := range derivatives {
+		if derivative.Status == DerivativeReady {
+			if ready[derivative.ImageID] == nil {
+				ready[derivative.ImageID] = make(map[string]bool)
+			}
+			ready[derivative.ImageID][derivative.Name] = true
+		}
+	}
+	for i := range images {
+		for _, derivative := range is.derivatives {
+			if !ready[images[i].ID][derivative.Name] {
+				continue
+			}
+			if images[i].Variants == nil {
+				images[i].Variants = make(map[string]string)
+			}
+			images[i].Variants[derivative.Name] = derivative.url(images[i].Filename)
+		}
+	}
+	return nil
+}
+
+// rendition returns rendition of image that derivative is cached as.
+func (d Derivative) rendition(img *Image) rendition {
+	rn := rendition{width: d.Width, height: d.Height, fit: d.Fit, format: imageFormat(img)}
+	if rn.format == "jpeg" {
+		rn.quality = DefaultJPEGQuality
+	}
+	return rn
+}
+
+// url returns URL of thumbnail derivative of image is cached as.
+func (d Derivative) url(filename string) string {
+	params := url.Values{}
+	if d.Width > 0 {
+		params.Set("w", strconv.Itoa(d.Width))
+	}
+	if d.Height > 0 {
+		params.Set("h", strconv.Itoa(d.Height))
+	}
+	params.Set("fit", d.Fit)
+	return imageURL(filename) + "/thumbnail?" + params.Encode()
+}
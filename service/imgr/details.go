@@ -0,0 +1,150 @@
+package imgr
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sp4rd4/go-imager/util"
+	"goji.io/pat"
+)
+
+// imageDetails are form values of image details that can be changed along with their max length in characters.
+var imageDetails = []struct {
+	name      string
+	maxLength int
+	field     func(img *Image) *string
+}{
+	{"display_name", 255, func(img *Image) *string { return &img.DisplayName }},
+	{"description", 5000, func(img *Image) *string { return &img.Description }},
+	{"alt_text", 1000, func(img *Image) *string { return &img.AltText }},
+}
+
+// imageETag returns entity tag of image resource served by GetImage and changed by PatchImage,
+// it's checksum of image content followed by version of image details, so it changes with every update of details.
+// Images stored before checksums were recorded are tagged by version only.
+func imageETag(img *Image) string {
+	version := "v" + strconv.FormatInt(img.Version, 10)
+	if img.SHA256 == "" {
+		return `"` + version + `"`
+	}
+	return `"` + img.SHA256 + "-" + version + `"`
+}
+
+// matchETag reports if If-Match header allows modification of resource with given entity tag,
+// missing header allows any modification.
+func matchETag(header, etag string) bool {
+	if header == "" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDetails sets image details present in request form, values are trimmed,
+// formValueError is returned for details that are too long or aren't valid UTF-8.
+func parseDetails(r *http.Request, img *Image) (bool, error) {
+	if err := r.ParseForm(); err != nil {
+		return false, err
+	}
+	present := false
+	for _, detail := range imageDetails {
+		if _, ok := r.PostForm[detail.name]; !ok {
+			continue
+		}
+		value := strings.TrimSpace(r.PostForm.Get(detail.name))
+		if !utf8.ValidString(value) || utf8.RuneCountInString(value) > detail.maxLength {
+			return false, formValueError(detail.name)
+		}
+		*detail.field(img) = value
+		present = true
+	}
+	return present, nil
+}
+
+// PatchImage changes display name, description and alt text of image uploaded by the current user,
+// details missing in form are kept and empty values clear them.
+// Updated image is returned as json with ETag header of its new version, the same one GetImage serves it with.
+// Image isn't updated when If-Match header doesn't match ETag of its current version,
+// so concurrent changes aren't overwritten.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 image will not be updated.
+// Images of other users are reported as missing.
+// * filename (required) URL path parameter
+// * display_name (optional) form value up to 255 characters
+// * description (optional) form value up to 5000 characters
+// * alt_text (optional) form value up to 1000 characters
+// * If-Match (optional) Header with ETag of image version that is updated, as served by GetImage
+func (is *LocalImageServer) PatchImage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	img := &Image{Filename: pat.Param(r, "filename"), UserID: userID}
+	if err = is.storage.LoadImage(img); err != nil {
+		if err == sql.ErrNoRows {
+			util.JSONResponse(w, http.StatusNotFound, `{"error":"Image not found"}`, requestLogger)
+			return
+		}
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+	if !matchETag(r.Header.Get("If-Match"), imageETag(img)) {
+		requestLogger.Infof("image %s version %d doesn't match %s", img.Filename, img.Version, r.Header.Get("If-Match"))
+		w.Header().Set("ETag", imageETag(img))
+		util.JSONResponse(w, http.StatusPreconditionFailed, `{"error":"Image was modified"}`, requestLogger)
+		return
+	}
+
+	present, err := parseDetails(r, img)
+	if err != nil {
+		requestLogger.Info(err)
+		body := `{"error":"Image details are invalid"}`
+		if name, ok := err.(formValueError); ok {
+			body = fmt.Sprintf(`{"error":"Invalid form value %s"}`, string(name))
+		}
+		util.JSONResponse(w, http.StatusUnprocessableEntity, body, requestLogger)
+		return
+	}
+	if !present {
+		requestLogger.Info("image details are missing in form")
+		util.JSONResponse(w, http.StatusUnprocessableEntity, `{"error":"Image details are missing"}`, requestLogger)
+		return
+	}
+
+	// Image is updated only if it's still of loaded version, even if If-Match header isn't sent
+	if err = is.storage.UpdateImageDetails(img); err != nil {
+		if err == sql.ErrNoRows {
+			requestLogger.Infof("image %s is modified since version %d", img.Filename, img.Version)
+			util.JSONResponse(w, http.StatusPreconditionFailed, `{"error":"Image was modified"}`, requestLogger)
+			return
+		}
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+
+	img.URL = imageURL(img.Filename)
+	w.Header().Set("ETag", imageETag(img))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(w).Encode(img); err != nil {
+		requestLogger.Error(err)
+	}
+}
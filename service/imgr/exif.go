@@ -0,0 +1,588 @@
+package imgr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EXIF tags and pointers to sub IFDs.
+const (
+	exifOrientation   = 0x0112
+	exifIFDPointer    = 0x8769
+	exifDateTimeOrig  = 0x9003
+	exifDateTimeDigit = 0x9004
+	exifOffsetOrig    = 0x9011
+	exifOffsetDigit   = 0x9012
+)
+
+// exifTag describes EXIF tag that can be kept in uploaded images, sub tags are stored in Exif IFD.
+type exifTag struct {
+	id  uint16
+	sub bool
+}
+
+// exifTags maps names of EXIF tags that can be kept to their descriptions.
+// Tags with location, maker notes and thumbnails are never kept.
+var exifTags = map[string]exifTag{
+	"ImageDescription":      {0x010E, false},
+	"Make":                  {0x010F, false},
+	"Model":                 {0x0110, false},
+	"XResolution":           {0x011A, false},
+	"YResolution":           {0x011B, false},
+	"ResolutionUnit":        {0x0128, false},
+	"Software":              {0x0131, false},
+	"DateTime":              {0x0132, false},
+	"Artist":                {0x013B, false},
+	"Copyright":             {0x8298, false},
+	"ExposureTime":          {0x829A, true},
+	"FNumber":               {0x829D, true},
+	"ExposureProgram":       {0x8822, true},
+	"ISOSpeedRatings":       {0x8827, true},
+	"DateTimeOriginal":      {exifDateTimeOrig, true},
+	"DateTimeDigitized":     {exifDateTimeDigit, true},
+	"OffsetTime":            {0x9010, true},
+	"OffsetTimeOriginal":    {exifOffsetOrig, true},
+	"OffsetTimeDigitized":   {exifOffsetDigit, true},
+	"ShutterSpeedValue":     {0x9201, true},
+	"ApertureValue":         {0x9202, true},
+	"ExposureBiasValue":     {0x9204, true},
+	"MeteringMode":          {0x9207, true},
+	"Flash":                 {0x9209, true},
+	"FocalLength":           {0x920A, true},
+	"ColorSpace":            {0xA001, true},
+	"WhiteBalance":          {0xA403, true},
+	"FocalLengthIn35mmFilm": {0xA405, true},
+	"CameraOwnerName":       {0xA430, true},
+	"BodySerialNumber":      {0xA431, true},
+	"LensMake":              {0xA433, true},
+	"LensModel":             {0xA434, true},
+	"LensSerialNumber":      {0xA435, true},
+}
+
+// defaultKeptEXIFTags are EXIF tags kept in uploaded images by default, they don't identify place or device.
+var defaultKeptEXIFTags = []string{
+	"ImageDescription", "Artist", "Copyright", "DateTime", "DateTimeOriginal", "DateTimeDigitized",
+	"OffsetTime", "OffsetTimeOriginal", "OffsetTimeDigitized", "ExposureTime", "FNumber", "ExposureProgram",
+	"ISOSpeedRatings", "ShutterSpeedValue", "ApertureValue", "ExposureBiasValue", "MeteringMode", "Flash",
+	"FocalLength", "ColorSpace", "WhiteBalance", "FocalLengthIn35mmFilm",
+}
+
+// WithKeptEXIFTags is functional option for setting EXIF tags LocalImageServer keeps in uploaded JPEG images,
+// all other metadata including GPS location is removed before image is stored.
+// By default description, authorship, dates and exposure settings are kept.
+func WithKeptEXIFTags(tags ...string) Option {
+	return func(is *LocalImageServer) error {
+		for _, tag := range tags {
+			if _, ok := exifTags[tag]; !ok {
+				return fmt.Errorf("EXIF tag %s isn't supported", tag)
+			}
+		}
+		is.keptEXIFTags = exifTagIDs(tags)
+		return nil
+	}
+}
+
+// exifTagIDs returns set of IDs of named EXIF tags.
+func exifTagIDs(tags []string) map[uint16]bool {
+	ids := make(map[uint16]bool)
+	for _, tag := range tags {
+		if t, ok := exifTags[tag]; ok {
+			ids[t.id] = true
+		}
+	}
+	return ids
+}
+
+// exifTypeSizes maps EXIF value types to size of single value.
+var exifTypeSizes = map[uint16]uint64{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// exifEntry is IFD entry with its value, values are kept in original byte order.
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// exifData is parsed EXIF segment, only IFD0 and Exif IFD entries are kept.
+type exifData struct {
+	order binary.ByteOrder
+	ifd0  []exifEntry
+	sub   []exifEntry
+}
+
+// parseEXIF parses payload of APP1 EXIF segment.
+func parseEXIF(payload []byte) (*exifData, error) {
+	tiff := payload[len(exifHeader):]
+	if len(tiff) < 8 {
+		return nil, errors.New("EXIF header is truncated")
+	}
+	exif := &exifData{}
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		exif.order = binary.LittleEndian
+	case "MM\x00*":
+		exif.order = binary.BigEndian
+	default:
+		return nil, errors.New("EXIF byte order is invalid")
+	}
+
+	var err error
+	if exif.ifd0, err = exif.readIFD(tiff, exif.order.Uint32(tiff[4:])); err != nil {
+		return nil, err
+	}
+	for _, entry := range exif.ifd0 {
+		if entry.tag == exifIFDPointer && entry.typ == 4 && entry.count == 1 {
+			if exif.sub, err = exif.readIFD(tiff, exif.order.Uint32(entry.value)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return exif, nil
+}
+
+// readIFD reads entries of IFD at given offset, entries of unknown types are skipped.
+func (exif *exifData) readIFD(tiff []byte, offset uint32) ([]exifEntry, error) {
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return nil, errors.New("EXIF IFD offset is invalid")
+	}
+	count := uint64(exif.order.Uint16(tiff[offset:]))
+	start := uint64(offset) + 2
+	if start+count*12 > uint64(len(tiff)) {
+		return nil, errors.New("EXIF IFD is truncated")
+	}
+
+	entries := make([]exifEntry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		raw := tiff[start+i*12 : start+i*12+12]
+		entry := exifEntry{
+			tag:   exif.order.Uint16(raw),
+			typ:   exif.order.Uint16(raw[2:]),
+			count: exif.order.Uint32(raw[4:]),
+		}
+		typeSize, ok := exifTypeSizes[entry.typ]
+		if !ok {
+			continue
+		}
+		size := typeSize * uint64(entry.count)
+		if size <= 4 {
+			entry.value = raw[8 : 8+size]
+		} else {
+			valueOffset := uint64(exif.order.Uint32(raw[8:]))
+			if valueOffset+size > uint64(len(tiff)) {
+				return nil, fmt.Errorf("EXIF tag %#04x value is truncated", entry.tag)
+			}
+			entry.value = tiff[valueOffset : valueOffset+size]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// find returns entry with given tag from IFD0 or Exif IFD.
+func (exif *exifData) find(tag uint16) (exifEntry, bool) {
+	for _, entries := range [][]exifEntry{exif.ifd0, exif.sub} {
+		for _, entry := range entries {
+			if entry.tag == tag {
+				return entry, true
+			}
+		}
+	}
+	return exifEntry{}, false
+}
+
+// orientation returns EXIF orientation of image, 1 means image doesn't need to be transformed.
+func (exif *exifData) orientation() int {
+	entry, ok := exif.find(exifOrientation)
+	if !ok || entry.typ != 3 || entry.count != 1 {
+		return 1
+	}
+	if orientation := int(exif.order.Uint16(entry.value)); orientation >= 1 && orientation <= 8 {
+		return orientation
+	}
+	return 1
+}
+
+// capturedAt returns time image was taken, local time without known offset is treated as UTC.
+func (exif *exifData) capturedAt() *time.Time {
+	for _, tags := range [][2]uint16{{exifDateTimeOrig, exifOffsetOrig}, {exifDateTimeDigit, exifOffsetDigit}} {
+		entry, ok := exif.find(tags[0])
+		if !ok || entry.typ != 2 {
+			continue
+		}
+		value := exifString(entry)
+		if offset, ok := exif.find(tags[1]); ok && offset.typ == 2 {
+			if t, err := time.Parse("2006:01:02 15:04:05-07:00", value+exifString(offset)); err == nil {
+				t = t.UTC()
+				return &t
+			}
+		}
+		if t, err := time.Parse("2006:01:02 15:04:05", value); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+// exifString returns value of ASCII entry without terminating null.
+func exifString(entry exifEntry) string {
+	return strings.TrimRight(string(entry.value), "\x00 ")
+}
+
+// segment returns APP1 segment with kept entries, nil is returned if no entry is kept.
+func (exif *exifData) segment(kept map[uint16]bool) []byte {
+	filter := func(entries []exifEntry, sub bool) []exifEntry {
+		filtered := make([]exifEntry, 0)
+		for _, entry := range entries {
+			if t, ok := exifTagByID(entry.tag); ok && t.sub == sub && kept[entry.tag] {
+				filtered = append(filtered, entry)
+			}
+		}
+		return filtered
+	}
+	ifd0, sub := filter(exif.ifd0, false), filter(exif.sub, true)
+	if len(ifd0) == 0 && len(sub) == 0 {
+		return nil
+	}
+
+	tiff := encodeTIFF(exif.order, ifd0, sub)
+	payload := append([]byte(exifHeader), tiff...)
+	if len(payload)+2 > 0xFFFF {
+		return nil
+	}
+	segment := []byte{0xFF, jpegAPP1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// exifTagByID returns description of EXIF tag that can be kept.
+func exifTagByID(id uint16) (exifTag, bool) {
+	for _, t := range exifTags {
+		if t.id == id {
+			return t, true
+		}
+	}
+	return exifTag{}, false
+}
+
+// encodeTIFF writes TIFF structure with IFD0 and Exif IFD, that is referenced from IFD0 if it has entries.
+func encodeTIFF(order binary.ByteOrder, ifd0, sub []exifEntry) []byte {
+	if len(sub) > 0 {
+		ifd0 = append(ifd0, exifEntry{tag: exifIFDPointer, typ: 4, count: 1, value: make([]byte, 4)})
+		subOffset := 8 + ifdSize(ifd0)
+		order.PutUint32(ifd0[len(ifd0)-1].value, subOffset)
+	}
+
+	buf := &bytes.Buffer{}
+	if order == binary.LittleEndian {
+		buf.WriteString("II*\x00")
+	} else {
+		buf.WriteString("MM\x00*")
+	}
+	writeUint32(buf, order, 8)
+	writeIFD(buf, order, ifd0)
+	if len(sub) > 0 {
+		writeIFD(buf, order, sub)
+	}
+	return buf.Bytes()
+}
+
+// ifdSize returns size of IFD with its values that don't fit into entries.
+func ifdSize(entries []exifEntry) uint32 {
+	size := uint32(2 + len(entries)*12 + 4)
+	for _, entry := range entries {
+		if len(entry.value) > 4 {
+			size += uint32(len(entry.value) + len(entry.value)%2)
+		}
+	}
+	return size
+}
+
+// writeIFD writes IFD sorted by tags at current position of buffer, followed by its values.
+func writeIFD(buf *bytes.Buffer, order binary.ByteOrder, entries []exifEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+	valueOffset := uint32(buf.Len()) + uint32(2+len(entries)*12+4)
+	values := &bytes.Buffer{}
+
+	entry := make([]byte, 12)
+	order.PutUint16(entry, uint16(len(entries)))
+	buf.Write(entry[:2])
+	for _, e := range entries {
+		order.PutUint16(entry, e.tag)
+		order.PutUint16(entry[2:], e.typ)
+		order.PutUint32(entry[4:], e.count)
+		copy(entry[8:], []byte{0, 0, 0, 0})
+		if len(e.value) <= 4 {
+			copy(entry[8:], e.value)
+		} else {
+			// Values are word aligned
+			order.PutUint32(entry[8:], valueOffset+uint32(values.Len()))
+			values.Write(e.value)
+			if len(e.value)%2 == 1 {
+				values.WriteByte(0)
+			}
+		}
+		buf.Write(entry)
+	}
+	// Next IFD offset, thumbnail IFD is never written
+	writeUint32(buf, order, 0)
+	buf.Write(values.Bytes())
+}
+
+func writeUint32(buf *bytes.Buffer, order binary.ByteOrder, v uint32) {
+	b := make([]byte, 4)
+	order.PutUint32(b, v)
+	buf.Write(b)
+}
+
+// JPEG markers.
+const (
+	jpegSOI   = 0xD8
+	jpegEOI   = 0xD9
+	jpegSOS   = 0xDA
+	jpegAPP0  = 0xE0
+	jpegAPP1  = 0xE1
+	jpegAPP2  = 0xE2
+	jpegAPP14 = 0xEE
+	jpegAPP15 = 0xEF
+	jpegCOM   = 0xFE
+)
+
+// Identifiers of APP segments payloads.
+const (
+	exifHeader  = "Exif\x00\x00"
+	iccHeader   = "ICC_PROFILE\x00"
+	adobeHeader = "Adobe"
+)
+
+// sanitizeJPEG removes metadata segments from uploaded JPEG image except kept EXIF tags, color profile and
+// color transform, and applies EXIF orientation to image pixels. Capture time and dimensions of image
+// are updated in image data. Segments are read up to image scan and the rest of image is streamed as is,
+// only images that are rotated by their orientation are decoded and reencoded in memory.
+func (is *LocalImageServer) sanitizeJPEG(id *imageData, content io.Reader) (io.Reader, error) {
+	malformed := func(err error) error {
+		return &uploadError{
+			http.StatusUnprocessableEntity,
+			`{"error":"Image is malformed"}`,
+			fmt.Errorf("JPEG image is malformed: %s", err),
+		}
+	}
+	readFailure := func(err error) error {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return malformed(errors.New("segment is truncated"))
+		}
+		return err
+	}
+
+	r := bufio.NewReader(content)
+	// Start of image was validated by image header
+	if _, err := r.Discard(2); err != nil {
+		return nil, readFailure(err)
+	}
+	// Metadata segments are kept even if image is reencoded
+	var metadata [][]byte
+	var exif *exifData
+	header := bytes.NewBuffer([]byte{0xFF, jpegSOI})
+	for {
+		prefix, err := r.ReadByte()
+		if err != nil {
+			return nil, readFailure(err)
+		}
+		if prefix != 0xFF {
+			return nil, malformed(errors.New("segment marker is missing"))
+		}
+		marker := byte(0xFF)
+		// Fill bytes precede marker
+		for marker == 0xFF && err == nil {
+			marker, err = r.ReadByte()
+		}
+		if err != nil {
+			return nil, readFailure(err)
+		}
+		if marker == jpegSOS || marker == jpegEOI {
+			header.Write([]byte{0xFF, marker})
+			break
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			header.Write([]byte{0xFF, marker})
+			continue
+		}
+
+		segment := []byte{0xFF, marker, 0, 0}
+		if _, err = io.ReadFull(r, segment[2:]); err != nil {
+			return nil, readFailure(err)
+		}
+		length := int(binary.BigEndian.Uint16(segment[2:]))
+		if length < 2 {
+			return nil, malformed(errors.New("segment is truncated"))
+		}
+		segment = append(segment, make([]byte, length-2)...)
+		if _, err = io.ReadFull(r, segment[4:]); err != nil {
+			return nil, readFailure(err)
+		}
+		payload := segment[4:]
+
+		switch {
+		case marker == jpegAPP1 && bytes.HasPrefix(payload, []byte(exifHeader)):
+			if exif != nil {
+				continue
+			}
+			// Unparsable EXIF is dropped
+			if exif, err = parseEXIF(payload); err != nil {
+				exif = &exifData{}
+				continue
+			}
+			if segment = exif.segment(is.keptEXIFTags); segment != nil {
+				metadata = append(metadata, segment)
+				header.Write(segment)
+			}
+		case marker == jpegAPP2 && bytes.HasPrefix(payload, []byte(iccHeader)):
+			metadata = append(metadata, segment)
+			header.Write(segment)
+		case marker == jpegAPP0 || (marker == jpegAPP14 && bytes.HasPrefix(payload, []byte(adobeHeader))):
+			header.Write(segment)
+		case (marker >= jpegAPP0 && marker <= jpegAPP15) || marker == jpegCOM:
+			// Other application segments and comments can contain any private data, e.g. XMP location
+		default:
+			header.Write(segment)
+		}
+	}
+
+	orientation := 1
+	if exif != nil {
+		id.capturedAt = exif.capturedAt()
+		orientation = exif.orientation()
+	}
+	if orientation == 1 {
+		return io.MultiReader(header, r), nil
+	}
+
+	img, err := jpeg.Decode(io.MultiReader(header, r))
+	if err == errImageTooLarge {
+		return nil, err
+	}
+	if err != nil {
+		return nil, malformed(err)
+	}
+	oriented := orient(img, orientation)
+	encoded := &bytes.Buffer{}
+	if err = jpeg.Encode(encoded, oriented, &jpeg.Options{Quality: DefaultJPEGQuality}); err != nil {
+		return nil, err
+	}
+	sanitized := bytes.NewBuffer([]byte{0xFF, jpegSOI})
+	for _, segment := range metadata {
+		sanitized.Write(segment)
+	}
+	// Encoded image starts with its own SOI marker
+	sanitized.Write(encoded.Bytes()[2:])
+	id.width, id.height = oriented.Bounds().Dx(), oriented.Bounds().Dy()
+	return sanitized, nil
+}
+
+// orient transforms image with EXIF orientation, so it can be displayed as is.
+// Planes of gray, YCbCr, CMYK and RGBA images are transformed as they are,
+// other images are converted to RGBA first.
+func orient(src image.Image, orientation int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Orientations from 5 to 8 transpose image
+	rect := image.Rect(0, 0, w, h)
+	if orientation >= 5 {
+		rect = image.Rect(0, 0, h, w)
+	}
+
+	switch img := src.(type) {
+	case *image.Gray:
+		dst := image.NewGray(rect)
+		orientPlane(dst.Pix, dst.Stride, img.Pix, img.Stride, w, h, 1, orientation)
+		return dst
+	case *image.CMYK:
+		dst := image.NewCMYK(rect)
+		orientPlane(dst.Pix, dst.Stride, img.Pix, img.Stride, w, h, 4, orientation)
+		return dst
+	case *image.RGBA:
+		dst := image.NewRGBA(rect)
+		orientPlane(dst.Pix, dst.Stride, img.Pix, img.Stride, w, h, 4, orientation)
+		return dst
+	case *image.YCbCr:
+		if dst, ok := orientYCbCr(img, rect, orientation); ok {
+			return dst
+		}
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	return orient(rgba, orientation)
+}
+
+// orientYCbCr transforms luma and chroma planes of image with EXIF orientation,
+// false is returned for subsample ratios that can't be transposed.
+func orientYCbCr(src *image.YCbCr, rect image.Rectangle, orientation int) (*image.YCbCr, bool) {
+	// Chroma planes are aligned with luma plane only for images starting at origin
+	if src.Rect.Min != (image.Point{}) {
+		return nil, false
+	}
+	ratio := src.SubsampleRatio
+	if orientation >= 5 {
+		switch ratio {
+		case image.YCbCrSubsampleRatio422:
+			ratio = image.YCbCrSubsampleRatio440
+		case image.YCbCrSubsampleRatio440:
+			ratio = image.YCbCrSubsampleRatio422
+		case image.YCbCrSubsampleRatio444, image.YCbCrSubsampleRatio420:
+		default:
+			return nil, false
+		}
+	}
+
+	dst := image.NewYCbCr(rect, ratio)
+	orientPlane(dst.Y, dst.YStride, src.Y, src.YStride, src.Rect.Dx(), src.Rect.Dy(), 1, orientation)
+	cw, ch := dst.CStride, len(dst.Cb)/dst.CStride
+	if orientation >= 5 {
+		cw, ch = ch, cw
+	}
+	orientPlane(dst.Cb, dst.CStride, src.Cb, src.CStride, cw, ch, 1, orientation)
+	orientPlane(dst.Cr, dst.CStride, src.Cr, src.CStride, cw, ch, 1, orientation)
+	return dst, true
+}
+
+// orientPlane copies pixels of w x h source plane to destination plane transformed with EXIF orientation,
+// every pixel takes size bytes.
+func orientPlane(dst []uint8, dstStride int, src []uint8, srcStride, w, h, size, orientation int) {
+	for y := 0; y < h; y++ {
+		row := src[y*srcStride : y*srcStride+w*size]
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			default:
+				dx, dy = x, y
+			}
+			i := dy*dstStride + dx*size
+			copy(dst[i:i+size], row[x*size:x*size+size])
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package imgr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrient(t *testing.T) {
+	// Pixels of 3x2 image are numbered row by row
+	src := image.NewGray(image.Rect(0, 0, 3, 2))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i)
+	}
+	examples := []struct {
+		orientation int
+		want        [][]uint8
+	}{
+		{1, [][]uint8{{0, 1, 2}, {3, 4, 5}}},
+		{2, [][]uint8{{2, 1, 0}, {5, 4, 3}}},
+		{3, [][]uint8{{5, 4, 3}, {2, 1, 0}}},
+		{4, [][]uint8{{3, 4, 5}, {0, 1, 2}}},
+		{5, [][]uint8{{0, 3}, {1, 4}, {2, 5}}},
+		{6, [][]uint8{{3, 0}, {4, 1}, {5, 2}}},
+		{7, [][]uint8{{5, 2}, {4, 1}, {3, 0}}},
+		{8, [][]uint8{{2, 5}, {1, 4}, {0, 3}}},
+	}
+	for _, ex := range examples {
+		dst := orient(src, ex.orientation).(*image.Gray)
+		got := make([][]uint8, dst.Bounds().Dy())
+		for y := range got {
+			for x := 0; x < dst.Bounds().Dx(); x++ {
+				got[y] = append(got[y], dst.GrayAt(x, y).Y)
+			}
+		}
+		assert.Equal(t, ex.want, got, "Incorrect orientation %d", ex.orientation)
+	}
+}
+
+func TestOrientYCbCr(t *testing.T) {
+	// Luma of 4x2 image is numbered row by row, chroma is numbered by horizontally subsampled pairs
+	src := image.NewYCbCr(image.Rect(0, 0, 4, 2), image.YCbCrSubsampleRatio422)
+	for i := range src.Y {
+		src.Y[i] = uint8(i)
+	}
+	for i := range src.Cb {
+		src.Cb[i], src.Cr[i] = uint8(i), uint8(10+i)
+	}
+
+	dst, ok := orient(src, 6).(*image.YCbCr)
+	if !assert.True(t, ok, "YCbCr image should stay YCbCr") {
+		return
+	}
+	assert.Equal(t, image.Rect(0, 0, 2, 4), dst.Rect, "Image should be transposed")
+	assert.Equal(t, image.YCbCrSubsampleRatio440, dst.SubsampleRatio, "Subsampling should be transposed")
+	assert.Equal(t, []uint8{4, 0, 5, 1, 6, 2, 7, 3}, dst.Y, "Incorrect luma")
+	assert.Equal(t, []uint8{2, 0, 3, 1}, dst.Cb, "Incorrect blue chroma")
+	assert.Equal(t, []uint8{12, 10, 13, 11}, dst.Cr, "Incorrect red chroma")
+
+	// Images of other types are converted
+	paletted := image.NewPaletted(image.Rect(0, 0, 3, 2), color.Palette{color.Black})
+	assert.Equal(t, image.Rect(0, 0, 2, 3), orient(paletted, 8).Bounds(), "Converted image should be transposed")
+}
+
+func TestParseEXIF(t *testing.T) {
+	examples := []struct {
+		name string
+		tiff string
+	}{
+		{"Truncated header", "II*\x00"},
+		{"Invalid byte order", "XX*\x00\x08\x00\x00\x00"},
+		{"Invalid IFD offset", "II*\x00\xff\x00\x00\x00"},
+		{"Truncated IFD", "II*\x00\x08\x00\x00\x00\x05\x00"},
+		{"Truncated value", "II*\x00\x08\x00\x00\x00\x01\x00\x0f\x01\x02\x00\x10\x00\x00\x00\x1a\x00\x00\x00"},
+	}
+	for _, ex := range examples {
+		t.Run(ex.name, func(t *testing.T) {
+			_, err := parseEXIF([]byte(exifHeader + ex.tiff))
+			assert.NotNil(t, err, "EXIF should be malformed")
+		})
+	}
+}
+
+func TestSanitizeJPEG(t *testing.T) {
+	encoded := &bytes.Buffer{}
+	if err := jpeg.Encode(encoded, image.NewRGBA(image.Rect(0, 0, 8, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	exif := &exifData{
+		order: binary.BigEndian,
+		ifd0: []exifEntry{
+			{0x010F, 2, 6, []byte("Maker\x00")},
+			{0x0110, 2, 6, []byte("Model\x00")},
+			{exifOrientation, 3, 1, []byte{0, 1}},
+		},
+		sub: []exifEntry{{exifDateTimeOrig, 2, 20, []byte("2018:04:01 10:20:30\x00")}},
+	}
+	segment := exif.segment(map[uint16]bool{0x010F: true, 0x0110: true, exifDateTimeOrig: true})
+	xmp := append([]byte{0xFF, jpegAPP1, 0, 12}, "http://ns\x00"...)
+	data := append(append(append([]byte{0xFF, jpegSOI}, segment...), xmp...), encoded.Bytes()[2:]...)
+
+	is := &LocalImageServer{keptEXIFTags: exifTagIDs([]string{"Make", "DateTimeOriginal"})}
+	id := &imageData{width: 8, height: 4}
+	// Image data isn't read until sanitized image is read
+	sanitized, err := is.sanitizeJPEG(id, io.MultiReader(bytes.NewReader(data), iotest.ErrReader(errors.New("read"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(sanitized)
+	assert.Equal(t, errors.New("read"), err, "Image data should be streamed")
+
+	assert.True(t, bytes.Contains(content, []byte("Maker\x00")), "Kept tag should be present")
+	assert.False(t, bytes.Contains(content, []byte("Model\x00")), "Other tags should be removed")
+	assert.False(t, bytes.Contains(content, []byte("http://ns")), "XMP should be removed")
+	// Image without orientation isn't reencoded
+	assert.True(t, bytes.HasSuffix(content, encoded.Bytes()[2:]), "Image data should be kept")
+	assert.Equal(t, 8, id.width, "Incorrect width")
+	if assert.NotNil(t, id.capturedAt, "Capture time should be recorded") {
+		assert.Equal(t, "2018-04-01T10:20:30Z", id.capturedAt.Format("2006-01-02T15:04:05Z07:00"))
+	}
+
+	stripped, err := parseEXIF(content[6:])
+	if assert.Nil(t, err, "Written EXIF should be valid") {
+		// Make and pointer to Exif IFD
+		assert.Equal(t, 2, len(stripped.ifd0), "Only kept IFD0 tags should be written")
+		assert.Equal(t, exif.sub, stripped.sub, "Exif IFD should be written")
+	}
+
+	_, err = is.sanitizeJPEG(&imageData{}, bytes.NewReader([]byte{0xFF, jpegSOI, 0xFF, 0xE0, 0xFF}))
+	assert.NotNil(t, err, "Truncated segment should be malformed")
+}
+
+func TestSanitizeJPEGOrientation(t *testing.T) {
+	encoded := &bytes.Buffer{}
+	if err := jpeg.Encode(encoded, image.NewRGBA(image.Rect(0, 0, 8, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	// Orientation isn't tag that can be kept, so segment is written without filtering
+	ifd0 := []exifEntry{{0x010F, 2, 6, []byte("Maker\x00")}, {exifOrientation, 3, 1, []byte{6, 0}}}
+	payload := append([]byte(exifHeader), encodeTIFF(binary.LittleEndian, ifd0, nil)...)
+	segment := []byte{0xFF, jpegAPP1, 0, byte(len(payload) + 2)}
+	data := append(append(append([]byte{0xFF, jpegSOI}, segment...), payload...), encoded.Bytes()[2:]...)
+
+	is := &LocalImageServer{keptEXIFTags: exifTagIDs([]string{"Make"})}
+	id := &imageData{width: 8, height: 4}
+	sanitized, err := is.sanitizeJPEG(id, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(sanitized)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, bytes.Contains(content, []byte("Maker\x00")), "Kept tag should be present")
+	config, err := jpeg.DecodeConfig(bytes.NewReader(content))
+	if assert.Nil(t, err, "Rotated image should be valid") {
+		assert.Equal(t, 4, config.Width, "Incorrect rotated width")
+		assert.Equal(t, 8, config.Height, "Incorrect rotated height")
+	}
+	assert.Equal(t, 4, id.width, "Incorrect width")
+	assert.Equal(t, 8, id.height, "Incorrect height")
+	stripped, err := parseEXIF(content[6:])
+	if assert.Nil(t, err, "Written EXIF should be valid") {
+		assert.Equal(t, 1, stripped.orientation(), "Orientation should not be written")
+	}
+}
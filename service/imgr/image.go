@@ -3,8 +3,11 @@
 package imgr
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
@@ -12,8 +15,41 @@ import (
 
 // Storage interface defines storage methods needed by images service.
 type Storage interface {
-	CreateImage(img *Image) error
-	LoadImages(images *[]Image, limit, offset, userID uint64) error
+	CreateImage(img *Image, quota *Quota) error
+	CreateImages(images []*Image, quota *Quota) ([]error, error)
+	LoadImage(img *Image) error
+	LoadImages(images *[]Image, query ImageQuery) error
+	CountImages(count *uint64, query ImageQuery) error
+	UpdateImageDetails(img *Image) error
+	DeleteImage(filename string, userID uint64, remove func(key string) error) error
+	CreateDerivatives(imageID uint64, names []string) error
+	UpdateDerivative(derivative *ImageDerivative) error
+	LoadDerivatives(derivatives *[]ImageDerivative, imageIDs []uint64) error
+	LoadUnfinishedDerivatives(pending *[]PendingDerivative, names []string, before time.Time, limit int) error
+	LoadUsage(usage *Usage, quota Quota) error
+	CreateAlbum(album *Album) error
+	LoadAlbum(album *Album) error
+	LoadAlbums(albums *[]Album, userID uint64) error
+	RenameAlbum(album *Album) error
+	DeleteAlbum(id, userID uint64) error
+	AddAlbumImage(albumID, imageID uint64) error
+	RemoveAlbumImage(albumID, imageID uint64) error
+	SetImageTags(imageID uint64, tags []string) error
+	LoadImageTags(tags *[]ImageTag, imageIDs []uint64) error
+	LoadTagCounts(counts *[]TagCount, userID uint64) error
+	CreateShare(share *Share) error
+	LoadShare(share *Share, filename string) error
+	UseShare(share *Share, filename string) error
+	ReturnShareView(id uint64) error
+	DeleteShare(id, imageID uint64) error
+	CreateUploadSession(session *UploadSession, quota *Quota) error
+	LoadUploadSession(session *UploadSession) error
+	ClaimUploadSession(session *UploadSession) error
+	ReleaseUploadSession(id string, userID uint64) error
+	AppendUploadChunk(session *UploadSession, key string, size int64) error
+	DeleteUploadSession(id string, userID uint64) error
+	DeleteStaleUploadSession(id string, before time.Time) error
+	LoadStaleUploadSessions(sessions *[]UploadSession, before time.Time) error
 }
 
 // DB type wraps *sqlx.DB for images-specific context.
@@ -23,8 +59,56 @@ type DB struct {
 
 // Image describes image data that is stored in database.
 type Image struct {
-	Filename string `json:"filename" db:"filename"`
-	UserID   uint64 `json:"-" db:"user_id"`
+	ID           uint64     `json:"id" db:"id"`
+	Filename     string     `json:"filename" db:"filename"`
+	URL          string     `json:"url" db:"-"`
+	OriginalName string     `json:"original_name" db:"original_name"`
+	ContentType  string     `json:"content_type" db:"content_type"`
+	Size         int64      `json:"size_bytes" db:"size_bytes"`
+	Width        int        `json:"width" db:"width"`
+	Height       int        `json:"height" db:"height"`
+	SHA256       string     `json:"sha256" db:"sha256"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	CapturedAt   *time.Time `json:"captured_at,omitempty" db:"captured_at"`
+	DisplayName  string     `json:"display_name,omitempty" db:"display_name"`
+	Description  string     `json:"description,omitempty" db:"description"`
+	AltText      string     `json:"alt_text,omitempty" db:"alt_text"`
+	Version      int64      `json:"version,omitempty" db:"version"`
+	BlobKey      string     `json:"-" db:"blob_key"`
+	UserID       uint64     `json:"-" db:"user_id"`
+
+	Variants map[string]string `json:"variants,omitempty" db:"-"`
+	Tags     []string          `json:"tags,omitempty" db:"-"`
+}
+
+// ImageQuery describes selection of user images.
+// Sort is one of filename (default), created_at, -created_at or size, minus sign means descending order.
+// Images are filtered by content type, creation time, original name, album and tags when corresponding fields are set,
+// images having all Tags are selected unless AnyTag is set.
+// After is last image from previous selection with the same sort, only images after it are selected.
+// Zero Limit means no limit.
+type ImageQuery struct {
+	UserID        uint64
+	Sort          string
+	ContentType   string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	NameContains  string
+	AlbumID       uint64
+	Tags          []string
+	AnyTag        bool
+	After         *Image
+	Limit         uint64
+	Offset        uint64
+}
+
+// imageSortColumns maps ImageQuery sorts to columns images are ordered by,
+// filename is used as second column to keep order stable.
+var imageSortColumns = map[string]string{
+	"filename":    "filename",
+	"created_at":  "created_at",
+	"-created_at": "created_at",
+	"size":        "size_bytes",
 }
 
 // ErrUniqueIndexConflict is custom error for unique index conflicts
@@ -35,8 +119,11 @@ func (uic ErrUniqueIndexConflict) Error() string {
 	return "Conflict on unique index in table " + string(uic)
 }
 
-// CreateImage insert Image into database.
-func (db *DB) CreateImage(img *Image) error {
+// CreateImage insert Image into database, ID and version of created record are set to passed image.
+// Creation time is set to current time if it's missing.
+// Image is added to usage of its user, ErrQuotaExceeded is returned if usage exceeds quota of user,
+// that is passed quota unless it's overridden for user. Nil quota isn't enforced.
+func (db *DB) CreateImage(img *Image, quota *Quota) error {
 	if img == nil {
 		return errors.New("image required")
 	}
@@ -48,10 +135,7 @@ func (db *DB) CreateImage(img *Image) error {
 		return err
 	}
 
-	_, err = tx.Exec(`INSERT INTO images (filename, user_id) VALUES ($1, $2)`, img.Filename, img.UserID)
-	handleConflictError(&err)
-
-	if err != nil {
+	if err = insertImage(tx, img, quota); err != nil {
 		if errT := tx.Rollback(); errT != nil {
 			err = fmt.Errorf("First: %s, Second: %s", err, errT)
 		}
@@ -61,6 +145,122 @@ func (db *DB) CreateImage(img *Image) error {
 	return err
 }
 
+// CreateImages inserts images into database in single transaction, IDs of created records are set to passed images.
+// Every image is created the same way as by CreateImage, but independently from others,
+// so returned errors of images are in order of images and are nil for created ones.
+// Error of whole batch is returned when transaction fails, then no image is created.
+func (db *DB) CreateImages(images []*Image, quota *Quota) ([]error, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(images))
+	for i, img := range images {
+		switch {
+		case img == nil:
+			errs[i] = errors.New("image required")
+			continue
+		case img.Filename == "":
+			errs[i] = errors.New("image filename required")
+			continue
+		}
+		// Failed image is rolled back to savepoint, so images created before it are kept
+		if _, err = tx.Exec(`SAVEPOINT image`); err != nil {
+			break
+		}
+		if errs[i] = insertImage(tx, img, quota); errs[i] != nil {
+			img.ID = 0
+			_, err = tx.Exec(`ROLLBACK TO SAVEPOINT image`)
+		} else {
+			_, err = tx.Exec(`RELEASE SAVEPOINT image`)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		if errT := tx.Rollback(); errT != nil {
+			err = fmt.Errorf("First: %s, Second: %s", err, errT)
+		}
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+// insertImage inserts image record, references its content blob and adds image to usage of its user.
+func insertImage(tx *sqlx.Tx, img *Image, quota *Quota) error {
+	if img.CreatedAt.IsZero() {
+		// Postgres keeps timestamps with microsecond precision
+		img.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	}
+	err := tx.QueryRowx(
+		`INSERT INTO images
+		(filename, user_id, original_name, content_type, size_bytes, width, height, sha256, created_at, captured_at,
+		blob_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id, version`,
+		img.Filename, img.UserID, img.OriginalName, img.ContentType, img.Size, img.Width, img.Height, img.SHA256,
+		img.CreatedAt, img.CapturedAt, img.BlobKey,
+	).Scan(&img.ID, &img.Version)
+	handleConflictError(&err)
+	if err == nil && img.BlobKey != "" {
+		// Row lock of blob waits for its concurrent removal
+		_, err = tx.Exec(
+			`INSERT INTO blobs (key, refs) VALUES ($1, 1) ON CONFLICT (key) DO UPDATE SET refs = blobs.refs + 1`,
+			img.BlobKey,
+		)
+	}
+	if err == nil {
+		err = accountImage(tx, img, quota)
+	}
+	return err
+}
+
+// accountImage adds created image to usage of its user and checks quota of user, open upload sessions of user
+// count toward quota except claimed ones, which are accounted as images once finalized.
+// Usage row stays locked until transaction ends, so concurrent uploads of user are accounted one by one.
+func accountImage(tx *sqlx.Tx, img *Image, quota *Quota) error {
+	if quota == nil {
+		_, err := tx.Exec(
+			`INSERT INTO quotas (user_id, used_bytes, used_images) VALUES ($1, $2, 1) ON CONFLICT (user_id)
+			DO UPDATE SET used_bytes = quotas.used_bytes + $2, used_images = quotas.used_images + 1`,
+			img.UserID, img.Size,
+		)
+		return err
+	}
+
+	usage := Usage{}
+	err := tx.Get(
+		&usage,
+		`INSERT INTO quotas (user_id, used_bytes, used_images) VALUES ($1, $2, 1) ON CONFLICT (user_id)
+		DO UPDATE SET used_bytes = quotas.used_bytes + $2, used_images = quotas.used_images + 1
+		RETURNING user_id, used_bytes, used_images,
+		coalesce(max_bytes, $3) AS max_bytes, coalesce(max_images, $4) AS max_images`,
+		img.UserID, img.Size, quota.MaxBytes, quota.MaxImages,
+	)
+	if err != nil {
+		return err
+	}
+
+	reserved := Usage{}
+	err = tx.Get(
+		&reserved,
+		`SELECT coalesce(sum(upload_length), 0) AS used_bytes, count(*) AS used_images
+		FROM upload_sessions WHERE user_id=$1 AND NOT finalizing`,
+		img.UserID,
+	)
+	if err != nil {
+		return err
+	}
+	usage.UsedBytes += reserved.UsedBytes
+	usage.UsedImages += reserved.UsedImages
+	return usage.check()
+}
+
 func handleConflictError(err *error) {
 	if *err != nil {
 		if pgerr, ok := (*err).(*pq.Error); ok && pgerr.Code == "23505" {
@@ -69,17 +269,668 @@ func handleConflictError(err *error) {
 	}
 }
 
-// LoadImages selects Images from database.
-func (db *DB) LoadImages(images *[]Image, limit, offset, userID uint64) error {
-	qStr := `SELECT * FROM images WHERE user_id=$1 ORDER BY filename OFFSET $2`
-	params := make([]interface{}, 2, 3)
-	params[0] = userID
-	params[1] = offset
-	if limit > 0 {
-		qStr += `LIMIT $3`
-		params = append(params, limit)
+// LoadImage loads image to passed var after looking up db record by filename and user_id.
+func (db *DB) LoadImage(img *Image) error {
+	if img == nil {
+		return errors.New("image required")
+	}
+	if img.Filename == "" {
+		return sql.ErrNoRows
+	}
+	err := db.Get(img, `SELECT * FROM images WHERE filename=$1 AND user_id=$2`, img.Filename, img.UserID)
+	return err
+}
+
+// UpdateImageDetails updates display name, description and alt text of image looked up by filename and user_id,
+// image is updated only if its version matches version of passed image. Version of updated image is incremented
+// and passed image is reloaded from updated record.
+// sql.ErrNoRows is returned when user has no such image or it's modified since passed version.
+func (db *DB) UpdateImageDetails(img *Image) error {
+	if img == nil {
+		return errors.New("image required")
+	}
+	return db.Get(
+		img,
+		`UPDATE images SET display_name=$4, description=$5, alt_text=$6, version = version + 1
+		WHERE filename=$1 AND user_id=$2 AND version=$3 RETURNING *`,
+		img.Filename, img.UserID, img.Version, img.DisplayName, img.Description, img.AltText,
+	)
+}
+
+// LoadImages selects Images from database matching query,
+// selection after image is done by index, without scanning previous records.
+func (db *DB) LoadImages(images *[]Image, query ImageQuery) error {
+	if query.Sort == "" {
+		query.Sort = "filename"
+	}
+	column, ok := imageSortColumns[query.Sort]
+	if !ok {
+		return fmt.Errorf("sort %s isn't supported", query.Sort)
+	}
+	order, compare := "ASC", ">"
+	if strings.HasPrefix(query.Sort, "-") {
+		order, compare = "DESC", "<"
+	}
+
+	qStr, params := query.filter()
+	if query.After != nil {
+		var value interface{}
+		switch column {
+		case "created_at":
+			value = query.After.CreatedAt
+		case "size_bytes":
+			value = query.After.Size
+		}
+		if value == nil {
+			params = append(params, query.After.Filename)
+			qStr += fmt.Sprintf(` AND filename %s $%d`, compare, len(params))
+		} else {
+			params = append(params, value, query.After.Filename)
+			qStr += fmt.Sprintf(` AND (%s, filename) %s ($%d, $%d)`, column, compare, len(params)-1, len(params))
+		}
+	}
+	if column == "filename" {
+		qStr += fmt.Sprintf(` ORDER BY filename %s`, order)
+	} else {
+		qStr += fmt.Sprintf(` ORDER BY %s %s, filename %s`, column, order, order)
+	}
+	if query.Offset > 0 {
+		params = append(params, query.Offset)
+		qStr += fmt.Sprintf(` OFFSET $%d`, len(params))
+	}
+	if query.Limit > 0 {
+		params = append(params, query.Limit)
+		qStr += fmt.Sprintf(` LIMIT $%d`, len(params))
 	}
 
-	err := db.Select(images, qStr, params...)
+	err := db.Select(images, `SELECT * FROM images WHERE `+qStr, params...)
 	return err
 }
+
+// CountImages counts images of user matching query filters, sort and selection parts of query are ignored.
+func (db *DB) CountImages(count *uint64, query ImageQuery) error {
+	qStr, params := query.filter()
+	err := db.Get(count, `SELECT count(*) FROM images WHERE `+qStr, params...)
+	return err
+}
+
+// filter returns parametrised condition matching images of query filters.
+func (query ImageQuery) filter() (string, []interface{}) {
+	qStr := `user_id=$1`
+	params := []interface{}{query.UserID}
+	if query.ContentType != "" {
+		params = append(params, query.ContentType)
+		qStr += fmt.Sprintf(` AND content_type=$%d`, len(params))
+	}
+	if !query.CreatedAfter.IsZero() {
+		params = append(params, query.CreatedAfter)
+		qStr += fmt.Sprintf(` AND created_at > $%d`, len(params))
+	}
+	if !query.CreatedBefore.IsZero() {
+		params = append(params, query.CreatedBefore)
+		qStr += fmt.Sprintf(` AND created_at < $%d`, len(params))
+	}
+	if query.NameContains != "" {
+		params = append(params, strings.ToLower(query.NameContains))
+		qStr += fmt.Sprintf(` AND strpos(lower(original_name), $%d) > 0`, len(params))
+	}
+	if query.AlbumID > 0 {
+		params = append(params, query.AlbumID)
+		qStr += fmt.Sprintf(` AND id IN (SELECT image_id FROM album_images WHERE album_id=$%d)`, len(params))
+	}
+	if len(query.Tags) > 0 {
+		params = append(params, pq.Array(query.Tags))
+		tagged := fmt.Sprintf(`SELECT image_id FROM image_tags WHERE tag = ANY($%d)`, len(params))
+		if !query.AnyTag {
+			params = append(params, len(query.Tags))
+			tagged += fmt.Sprintf(` GROUP BY image_id HAVING count(*) = $%d`, len(params))
+		}
+		qStr += ` AND id IN (` + tagged + `)`
+	}
+	return qStr, params
+}
+
+// DeleteImage removes image record of given user from database, releases its reference to content blob
+// and removes it from usage of user, sql.ErrNoRows is returned when user has no image with such filename.
+// When content blob of image isn't referenced anymore, its record is deleted and remove is called with its key
+// before deletion is committed, so deletion is rolled back if remove fails.
+// Blob row stays locked until transaction ends, so images with identical content can't be created meanwhile.
+func (db *DB) DeleteImage(filename string, userID uint64, remove func(key string) error) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	deleted := Image{}
+	err = tx.Get(
+		&deleted,
+		`DELETE FROM images WHERE filename=$1 AND user_id=$2 RETURNING filename, blob_key, size_bytes`,
+		filename, userID,
+	)
+	// Images uploaded before deduplication own blobs stored under their filenames
+	key := deleted.Filename
+	if err == nil && deleted.BlobKey != "" {
+		key = ""
+		var refs int64
+		err = tx.Get(&refs, `UPDATE blobs SET refs = refs - 1 WHERE key=$1 RETURNING refs`, deleted.BlobKey)
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		if err == nil && refs <= 0 {
+			key = deleted.BlobKey
+			_, err = tx.Exec(`DELETE FROM blobs WHERE key=$1`, key)
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec(
+			`UPDATE quotas SET used_bytes = used_bytes - $2, used_images = used_images - 1 WHERE user_id=$1`,
+			userID, deleted.Size,
+		)
+	}
+	if err == nil && key != "" {
+		err = remove(key)
+	}
+
+	if err != nil {
+		if errT := tx.Rollback(); errT != nil {
+			err = fmt.Errorf("First: %s, Second: %s", err, errT)
+		}
+	} else {
+		err = tx.Commit()
+	}
+	return err
+}
+
+// CreateDerivatives inserts pending derivatives with given names of image into database.
+func (db *DB) CreateDerivatives(imageID uint64, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	_, err := db.Exec(
+		`INSERT INTO derivatives (image_id, name, status) SELECT $1, unnest($2::varchar[]), $3`,
+		imageID, pq.Array(names), DerivativePending,
+	)
+	handleConflictError(&err)
+	return err
+}
+
+// UpdateDerivative updates status of image derivative, failed generations are counted as attempts,
+// sql.ErrNoRows is returned when there is no such derivative.
+func (db *DB) UpdateDerivative(derivative *ImageDerivative) error {
+	if derivative == nil {
+		return errors.New("derivative required")
+	}
+	res, err := db.Exec(
+		`UPDATE derivatives SET status=$1, updated_at=now(), attempts=attempts + CASE WHEN $1=$4 THEN 1 ELSE 0 END
+		WHERE image_id=$2 AND name=$3`,
+		derivative.Status, derivative.ImageID, derivative.Name, DerivativeFailed,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// LoadDerivatives selects derivatives of images with given IDs from database.
+func (db *DB) LoadDerivatives(derivatives *[]ImageDerivative, imageIDs []uint64) error {
+	ids := make([]int64, 0, len(imageIDs))
+	for _, id := range imageIDs {
+		ids = append(ids, int64(id))
+	}
+	err := db.Select(
+		derivatives,
+		`SELECT image_id, name, status FROM derivatives WHERE image_id = ANY($1) ORDER BY image_id, name`,
+		pq.Array(ids),
+	)
+	return err
+}
+
+// LoadUnfinishedDerivatives selects up to n derivatives with given names that are pending
+// or failed less than max number of attempts and aren't updated since before, along with their images.
+// The longest waiting derivatives are selected first.
+func (db *DB) LoadUnfinishedDerivatives(pending *[]PendingDerivative, names []string, before time.Time, n int) error {
+	err := db.Select(
+		pending,
+		`SELECT images.*, derivatives.name AS derivative_name FROM derivatives
+		JOIN images ON images.id = derivatives.image_id
+		WHERE derivatives.name = ANY($1) AND derivatives.updated_at < $2
+		AND (derivatives.status = $3 OR (derivatives.status = $4 AND derivatives.attempts < $5))
+		ORDER BY derivatives.updated_at LIMIT $6`,
+		pq.Array(names), before, DerivativePending, DerivativeFailed, maxDerivativeAttempts, n,
+	)
+	return err
+}
+
+// LoadUsage loads usage of user with quota of user, that is passed quota unless it's overridden for user.
+func (db *DB) LoadUsage(usage *Usage, quota Quota) error {
+	if usage == nil {
+		return errors.New("usage required")
+	}
+	err := db.Get(
+		usage,
+		`SELECT user_id, used_bytes, used_images,
+		coalesce(max_bytes, $2) AS max_bytes, coalesce(max_images, $3) AS max_images
+		FROM quotas WHERE user_id=$1`,
+		usage.UserID, quota.MaxBytes, quota.MaxImages,
+	)
+	if err == sql.ErrNoRows {
+		// User without images has no usage record
+		*usage = Usage{UserID: usage.UserID, MaxBytes: quota.MaxBytes, MaxImages: quota.MaxImages}
+		return nil
+	}
+	return err
+}
+
+// CreateAlbum inserts album into database, ID of created record is set to passed album.
+// Creation time is set to current time if it's missing.
+func (db *DB) CreateAlbum(album *Album) error {
+	if album == nil {
+		return errors.New("album required")
+	}
+	if album.CreatedAt.IsZero() {
+		// Postgres keeps timestamps with microsecond precision
+		album.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	}
+	err := db.QueryRowx(
+		`INSERT INTO albums (user_id, name, created_at) VALUES ($1, $2, $3) RETURNING id`,
+		album.UserID, album.Name, album.CreatedAt,
+	).Scan(&album.ID)
+	handleConflictError(&err)
+	return err
+}
+
+// LoadAlbum loads album to passed var after looking up db record by id and user_id.
+func (db *DB) LoadAlbum(album *Album) error {
+	if album == nil {
+		return errors.New("album required")
+	}
+	return db.Get(album, `SELECT * FROM albums WHERE id=$1 AND user_id=$2`, album.ID, album.UserID)
+}
+
+// LoadAlbums selects albums of user ordered by name from database.
+func (db *DB) LoadAlbums(albums *[]Album, userID uint64) error {
+	return db.Select(albums, `SELECT * FROM albums WHERE user_id=$1 ORDER BY name`, userID)
+}
+
+// RenameAlbum updates name of album, sql.ErrNoRows is returned when user has no such album.
+func (db *DB) RenameAlbum(album *Album) error {
+	if album == nil {
+		return errors.New("album required")
+	}
+	err := db.Get(
+		&album.CreatedAt,
+		`UPDATE albums SET name=$3 WHERE id=$1 AND user_id=$2 RETURNING created_at`,
+		album.ID, album.UserID, album.Name,
+	)
+	handleConflictError(&err)
+	return err
+}
+
+// DeleteAlbum removes album of given user from database, images of album are kept,
+// sql.ErrNoRows is returned when user has no such album.
+func (db *DB) DeleteAlbum(id, userID uint64) error {
+	res, err := db.Exec(`DELETE FROM albums WHERE id=$1 AND user_id=$2`, id, userID)
+	if err != nil {
+		return err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// AddAlbumImage adds image to album, adding image that is already in album does nothing.
+func (db *DB) AddAlbumImage(albumID, imageID uint64) error {
+	_, err := db.Exec(
+		`INSERT INTO album_images (album_id, image_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, albumID, imageID,
+	)
+	return err
+}
+
+// RemoveAlbumImage removes image from album, sql.ErrNoRows is returned when image isn't in album.
+func (db *DB) RemoveAlbumImage(albumID, imageID uint64) error {
+	res, err := db.Exec(`DELETE FROM album_images WHERE album_id=$1 AND image_id=$2`, albumID, imageID)
+	if err != nil {
+		return err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetImageTags replaces tags of image with given ones, empty tags remove all tags of image.
+func (db *DB) SetImageTags(imageID uint64, tags []string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM image_tags WHERE image_id=$1`, imageID)
+	if err == nil && len(tags) > 0 {
+		_, err = tx.Exec(
+			`INSERT INTO image_tags (image_id, tag) SELECT $1, unnest($2::varchar[])`,
+			imageID, pq.Array(tags),
+		)
+	}
+	if err != nil {
+		if errT := tx.Rollback(); errT != nil {
+			err = fmt.Errorf("First: %s, Second: %s", err, errT)
+		}
+	} else {
+		err = tx.Commit()
+	}
+	return err
+}
+
+// LoadImageTags selects tags of images with given IDs from database.
+func (db *DB) LoadImageTags(tags *[]ImageTag, imageIDs []uint64) error {
+	ids := make([]int64, 0, len(imageIDs))
+	for _, id := range imageIDs {
+		ids = append(ids, int64(id))
+	}
+	err := db.Select(
+		tags,
+		`SELECT image_id, tag FROM image_tags WHERE image_id = ANY($1) ORDER BY image_id, tag`,
+		pq.Array(ids),
+	)
+	return err
+}
+
+// LoadTagCounts selects tags used by user with numbers of images having them ordered by tag.
+func (db *DB) LoadTagCounts(counts *[]TagCount, userID uint64) error {
+	err := db.Select(
+		counts,
+		`SELECT tag, count(*) AS count FROM image_tags JOIN images ON images.id = image_tags.image_id
+		WHERE images.user_id=$1 GROUP BY tag ORDER BY tag`,
+		userID,
+	)
+	return err
+}
+
+// CreateShare inserts share of image into database, ID of created record is set to passed share.
+// Creation time is set to current time if it's missing.
+func (db *DB) CreateShare(share *Share) error {
+	if share == nil {
+		return errors.New("share required")
+	}
+	if share.CreatedAt.IsZero() {
+		// Postgres keeps timestamps with microsecond precision
+		share.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	}
+	err := db.QueryRowx(
+		`INSERT INTO shares (image_id, user_id, expires_at, max_views, created_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		share.ImageID, share.UserID, share.ExpiresAt, share.MaxViews, share.CreatedAt,
+	).Scan(&share.ID)
+	return err
+}
+
+// UseShare counts view of image with given filename by share and loads share to passed var,
+// sql.ErrNoRows is returned when share of such image is missing, expired or has no views left.
+func (db *DB) UseShare(share *Share, filename string) error {
+	if share == nil {
+		return errors.New("share required")
+	}
+	return db.Get(
+		share,
+		`UPDATE shares SET views = shares.views + 1 FROM images
+		WHERE shares.id=$1 AND images.id = shares.image_id AND images.filename=$2
+		AND shares.expires_at > now() AND (shares.max_views = 0 OR shares.views < shares.max_views)
+		RETURNING shares.*`,
+		share.ID, filename,
+	)
+}
+
+// LoadShare loads share of image with given filename to passed var without counting view,
+// sql.ErrNoRows is returned when share of such image is missing, expired or has no views left.
+func (db *DB) LoadShare(share *Share, filename string) error {
+	if share == nil {
+		return errors.New("share required")
+	}
+	return db.Get(
+		share,
+		`SELECT shares.* FROM shares JOIN images ON images.id = shares.image_id
+		WHERE shares.id=$1 AND images.filename=$2
+		AND shares.expires_at > now() AND (shares.max_views = 0 OR shares.views < shares.max_views)`,
+		share.ID, filename,
+	)
+}
+
+// ReturnShareView uncounts view of share counted by UseShare,
+// sql.ErrNoRows is returned when share is missing or has no views counted.
+func (db *DB) ReturnShareView(id uint64) error {
+	res, err := db.Exec(`UPDATE shares SET views = views - 1 WHERE id=$1 AND views > 0`, id)
+	if err != nil {
+		return err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteShare removes share of image from database, sql.ErrNoRows is returned when image has no such share.
+func (db *DB) DeleteShare(id, imageID uint64) error {
+	res, err := db.Exec(`DELETE FROM shares WHERE id=$1 AND image_id=$2`, id, imageID)
+	if err != nil {
+		return err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CreateUploadSession inserts upload session into database.
+// Creation and update times are set to current time if they are missing.
+// Length of session is reserved in usage of its user along with lengths of other sessions of user,
+// ErrQuotaExceeded is returned if they exceed quota of user as if they were images
+// and ErrTooManyUploads is returned if user has max number of sessions already.
+func (db *DB) CreateUploadSession(session *UploadSession, quota *Quota) error {
+	if session == nil {
+		return errors.New("upload session required")
+	}
+	if session.CreatedAt.IsZero() {
+		// Postgres keeps timestamps with microsecond precision
+		session.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	}
+	if session.UpdatedAt.IsZero() {
+		session.UpdatedAt = session.CreatedAt
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	err = reserveUploadSession(tx, session, quota)
+	if err == nil {
+		_, err = tx.Exec(
+			`INSERT INTO upload_sessions (id, user_id, filename, upload_length, upload_offset, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			session.ID, session.UserID, session.Filename, session.Length, session.Offset, session.CreatedAt,
+			session.UpdatedAt,
+		)
+		handleConflictError(&err)
+	}
+
+	if err != nil {
+		if errT := tx.Rollback(); errT != nil {
+			err = fmt.Errorf("First: %s, Second: %s", err, errT)
+		}
+	} else {
+		err = tx.Commit()
+	}
+	return err
+}
+
+// reserveUploadSession checks that upload session fits into number of sessions and quota of its user.
+// Usage row stays locked until transaction ends, so concurrent sessions of user are reserved one by one.
+func reserveUploadSession(tx *sqlx.Tx, session *UploadSession, quota *Quota) error {
+	if quota == nil {
+		quota = &Quota{}
+	}
+	usage := Usage{}
+	err := tx.Get(
+		&usage,
+		`INSERT INTO quotas (user_id) VALUES ($1) ON CONFLICT (user_id) DO UPDATE SET user_id = quotas.user_id
+		RETURNING user_id, used_bytes, used_images,
+		coalesce(max_bytes, $2) AS max_bytes, coalesce(max_images, $3) AS max_images`,
+		session.UserID, quota.MaxBytes, quota.MaxImages,
+	)
+	if err != nil {
+		return err
+	}
+
+	reserved := Usage{}
+	err = tx.Get(
+		&reserved,
+		`SELECT coalesce(sum(upload_length), 0) AS used_bytes, count(*) AS used_images
+		FROM upload_sessions WHERE user_id=$1`,
+		session.UserID,
+	)
+	if err != nil {
+		return err
+	}
+	if reserved.UsedImages >= MaxUploadSessions {
+		return ErrTooManyUploads
+	}
+	usage.UsedBytes += reserved.UsedBytes + session.Length
+	usage.UsedImages += reserved.UsedImages + 1
+	return usage.check()
+}
+
+// LoadUploadSession loads upload session to passed var after looking up db record by id and user_id.
+func (db *DB) LoadUploadSession(session *UploadSession) error {
+	if session == nil {
+		return errors.New("upload session required")
+	}
+	return db.Get(
+		session, `SELECT * FROM upload_sessions WHERE id=$1 AND user_id=$2`, session.ID, session.UserID,
+	)
+}
+
+// ClaimUploadSession marks upload session as being finalized and updates its update time,
+// session is loaded to passed var. Claimed session isn't claimed again until it's released,
+// sql.ErrNoRows is returned when user has no such session or it's claimed already.
+func (db *DB) ClaimUploadSession(session *UploadSession) error {
+	if session == nil {
+		return errors.New("upload session required")
+	}
+	return db.Get(
+		session,
+		`UPDATE upload_sessions SET finalizing = true, updated_at = now()
+		WHERE id=$1 AND user_id=$2 AND NOT finalizing RETURNING *`,
+		session.ID, session.UserID,
+	)
+}
+
+// ReleaseUploadSession marks claimed upload session as not being finalized, so its finalization can be retried,
+// sql.ErrNoRows is returned when user has no such session.
+func (db *DB) ReleaseUploadSession(id string, userID uint64) error {
+	res, err := db.Exec(
+		`UPDATE upload_sessions SET finalizing = false, updated_at = now() WHERE id=$1 AND user_id=$2`, id, userID,
+	)
+	if err != nil {
+		return err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// AppendUploadChunk records chunk of given size stored under key as next chunk of upload session,
+// offset and update time of passed session are updated. sql.ErrNoRows is returned when user has no such session,
+// session is being finalized or other chunk was already recorded at session offset.
+func (db *DB) AppendUploadChunk(session *UploadSession, key string, size int64) error {
+	if session == nil {
+		return errors.New("upload session required")
+	}
+	updatedAt := time.Now().UTC().Truncate(time.Microsecond)
+	err := db.Get(
+		&session.Chunks,
+		`UPDATE upload_sessions
+		SET upload_offset = upload_offset + $4, chunks = array_append(chunks, $5), updated_at = $6
+		WHERE id=$1 AND user_id=$2 AND upload_offset=$3 AND NOT finalizing RETURNING chunks`,
+		session.ID, session.UserID, session.Offset, size, key, updatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	session.Offset, session.UpdatedAt = session.Offset+size, updatedAt
+	return nil
+}
+
+// DeleteUploadSession removes upload session of given user from database,
+// sql.ErrNoRows is returned when user has no such session.
+func (db *DB) DeleteUploadSession(id string, userID uint64) error {
+	res, err := db.Exec(`DELETE FROM upload_sessions WHERE id=$1 AND user_id=$2`, id, userID)
+	if err != nil {
+		return err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteStaleUploadSession removes upload session from database unless it was updated since given time
+// or it's being finalized, sql.ErrNoRows is returned when there is no such stale session.
+func (db *DB) DeleteStaleUploadSession(id string, before time.Time) error {
+	res, err := db.Exec(
+		`DELETE FROM upload_sessions WHERE id=$1 AND updated_at < $2 AND NOT finalizing`, id, before,
+	)
+	if err != nil {
+		return err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// LoadStaleUploadSessions selects upload sessions that weren't updated since given time
+// and aren't being finalized from database.
+func (db *DB) LoadStaleUploadSessions(sessions *[]UploadSession, before time.Time) error {
+	return db.Select(
+		sessions,
+		`SELECT * FROM upload_sessions WHERE updated_at < $1 AND NOT finalizing ORDER BY updated_at`,
+		before,
+	)
+}
@@ -1,8 +1,12 @@
 package imgr_test
 
 import (
+	"database/sql"
+	"errors"
 	"os"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -24,11 +28,15 @@ func TestDBCreateImage(t *testing.T) {
 
 			var err error
 			for _, img := range ex.input {
-				if errA := imgDB.CreateImage(img); errA != nil {
+				if errA := imgDB.CreateImage(img, nil); errA != nil {
 					err = errA
 				}
 			}
 			assert.EqualValues(t, ex.wantErr, err, "Error should be as expected")
+			if err == nil {
+				assert.NotZero(t, ex.input[0].ID, "Image ID should be set")
+				assert.NotZero(t, ex.input[0].CreatedAt, "Image creation time should be set")
+			}
 		})
 	}
 }
@@ -43,7 +51,7 @@ func TestDBLoadImages(t *testing.T) {
 
 	for _, ex := range examplesDBLoadImages {
 		for _, img := range ex.initial {
-			err = imgDB.CreateImage(&img)
+			err = imgDB.CreateImage(&img, nil)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -53,11 +61,11 @@ func TestDBLoadImages(t *testing.T) {
 			defer cleanTable(t, imgDB)
 
 			imgs := make([]imgr.Image, 0)
-			err := imgDB.LoadImages(&imgs, ex.limit, ex.offset, ex.userID)
+			err := imgDB.LoadImages(&imgs, ex.query)
 			assert.EqualValues(t, ex.wantErr, err, "Error should be as expected")
 			for i, img := range ex.want {
 				if i < len(imgs) {
-					assert.Equalf(t, img, imgs[i], "Loaded Image %d is not as expected", i)
+					assert.Equalf(t, img, withoutGenerated(imgs[i]), "Loaded Image %d is not as expected", i)
 				} else {
 					t.Errorf("Image %d is absent", i)
 				}
@@ -66,8 +74,595 @@ func TestDBLoadImages(t *testing.T) {
 	}
 }
 
+func TestDBCountImages(t *testing.T) {
+	db, err := util.OpenDB(os.Getenv("DATABASE_URL"), os.Getenv("MIGRATIONS_FOLDER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.CleanDB(t, db)
+	imgDB := &imgr.DB{DB: db}
+
+	for _, ex := range examplesDBCountImages {
+		for _, img := range ex.initial {
+			err = imgDB.CreateImage(&img, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		t.Run(ex.name, func(t *testing.T) {
+			defer cleanTable(t, imgDB)
+
+			var count uint64
+			err := imgDB.CountImages(&count, ex.query)
+			assert.EqualValues(t, ex.wantErr, err, "Error should be as expected")
+			assert.Equal(t, ex.want, count, "Count is not as expected")
+		})
+	}
+}
+
+func TestDBLoadImage(t *testing.T) {
+	db, err := util.OpenDB(os.Getenv("DATABASE_URL"), os.Getenv("MIGRATIONS_FOLDER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.CleanDB(t, db)
+	imgDB := &imgr.DB{DB: db}
+
+	for _, ex := range examplesDBLoadImage {
+		for _, img := range ex.initial {
+			err = imgDB.CreateImage(&img, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		t.Run(ex.name, func(t *testing.T) {
+			defer cleanTable(t, imgDB)
+
+			err := imgDB.LoadImage(ex.input)
+			assert.EqualValues(t, ex.wantErr, err, "Error should be as expected")
+			if ex.input != nil {
+				*ex.input = withoutGenerated(*ex.input)
+			}
+			assert.Equal(t, ex.want, ex.input, "Loaded Image is not as expected")
+		})
+	}
+}
+
+func TestDBDeleteImage(t *testing.T) {
+	db, err := util.OpenDB(os.Getenv("DATABASE_URL"), os.Getenv("MIGRATIONS_FOLDER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.CleanDB(t, db)
+	imgDB := &imgr.DB{DB: db}
+
+	for _, ex := range examplesDBDeleteImage {
+		for _, img := range ex.initial {
+			err = imgDB.CreateImage(&img, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		t.Run(ex.name, func(t *testing.T) {
+			defer cleanTable(t, imgDB)
+
+			err := imgDB.DeleteImage(ex.filename, ex.userID, keepBlob)
+			assert.EqualValues(t, ex.wantErr, err, "Error should be as expected")
+
+			imgs := make([]imgr.Image, 0)
+			if err = imgDB.LoadImages(&imgs, imgr.ImageQuery{UserID: 1}); err != nil {
+				t.Fatal(err)
+			}
+			for i := range imgs {
+				imgs[i] = withoutGenerated(imgs[i])
+			}
+			assert.Equal(t, ex.want, imgs, "Remaining images are not as expected")
+		})
+	}
+}
+
+func TestDBDerivatives(t *testing.T) {
+	db, err := util.OpenDB(os.Getenv("DATABASE_URL"), os.Getenv("MIGRATIONS_FOLDER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.CleanDB(t, db)
+	imgDB := &imgr.DB{DB: db}
+	defer cleanTable(t, imgDB)
+
+	images := []*imgr.Image{{Filename: "filename1", UserID: 1}, {Filename: "filename2", UserID: 1}}
+	for _, img := range images {
+		if err = imgDB.CreateImage(img, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = imgDB.CreateDerivatives(images[0].ID, []string{"thumb", "medium"})
+	assert.Nil(t, err, "Derivatives should be created")
+	err = imgDB.CreateDerivatives(images[0].ID, []string{"thumb"})
+	assert.Equal(t, imgr.ErrUniqueIndexConflict("derivatives"), err, "Duplicated derivative should be rejected")
+
+	err = imgDB.UpdateDerivative(&imgr.ImageDerivative{ImageID: images[0].ID, Name: "thumb", Status: imgr.DerivativeReady})
+	assert.Nil(t, err, "Derivative should be updated")
+	err = imgDB.UpdateDerivative(&imgr.ImageDerivative{ImageID: images[1].ID, Name: "thumb", Status: imgr.DerivativeReady})
+	assert.Equal(t, sql.ErrNoRows, err, "Missing derivative should be reported")
+
+	derivatives := make([]imgr.ImageDerivative, 0)
+	err = imgDB.LoadDerivatives(&derivatives, []uint64{images[0].ID, images[1].ID})
+	assert.Nil(t, err, "Derivatives should be loaded")
+	assert.Equal(t, []imgr.ImageDerivative{
+		{ImageID: images[0].ID, Name: "medium", Status: imgr.DerivativePending},
+		{ImageID: images[0].ID, Name: "thumb", Status: imgr.DerivativeReady},
+	}, derivatives, "Loaded derivatives are not as expected")
+}
+
+func TestDBLoadUnfinishedDerivatives(t *testing.T) {
+	db, err := util.OpenDB(os.Getenv("DATABASE_URL"), os.Getenv("MIGRATIONS_FOLDER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.CleanDB(t, db)
+	imgDB := &imgr.DB{DB: db}
+	defer cleanTable(t, imgDB)
+
+	img := &imgr.Image{Filename: "filename1", UserID: 1}
+	if err = imgDB.CreateImage(img, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = imgDB.CreateDerivatives(img.ID, []string{"thumb", "medium", "large", "removed"}); err != nil {
+		t.Fatal(err)
+	}
+	err = imgDB.UpdateDerivative(&imgr.ImageDerivative{ImageID: img.ID, Name: "large", Status: imgr.DerivativeReady})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Medium derivative fails every attempt
+	for i := 0; i < 3; i++ {
+		err = imgDB.UpdateDerivative(&imgr.ImageDerivative{ImageID: img.ID, Name: "medium", Status: imgr.DerivativeFailed})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pending := make([]imgr.PendingDerivative, 0)
+	err = imgDB.LoadUnfinishedDerivatives(&pending, []string{"thumb", "medium", "large"}, time.Now().Add(-time.Hour), 10)
+	assert.Nil(t, err, "Derivatives should be loaded")
+	assert.Empty(t, pending, "Recently updated derivatives shouldn't be loaded")
+
+	err = imgDB.LoadUnfinishedDerivatives(&pending, []string{"thumb", "medium", "large"}, time.Now().Add(time.Hour), 10)
+	assert.Nil(t, err, "Derivatives should be loaded")
+	if assert.Len(t, pending, 1, "Only pending derivative with given name should be loaded") {
+		assert.Equal(t, "thumb", pending[0].Name, "Incorrect derivative loaded")
+		assert.Equal(t, img.Filename, pending[0].Filename, "Image of derivative should be loaded")
+	}
+}
+
+// keepBlob is remove function of DB.DeleteImage that keeps blobs.
+func keepBlob(string) error {
+	return nil
+}
+
+func TestDBDeleteImageBlob(t *testing.T) {
+	db, err := util.OpenDB(os.Getenv("DATABASE_URL"), os.Getenv("MIGRATIONS_FOLDER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.CleanDB(t, db)
+	imgDB := &imgr.DB{DB: db}
+	defer cleanTable(t, imgDB)
+
+	// Both images share the same content
+	images := []*imgr.Image{
+		{Filename: "filename1", UserID: 1, BlobKey: "content/1"},
+		{Filename: "filename2", UserID: 2, BlobKey: "content/1"},
+		{Filename: "filename3", UserID: 2},
+	}
+	for _, img := range images {
+		if err = imgDB.CreateImage(img, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removed := make([]string, 0)
+	remove := func(key string) error {
+		removed = append(removed, key)
+		return nil
+	}
+
+	assert.Nil(t, imgDB.DeleteImage("filename1", 1, remove), "Image should be deleted")
+	assert.Equal(t, []string{}, removed, "Referenced blob should not be removed")
+
+	err = imgDB.DeleteImage("filename2", 2, func(string) error { return errors.New("blob store error") })
+	assert.Equal(t, errors.New("blob store error"), err, "Remove error should be returned")
+	kept := &imgr.Image{Filename: "filename2", UserID: 2}
+	assert.Nil(t, imgDB.LoadImage(kept), "Image should be kept when its blob can't be removed")
+	assert.Equal(t, images[1].ID, kept.ID, "Kept image should not be recreated")
+
+	assert.Nil(t, imgDB.DeleteImage("filename2", 2, remove), "Image should be deleted after failed removal")
+	assert.Nil(t, imgDB.DeleteImage("filename3", 2, remove), "Image should be deleted")
+	assert.Equal(t, []string{"content/1", "filename3"}, removed, "Unreferenced blobs should be removed")
+	var count uint64
+	if err = db.Get(&count, `SELECT count(*) FROM blobs`); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(0), count, "Removed blob should not be recorded")
+	usage := &imgr.Usage{UserID: 2}
+	assert.Nil(t, imgDB.LoadUsage(usage, imgr.Quota{}), "Usage should be loaded")
+	assert.Equal(t, imgr.Usage{UserID: 2}, *usage, "Deleted images should not be accounted")
+}
+
+func TestDBQuota(t *testing.T) {
+	db, err := util.OpenDB(os.Getenv("DATABASE_URL"), os.Getenv("MIGRATIONS_FOLDER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.CleanDB(t, db)
+	imgDB := &imgr.DB{DB: db}
+	defer cleanTable(t, imgDB)
+
+	quota := &imgr.Quota{MaxBytes: 1000, MaxImages: 2}
+	usage := &imgr.Usage{UserID: 1}
+	assert.Nil(t, imgDB.LoadUsage(usage, *quota), "Usage should be loaded")
+	assert.Equal(t, imgr.Usage{UserID: 1, MaxBytes: 1000, MaxImages: 2}, *usage, "User without images has no usage")
+
+	err = imgDB.CreateImage(&imgr.Image{Filename: "filename1", UserID: 1, Size: 600}, quota)
+	assert.Nil(t, err, "Image within quota should be created")
+	err = imgDB.CreateImage(&imgr.Image{Filename: "filename2", UserID: 1, Size: 600}, quota)
+	assert.Equal(t, imgr.QuotaBytes, err, "Image over bytes quota should be rejected")
+	err = imgDB.CreateImage(&imgr.Image{Filename: "filename2", UserID: 1, Size: 300}, quota)
+	assert.Nil(t, err, "Image within quota should be created")
+	err = imgDB.CreateImage(&imgr.Image{Filename: "filename3", UserID: 1, Size: 1}, quota)
+	assert.Equal(t, imgr.QuotaImages, err, "Image over images quota should be rejected")
+	err = imgDB.CreateImage(&imgr.Image{Filename: "filename3", UserID: 2, Size: 1}, quota)
+	assert.Nil(t, err, "Quota of other user should not be affected")
+
+	assert.Nil(t, imgDB.DeleteImage("filename1", 1, keepBlob), "Image should be deleted")
+	assert.Nil(t, imgDB.LoadUsage(usage, *quota), "Usage should be loaded")
+	assert.Equal(t, imgr.Usage{UserID: 1, UsedBytes: 300, UsedImages: 1, MaxBytes: 1000, MaxImages: 2}, *usage)
+
+	// Quota overridden for user takes precedence
+	if _, err = db.Exec(`UPDATE quotas SET max_bytes = 200, max_images = 0 WHERE user_id = 1`); err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, imgDB.LoadUsage(usage, *quota), "Usage should be loaded")
+	assert.Equal(t, imgr.Usage{UserID: 1, UsedBytes: 300, UsedImages: 1, MaxBytes: 200}, *usage)
+	err = imgDB.CreateImage(&imgr.Image{Filename: "filename4", UserID: 1, Size: 1}, quota)
+	assert.Equal(t, imgr.QuotaBytes, err, "Overridden quota should be enforced")
+	err = imgDB.CreateImage(&imgr.Image{Filename: "filename4", UserID: 1, Size: 1}, nil)
+	assert.Nil(t, err, "Nil quota should not be enforced")
+}
+
+func TestDBAlbums(t *testing.T) {
+	db, err := util.OpenDB(os.Getenv("DATABASE_URL"), os.Getenv("MIGRATIONS_FOLDER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.CleanDB(t, db)
+	imgDB := &imgr.DB{DB: db}
+	defer cleanTable(t, imgDB)
+
+	album := &imgr.Album{Name: "Holidays", UserID: 1}
+	assert.Nil(t, imgDB.CreateAlbum(album), "Album should be created")
+	err = imgDB.CreateAlbum(&imgr.Album{Name: "Holidays", UserID: 1})
+	assert.Equal(t, imgr.ErrUniqueIndexConflict("albums"), err, "Album names should be unique for user")
+	assert.Nil(t, imgDB.CreateAlbum(&imgr.Album{Name: "Holidays", UserID: 2}), "Other user can use the same name")
+
+	loaded := &imgr.Album{ID: album.ID, UserID: 2}
+	assert.Equal(t, sql.ErrNoRows, imgDB.LoadAlbum(loaded), "Album of other user should not be loaded")
+	album.Name = "Trips"
+	assert.Nil(t, imgDB.RenameAlbum(album), "Album should be renamed")
+	albums := make([]imgr.Album, 0)
+	assert.Nil(t, imgDB.LoadAlbums(&albums, 1), "Albums should be loaded")
+	if assert.Equal(t, 1, len(albums), "User should have one album") {
+		assert.Equal(t, "Trips", albums[0].Name, "Album should be renamed")
+	}
+
+	img := &imgr.Image{Filename: "filename1", UserID: 1}
+	if err = imgDB.CreateImage(img, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, imgDB.AddAlbumImage(album.ID, img.ID), "Image should be added")
+	assert.Nil(t, imgDB.AddAlbumImage(album.ID, img.ID), "Adding image twice should succeed")
+	var count uint64
+	assert.Nil(t, imgDB.CountImages(&count, imgr.ImageQuery{UserID: 1, AlbumID: album.ID}), "Images should be counted")
+	assert.Equal(t, uint64(1), count, "Album should have one image")
+
+	assert.Nil(t, imgDB.RemoveAlbumImage(album.ID, img.ID), "Image should be removed")
+	assert.Equal(t, sql.ErrNoRows, imgDB.RemoveAlbumImage(album.ID, img.ID), "Removed image isn't in album")
+	assert.Nil(t, imgDB.AddAlbumImage(album.ID, img.ID), "Image should be added")
+	assert.Nil(t, imgDB.DeleteAlbum(album.ID, 1), "Album should be deleted")
+	assert.Equal(t, sql.ErrNoRows, imgDB.DeleteAlbum(album.ID, 1), "Deleted album should be missing")
+	assert.Nil(t, imgDB.LoadImage(&imgr.Image{Filename: "filename1", UserID: 1}), "Image of album should be kept")
+}
+
+func TestDBTags(t *testing.T) {
+	db, err := util.OpenDB(os.Getenv("DATABASE_URL"), os.Getenv("MIGRATIONS_FOLDER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.CleanDB(t, db)
+	imgDB := &imgr.DB{DB: db}
+	defer cleanTable(t, imgDB)
+
+	images := []*imgr.Image{
+		{Filename: "filename1", UserID: 1},
+		{Filename: "filename2", UserID: 1},
+		{Filename: "filename3", UserID: 2},
+	}
+	for _, img := range images {
+		if err = imgDB.CreateImage(img, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Nil(t, imgDB.SetImageTags(images[0].ID, []string{"cats", "outdoor"}), "Tags should be set")
+	assert.Nil(t, imgDB.SetImageTags(images[1].ID, []string{"dogs"}), "Tags should be set")
+	assert.Nil(t, imgDB.SetImageTags(images[1].ID, []string{"cats"}), "Tags should be replaced")
+	assert.Nil(t, imgDB.SetImageTags(images[2].ID, []string{"cats"}), "Tags should be set")
+
+	var count uint64
+	query := imgr.ImageQuery{UserID: 1, Tags: []string{"cats", "outdoor"}}
+	assert.Nil(t, imgDB.CountImages(&count, query), "Images should be counted")
+	assert.Equal(t, uint64(1), count, "Only image with all tags should match")
+	query.AnyTag = true
+	assert.Nil(t, imgDB.CountImages(&count, query), "Images should be counted")
+	assert.Equal(t, uint64(2), count, "Images with any tag should match")
+
+	tags := make([]imgr.ImageTag, 0)
+	assert.Nil(t, imgDB.LoadImageTags(&tags, []uint64{images[0].ID, images[1].ID}), "Tags should be loaded")
+	assert.Equal(t, []imgr.ImageTag{
+		{ImageID: images[0].ID, Tag: "cats"},
+		{ImageID: images[0].ID, Tag: "outdoor"},
+		{ImageID: images[1].ID, Tag: "cats"},
+	}, tags)
+
+	counts := make([]imgr.TagCount, 0)
+	assert.Nil(t, imgDB.LoadTagCounts(&counts, 1), "Tag counts should be loaded")
+	assert.Equal(t, []imgr.TagCount{{Tag: "cats", Count: 2}, {Tag: "outdoor", Count: 1}}, counts)
+
+	assert.Nil(t, imgDB.SetImageTags(images[0].ID, nil), "Tags should be removed")
+	counts = make([]imgr.TagCount, 0)
+	assert.Nil(t, imgDB.LoadTagCounts(&counts, 1), "Tag counts should be loaded")
+	assert.Equal(t, []imgr.TagCount{{Tag: "cats", Count: 1}}, counts)
+}
+
+func TestDBShares(t *testing.T) {
+	db, err := util.OpenDB(os.Getenv("DATABASE_URL"), os.Getenv("MIGRATIONS_FOLDER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.CleanDB(t, db)
+	imgDB := &imgr.DB{DB: db}
+	defer cleanTable(t, imgDB)
+
+	img := &imgr.Image{Filename: "filename1", UserID: 1}
+	if err = imgDB.CreateImage(img, nil); err != nil {
+		t.Fatal(err)
+	}
+	limited := &imgr.Share{ImageID: img.ID, UserID: 1, ExpiresAt: time.Now().Add(time.Hour), MaxViews: 1}
+	assert.Nil(t, imgDB.CreateShare(limited), "Share should be created")
+	expired := &imgr.Share{ImageID: img.ID, UserID: 1, ExpiresAt: time.Now().Add(-time.Hour)}
+	assert.Nil(t, imgDB.CreateShare(expired), "Share should be created")
+
+	used := &imgr.Share{ID: limited.ID}
+	assert.Nil(t, imgDB.LoadShare(used, "filename1"), "Share should be loaded")
+	assert.Equal(t, int64(0), used.Views, "Loaded share should not count view")
+	assert.Equal(t, sql.ErrNoRows, imgDB.LoadShare(used, "filename2"), "Share of other image should not be loaded")
+	assert.Equal(t, sql.ErrNoRows, imgDB.ReturnShareView(used.ID), "Share without views should not return view")
+	assert.Equal(t, sql.ErrNoRows, imgDB.UseShare(used, "filename2"), "Share of other image should not be used")
+	assert.Nil(t, imgDB.UseShare(used, "filename1"), "Share should be used")
+	assert.Equal(t, imgr.Share{
+		ID: limited.ID, ImageID: img.ID, UserID: 1, ExpiresAt: used.ExpiresAt, MaxViews: 1, Views: 1,
+		CreatedAt: used.CreatedAt,
+	}, *used)
+	assert.Equal(t, sql.ErrNoRows, imgDB.UseShare(used, "filename1"), "Used up share should not be used")
+	assert.Equal(t, sql.ErrNoRows, imgDB.LoadShare(used, "filename1"), "Used up share should not be loaded")
+	assert.Nil(t, imgDB.ReturnShareView(used.ID), "View should be returned")
+	assert.Nil(t, imgDB.UseShare(used, "filename1"), "Share with returned view should be used")
+	assert.Equal(t, sql.ErrNoRows, imgDB.UseShare(&imgr.Share{ID: expired.ID}, "filename1"), "Share is expired")
+
+	assert.Equal(t, sql.ErrNoRows, imgDB.DeleteShare(expired.ID, img.ID+1), "Share of other image should be kept")
+	assert.Nil(t, imgDB.DeleteShare(expired.ID, img.ID), "Share should be revoked")
+	assert.Equal(t, sql.ErrNoRows, imgDB.DeleteShare(expired.ID, img.ID), "Revoked share should be missing")
+}
+
+func TestDBCreateImages(t *testing.T) {
+	db, err := util.OpenDB(os.Getenv("DATABASE_URL"), os.Getenv("MIGRATIONS_FOLDER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.CleanDB(t, db)
+	imgDB := &imgr.DB{DB: db}
+	defer cleanTable(t, imgDB)
+
+	images := []*imgr.Image{
+		{Filename: "filename1", UserID: 1, Size: 100, BlobKey: "content/1"},
+		{Filename: "filename1", UserID: 1, Size: 100, BlobKey: "content/1"},
+		{Filename: "filename2", UserID: 1, Size: 100, BlobKey: "content/1"},
+		{Filename: "filename3", UserID: 1, Size: 100, BlobKey: "content/2"},
+		{UserID: 1},
+	}
+	errs, err := imgDB.CreateImages(images, &imgr.Quota{MaxImages: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, errs[0], "Image should be created")
+	assert.Equal(t, imgr.ErrUniqueIndexConflict("images"), errs[1], "Image with taken filename should be rejected")
+	assert.Nil(t, errs[2], "Image should be created after rejected one")
+	assert.Equal(t, imgr.QuotaImages, errs[3], "Image over quota should be rejected")
+	assert.NotNil(t, errs[4], "Image without filename should be rejected")
+	assert.NotZero(t, images[0].ID, "ID of created image should be set")
+	assert.Zero(t, images[1].ID, "ID of rejected image should not be set")
+
+	var count uint64
+	assert.Nil(t, imgDB.CountImages(&count, imgr.ImageQuery{UserID: 1}), "Images should be counted")
+	assert.Equal(t, uint64(2), count, "Only created images should be stored")
+	usage := &imgr.Usage{UserID: 1}
+	assert.Nil(t, imgDB.LoadUsage(usage, imgr.Quota{}), "Usage should be loaded")
+	assert.Equal(t, imgr.Usage{UserID: 1, UsedBytes: 200, UsedImages: 2}, *usage, "Only created images are accounted")
+	err = imgDB.DeleteImage("filename1", 1, func(string) error { return errors.New("blob is referenced") })
+	assert.Nil(t, err, "Image should be deleted without removing referenced blob")
+	if err = db.Get(&count, `SELECT count(*) FROM blobs WHERE key='content/2'`); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(0), count, "Blob of rejected image should not be recorded")
+}
+
+func TestDBUploadSessions(t *testing.T) {
+	db, err := util.OpenDB(os.Getenv("DATABASE_URL"), os.Getenv("MIGRATIONS_FOLDER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.CleanDB(t, db)
+	imgDB := &imgr.DB{DB: db}
+	defer cleanTable(t, imgDB)
+
+	session := &imgr.UploadSession{ID: "session1", UserID: 1, Filename: "image.png", Length: 100}
+	assert.Nil(t, imgDB.CreateUploadSession(session, nil), "Session should be created")
+	err = imgDB.CreateUploadSession(session, nil)
+	assert.Equal(t, imgr.ErrUniqueIndexConflict("upload_sessions"), err, "Session exists")
+	stale := &imgr.UploadSession{
+		ID: "session2", UserID: 2, Filename: "image.png", Length: 100, UpdatedAt: time.Now().Add(-2 * time.Hour),
+	}
+	assert.Nil(t, imgDB.CreateUploadSession(stale, nil), "Session should be created")
+
+	assert.Equal(t, sql.ErrNoRows, imgDB.LoadUploadSession(&imgr.UploadSession{ID: "session1", UserID: 2}))
+	assert.Nil(t, imgDB.AppendUploadChunk(session, "sessions/session1/0", 60), "Chunk should be recorded")
+	conflicting := &imgr.UploadSession{ID: "session1", UserID: 1}
+	assert.Equal(t, sql.ErrNoRows, imgDB.AppendUploadChunk(conflicting, "sessions/session1/1", 60), "Offset is taken")
+	assert.Nil(t, imgDB.AppendUploadChunk(session, "sessions/session1/60", 40), "Chunk should be recorded")
+
+	loaded := &imgr.UploadSession{ID: "session1", UserID: 1}
+	assert.Nil(t, imgDB.LoadUploadSession(loaded), "Session should be loaded")
+	assert.Equal(t, int64(100), loaded.Offset, "Chunks should advance offset")
+	assert.Equal(t, []string{"sessions/session1/0", "sessions/session1/60"}, []string(loaded.Chunks), "Incorrect chunks")
+
+	claimed := &imgr.UploadSession{ID: "session1", UserID: 1}
+	assert.Nil(t, imgDB.ClaimUploadSession(claimed), "Session should be claimed")
+	assert.True(t, claimed.Finalizing, "Claimed session should be finalizing")
+	assert.Equal(t, sql.ErrNoRows, imgDB.ClaimUploadSession(claimed), "Claimed session should not be claimed again")
+	assert.Nil(t, imgDB.ReleaseUploadSession("session1", 1), "Session should be released")
+	assert.Nil(t, imgDB.ClaimUploadSession(claimed), "Released session should be claimed")
+	assert.Equal(t, sql.ErrNoRows, imgDB.ReleaseUploadSession("session1", 2), "Session of other user should be kept")
+	assert.Equal(t, sql.ErrNoRows, imgDB.AppendUploadChunk(claimed, "sessions/session1/100", 1), "Session is claimed")
+
+	sessions := make([]imgr.UploadSession, 0)
+	assert.Nil(t, imgDB.LoadStaleUploadSessions(&sessions, time.Now().Add(-time.Hour)), "Sessions should be loaded")
+	if assert.Equal(t, 1, len(sessions), "Only stale session should be loaded") {
+		assert.Equal(t, "session2", sessions[0].ID, "Incorrect stale session")
+	}
+	before := time.Now().Add(-time.Hour)
+	assert.Equal(t, sql.ErrNoRows, imgDB.DeleteStaleUploadSession("session1", time.Now()), "Claimed session is kept")
+	assert.Equal(t, sql.ErrNoRows, imgDB.DeleteStaleUploadSession("session1", before), "Active session is kept")
+	assert.Nil(t, imgDB.DeleteStaleUploadSession("session2", before), "Stale session should be removed")
+
+	assert.Equal(t, sql.ErrNoRows, imgDB.DeleteUploadSession("session1", 2), "Session of other user should be kept")
+	assert.Nil(t, imgDB.DeleteUploadSession("session1", 1), "Session should be removed")
+	assert.Equal(t, sql.ErrNoRows, imgDB.DeleteUploadSession("session1", 1), "Removed session should be missing")
+}
+
+func TestDBUploadSessionsQuota(t *testing.T) {
+	db, err := util.OpenDB(os.Getenv("DATABASE_URL"), os.Getenv("MIGRATIONS_FOLDER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.CleanDB(t, db)
+	imgDB := &imgr.DB{DB: db}
+	defer cleanTable(t, imgDB)
+
+	if err = imgDB.CreateImage(&imgr.Image{Filename: "filename1", UserID: 1, Size: 50}, nil); err != nil {
+		t.Fatal(err)
+	}
+	quota := &imgr.Quota{MaxBytes: 200, MaxImages: 3}
+	session := &imgr.UploadSession{ID: "session1", UserID: 1, Filename: "image.png", Length: 100}
+	assert.Nil(t, imgDB.CreateUploadSession(session, quota), "Session should be created")
+	session = &imgr.UploadSession{ID: "session2", UserID: 1, Filename: "image.png", Length: 100}
+	assert.Equal(t, imgr.QuotaBytes, imgDB.CreateUploadSession(session, quota), "Session should not fit into quota")
+	session.Length = 50
+	assert.Nil(t, imgDB.CreateUploadSession(session, quota), "Session should be created")
+	session = &imgr.UploadSession{ID: "session3", UserID: 1, Filename: "image.png", Length: 1}
+	assert.Equal(t, imgr.QuotaImages, imgDB.CreateUploadSession(session, quota), "Session should not fit into quota")
+	img := &imgr.Image{Filename: "filename2", UserID: 1, Size: 1}
+	assert.Equal(t, imgr.QuotaBytes, imgDB.CreateImage(img, quota), "Open sessions should count toward quota")
+	claimed := &imgr.UploadSession{ID: "session1", UserID: 1}
+	if err = imgDB.ClaimUploadSession(claimed); err != nil {
+		t.Fatal(err)
+	}
+	img = &imgr.Image{Filename: "filename2", UserID: 1, Size: 100}
+	assert.Nil(t, imgDB.CreateImage(img, quota), "Image of claimed session should fit into quota")
+
+	for i := 0; i < imgr.MaxUploadSessions; i++ {
+		session = &imgr.UploadSession{ID: "other" + strconv.Itoa(i), UserID: 2, Filename: "image.png", Length: 1}
+		if err = imgDB.CreateUploadSession(session, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	session = &imgr.UploadSession{ID: "session4", UserID: 2, Filename: "image.png", Length: 1}
+	assert.Equal(t, imgr.ErrTooManyUploads, imgDB.CreateUploadSession(session, nil), "Sessions should be limited")
+}
+
+func TestDBUpdateImageDetails(t *testing.T) {
+	db, err := util.OpenDB(os.Getenv("DATABASE_URL"), os.Getenv("MIGRATIONS_FOLDER"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.CleanDB(t, db)
+	imgDB := &imgr.DB{DB: db}
+	defer cleanTable(t, imgDB)
+
+	img := &imgr.Image{Filename: "filename1", UserID: 1, OriginalName: "image.png"}
+	if err = imgDB.CreateImage(img, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(1), img.Version, "Created image should be of first version")
+
+	stale := *img
+	img.DisplayName, img.Description, img.AltText = "Sunset", "Beach at dusk", "Red sky"
+	assert.Nil(t, imgDB.UpdateImageDetails(img), "Details should be updated")
+	assert.Equal(t, int64(2), img.Version, "Version should be incremented")
+	assert.Equal(t, "image.png", img.OriginalName, "Image should be reloaded")
+
+	stale.DisplayName = "Sunrise"
+	assert.Equal(t, sql.ErrNoRows, imgDB.UpdateImageDetails(&stale), "Modified image should not be updated")
+	other := &imgr.Image{Filename: "filename1", UserID: 2, Version: 2}
+	assert.Equal(t, sql.ErrNoRows, imgDB.UpdateImageDetails(other), "Image of other user should not be updated")
+
+	loaded := &imgr.Image{Filename: "filename1", UserID: 1}
+	assert.Nil(t, imgDB.LoadImage(loaded), "Image should be loaded")
+	assert.Equal(t, "Sunset", loaded.DisplayName, "Incorrect display name")
+	assert.Equal(t, "Beach at dusk", loaded.Description, "Incorrect description")
+	assert.Equal(t, "Red sky", loaded.AltText, "Incorrect alt text")
+	assert.Equal(t, int64(2), loaded.Version, "Incorrect version")
+
+	// Image that can't be deleted keeps its details, version and links
+	album := &imgr.Album{UserID: 1, Name: "album"}
+	if err = imgDB.CreateAlbum(album); err != nil {
+		t.Fatal(err)
+	}
+	if err = imgDB.AddAlbumImage(album.ID, img.ID); err != nil {
+		t.Fatal(err)
+	}
+	err = imgDB.DeleteImage("filename1", 1, func(string) error { return errors.New("blob store error") })
+	assert.Equal(t, errors.New("blob store error"), err, "Remove error should be returned")
+	kept := &imgr.Image{Filename: "filename1", UserID: 1}
+	assert.Nil(t, imgDB.LoadImage(kept), "Image should be kept")
+	assert.Equal(t, *loaded, *kept, "Kept image should not be modified")
+	images := make([]imgr.Image, 0)
+	assert.Nil(t, imgDB.LoadImages(&images, imgr.ImageQuery{UserID: 1, AlbumID: album.ID}), "Album should be loaded")
+	assert.Equal(t, 1, len(images), "Kept image should stay in album")
+}
+
+// withoutGenerated clears fields of image that are generated by database.
+func withoutGenerated(img imgr.Image) imgr.Image {
+	img.ID = 0
+	img.CreatedAt = time.Time{}
+	img.Version = 0
+	return img
+}
+
 func cleanTable(t *testing.T, db *imgr.DB) {
-	if _, err := db.Exec(`TRUNCATE TABLE "images" CASCADE;`); err != nil {
+	if _, err := db.Exec(`TRUNCATE TABLE "images", "blobs", "quotas", "albums", "upload_sessions" CASCADE;`); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -0,0 +1,224 @@
+package imgr
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sp4rd4/go-imager/util"
+)
+
+// DefaultImportTimeout is time image import from URL should finish in unless other time is set.
+const DefaultImportTimeout = 30 * time.Second
+
+// maxImportRedirects is max number of redirects followed while image is imported.
+const maxImportRedirects = 5
+
+// deniedNetworks are loopback, private, link-local and other special purpose address ranges,
+// images aren't imported from them unless they are allow-listed, so imports can't reach internal services.
+// 6to4 and Teredo ranges are denied too, as they embed IPv4 addresses that could be internal.
+var deniedNetworks = mustParseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "64:ff9b::/96", "100::/64", "2001::/32", "2002::/16", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+// errImportDenied is returned when image URL resolves to address of denied network.
+var errImportDenied = &uploadError{
+	http.StatusUnprocessableEntity,
+	`{"error":"Image URL is not allowed"}`,
+	errors.New("image URL resolves to denied address"),
+}
+
+// errImportRedirects is returned when image URL redirects more than max number of times.
+var errImportRedirects = &uploadError{
+	http.StatusBadGateway,
+	`{"error":"Image can't be fetched"}`,
+	errors.New("image URL has too many redirects"),
+}
+
+// parseNetworks parses CIDR notations of networks.
+func parseNetworks(cidrs ...string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// mustParseNetworks is parseNetworks that panics on invalid network.
+func mustParseNetworks(cidrs ...string) []*net.IPNet {
+	networks, err := parseNetworks(cidrs...)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+// WithImportTimeout is functional option for setting time image import of LocalImageServer should finish in,
+// it includes redirects and reading of image.
+func WithImportTimeout(timeout time.Duration) Option {
+	return func(is *LocalImageServer) error {
+		if timeout <= 0 {
+			return errors.New("import timeout should be positive")
+		}
+		is.importTimeout = timeout
+		return nil
+	}
+}
+
+// WithImportAllowList is functional option for setting networks in CIDR notation LocalImageServer imports images from
+// even though they are loopback, private or other special purpose ranges, which are denied by default.
+func WithImportAllowList(cidrs ...string) Option {
+	return func(is *LocalImageServer) error {
+		networks, err := parseNetworks(cidrs...)
+		if err != nil {
+			return err
+		}
+		is.importAllowList = networks
+		return nil
+	}
+}
+
+// importAllowed reports if images can be imported from address.
+func (is *LocalImageServer) importAllowed(ip net.IP) bool {
+	for _, network := range is.importAllowList {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	for _, network := range deniedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newImportClient creates HTTP client images are imported with.
+// Address is checked after it's resolved, right before connection, so host can't be resolved to other address later.
+// Environment proxy isn't used, as it would connect instead of client.
+func (is *LocalImageServer) newImportClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: is.importTimeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !is.importAllowed(ip) {
+				return errImportDenied
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxImportRedirects {
+				return errImportRedirects
+			}
+			return nil
+		},
+		Timeout: is.importTimeout,
+	}
+}
+
+// parseImportURL validates URL image is imported from, only absolute http and https URLs are accepted.
+func parseImportURL(value string) (*url.URL, error) {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, formValueError("url")
+	}
+	return u, nil
+}
+
+// importName returns original name of image imported from URL, it's the last element of URL path.
+func importName(u *url.URL) string {
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return "image"
+	}
+	return name
+}
+
+// fetchImage requests image from URL, failed requests are returned as uploadError.
+func (is *LocalImageServer) fetchImage(r *http.Request, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u.String(), http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := is.importClient.Do(req.WithContext(r.Context()))
+	if err != nil {
+		var ue *uploadError
+		if errors.As(err, &ue) {
+			return nil, ue
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, &uploadError{http.StatusGatewayTimeout, `{"error":"Image fetch timed out"}`, err}
+		}
+		return nil, &uploadError{http.StatusBadGateway, `{"error":"Image can't be fetched"}`, err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = resp.Body.Close()
+		if err == nil {
+			err = errors.New("image URL responded with " + resp.Status)
+		}
+		return nil, &uploadError{http.StatusBadGateway, `{"error":"Image can't be fetched"}`, err}
+	}
+	if resp.ContentLength > is.maxUploadSize {
+		resp.Body.Close()
+		return nil, errImageTooLarge
+	}
+	return resp, nil
+}
+
+// PostImport fetches image from URL and stores it the same way as image uploaded by PostImage.
+// Import should finish in import timeout, up to 5 redirects are followed
+// and images aren't imported from loopback, private or other special purpose addresses unless they are allow-listed.
+// Created image is returned as json with Location header pointing to its URL.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 image will not be imported.
+// * url (required) form value with http or https URL of image
+func (is *LocalImageServer) PostImport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	u, err := parseImportURL(r.FormValue("url"))
+	if err != nil {
+		requestLogger.Info(err)
+		util.JSONResponse(w, http.StatusUnprocessableEntity, `{"error":"Invalid form value url"}`, requestLogger)
+		return
+	}
+	resp, err := is.fetchImage(r, u)
+	if err != nil {
+		writeUpload(w, &upload{err: err}, requestLogger)
+		return
+	}
+	up := is.receiveImage(ctx, importName(u), resp.Body, userID)
+	if err = resp.Body.Close(); err != nil {
+		requestLogger.Error(err)
+	}
+	is.createImages(ctx, []*upload{up}, requestLogger)
+	writeUpload(w, up, requestLogger)
+}
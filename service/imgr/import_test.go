@@ -0,0 +1,40 @@
+package imgr
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportAllowed(t *testing.T) {
+	is := &LocalImageServer{}
+	allowing := &LocalImageServer{importAllowList: mustParseNetworks("10.1.0.0/16")}
+
+	for _, ex := range []struct {
+		name    string
+		is      *LocalImageServer
+		ip      string
+		allowed bool
+	}{
+		{"Public IPv4 address", is, "93.184.216.34", true},
+		{"Public IPv6 address", is, "2606:2800:220:1:248:1893:25c8:1946", true},
+		{"Loopback address", is, "127.0.0.1", false},
+		{"IPv6 loopback address", is, "::1", false},
+		{"IPv4-mapped loopback address", is, "::ffff:127.0.0.1", false},
+		{"Private address", is, "192.168.1.1", false},
+		{"Cloud metadata address", is, "169.254.169.254", false},
+		{"Unspecified address", is, "0.0.0.0", false},
+		{"Unique local IPv6 address", is, "fd00::1", false},
+		{"Link-local IPv6 address", is, "fe80::1", false},
+		{"6to4 address", is, "2002:7f00:1::1", false},
+		{"Teredo address", is, "2001:0:4136:e378:8000:63bf:3fff:fdd2", false},
+		{"Discard-only IPv6 address", is, "100::1", false},
+		{"Allow-listed private address", allowing, "10.1.2.3", true},
+		{"Private address out of allow-list", allowing, "10.2.0.1", false},
+	} {
+		t.Run(ex.name, func(t *testing.T) {
+			assert.Equal(t, ex.allowed, ex.is.importAllowed(net.ParseIP(ex.ip)), "Incorrect address check")
+		})
+	}
+}
@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS image_id_idx;
+ALTER TABLE "images"
+	DROP COLUMN IF EXISTS "id",
+	DROP COLUMN IF EXISTS "original_name",
+	DROP COLUMN IF EXISTS "content_type",
+	DROP COLUMN IF EXISTS "size_bytes",
+	DROP COLUMN IF EXISTS "width",
+	DROP COLUMN IF EXISTS "height",
+	DROP COLUMN IF EXISTS "sha256",
+	DROP COLUMN IF EXISTS "created_at";
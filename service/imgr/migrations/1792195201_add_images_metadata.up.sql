@@ -0,0 +1,10 @@
+ALTER TABLE "images"
+	ADD COLUMN IF NOT EXISTS "id" bigserial,
+	ADD COLUMN IF NOT EXISTS "original_name" varchar NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS "content_type" varchar NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS "size_bytes" bigint NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS "width" integer NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS "height" integer NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS "sha256" varchar NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS "created_at" timestamptz NOT NULL DEFAULT now();
+CREATE UNIQUE INDEX IF NOT EXISTS "image_id_idx" ON "images" ("id");
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS image_user_filename_idx;
@@ -0,0 +1 @@
+CREATE UNIQUE INDEX IF NOT EXISTS "image_user_filename_idx" ON "images" ("user_id", "filename");
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS image_user_size_idx;
+DROP INDEX IF EXISTS image_user_created_at_idx;
@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS "image_user_created_at_idx" ON "images" ("user_id", "created_at", "filename");
+CREATE INDEX IF NOT EXISTS "image_user_size_idx" ON "images" ("user_id", "size_bytes", "filename");
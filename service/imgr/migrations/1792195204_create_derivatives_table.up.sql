@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS "derivatives" (
+	"image_id" bigint NOT NULL REFERENCES "images" ("id") ON DELETE CASCADE,
+	"name" varchar NOT NULL,
+	"status" varchar NOT NULL,
+	"updated_at" timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY ("image_id", "name")
+);
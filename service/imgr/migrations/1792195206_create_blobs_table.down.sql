@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS blobs;
+ALTER TABLE "images" DROP COLUMN IF EXISTS "blob_key";
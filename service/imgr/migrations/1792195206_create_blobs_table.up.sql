@@ -0,0 +1,6 @@
+ALTER TABLE "images" ADD COLUMN IF NOT EXISTS "blob_key" varchar NOT NULL DEFAULT '';
+CREATE TABLE IF NOT EXISTS "blobs" (
+	"key" varchar PRIMARY KEY,
+	"refs" bigint NOT NULL DEFAULT 0,
+	"created_at" timestamptz NOT NULL DEFAULT now()
+);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS "quotas" (
+	"user_id" bigint PRIMARY KEY,
+	"used_bytes" bigint NOT NULL DEFAULT 0,
+	"used_images" bigint NOT NULL DEFAULT 0,
+	"max_bytes" bigint CHECK ("max_bytes" >= 0),
+	"max_images" bigint CHECK ("max_images" >= 0)
+);
+INSERT INTO "quotas" ("user_id", "used_bytes", "used_images")
+	SELECT "user_id", sum("size_bytes"), count(*) FROM "images" GROUP BY "user_id"
+	ON CONFLICT DO NOTHING;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS "albums" (
+	"id" bigserial PRIMARY KEY,
+	"user_id" bigint NOT NULL,
+	"name" varchar NOT NULL,
+	"created_at" timestamptz NOT NULL DEFAULT now()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS "album_user_name_idx" ON "albums" ("user_id", "name");
+CREATE TABLE IF NOT EXISTS "album_images" (
+	"album_id" bigint NOT NULL REFERENCES "albums" ("id") ON DELETE CASCADE,
+	"image_id" bigint NOT NULL REFERENCES "images" ("id") ON DELETE CASCADE,
+	"added_at" timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY ("album_id", "image_id")
+);
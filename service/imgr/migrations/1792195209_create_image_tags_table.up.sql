@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS "image_tags" (
+	"image_id" bigint NOT NULL REFERENCES "images" ("id") ON DELETE CASCADE,
+	"tag" varchar(50) NOT NULL,
+	PRIMARY KEY ("image_id", "tag")
+);
+CREATE INDEX IF NOT EXISTS "image_tags_tag_idx" ON "image_tags" ("tag");
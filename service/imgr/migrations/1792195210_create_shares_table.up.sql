@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS "shares" (
+	"id" bigserial PRIMARY KEY,
+	"image_id" bigint NOT NULL REFERENCES "images" ("id") ON DELETE CASCADE,
+	"user_id" bigint NOT NULL,
+	"expires_at" timestamptz NOT NULL,
+	"max_views" bigint NOT NULL DEFAULT 0,
+	"views" bigint NOT NULL DEFAULT 0,
+	"created_at" timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS "share_image_idx" ON "shares" ("image_id");
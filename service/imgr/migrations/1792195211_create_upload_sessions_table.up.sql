@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS "upload_sessions" (
+	"id" varchar PRIMARY KEY,
+	"user_id" bigint NOT NULL,
+	"filename" varchar NOT NULL,
+	"upload_length" bigint NOT NULL,
+	"upload_offset" bigint NOT NULL DEFAULT 0,
+	"chunks" varchar[] NOT NULL DEFAULT '{}',
+	"created_at" timestamptz NOT NULL DEFAULT now(),
+	"updated_at" timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS "upload_session_updated_at_idx" ON "upload_sessions" ("updated_at");
@@ -0,0 +1,5 @@
+ALTER TABLE "images"
+	DROP COLUMN IF EXISTS "display_name",
+	DROP COLUMN IF EXISTS "description",
+	DROP COLUMN IF EXISTS "alt_text",
+	DROP COLUMN IF EXISTS "version";
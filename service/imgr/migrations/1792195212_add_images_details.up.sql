@@ -0,0 +1,5 @@
+ALTER TABLE "images"
+	ADD COLUMN IF NOT EXISTS "display_name" varchar NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS "description" text NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS "alt_text" text NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS "version" bigint NOT NULL DEFAULT 1;
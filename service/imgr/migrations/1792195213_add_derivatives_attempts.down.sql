@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS "derivative_status_idx";
+ALTER TABLE "derivatives" DROP COLUMN IF EXISTS "attempts";
@@ -0,0 +1,2 @@
+ALTER TABLE "derivatives" ADD COLUMN IF NOT EXISTS "attempts" integer NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS "derivative_status_idx" ON "derivatives" ("status", "updated_at");
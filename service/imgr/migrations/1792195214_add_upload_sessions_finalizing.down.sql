@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS "upload_session_user_idx";
+ALTER TABLE "upload_sessions" DROP COLUMN IF EXISTS "finalizing";
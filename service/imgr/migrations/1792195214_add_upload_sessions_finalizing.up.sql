@@ -0,0 +1,2 @@
+ALTER TABLE "upload_sessions" ADD COLUMN IF NOT EXISTS "finalizing" boolean NOT NULL DEFAULT false;
+CREATE INDEX IF NOT EXISTS "upload_session_user_idx" ON "upload_sessions" ("user_id");
@@ -0,0 +1,117 @@
+package imgr
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// MaxListLimit is max number of images listed at once when limit of list is set.
+const MaxListLimit = 1000
+
+// queryParamError is returned when query parameter of images list has invalid value.
+type queryParamError string
+
+func (qpe queryParamError) Error() string {
+	return "invalid query parameter " + string(qpe)
+}
+
+// imageCursor is position in images list, it is passed to clients as opaque string.
+// It keeps sort of the list and sort values of last listed image.
+type imageCursor struct {
+	Sort      string    `json:"o"`
+	Filename  string    `json:"f"`
+	CreatedAt time.Time `json:"c"`
+	Size      int64     `json:"s"`
+}
+
+// encodeCursor returns cursor pointing after given image in list with given sort.
+func encodeCursor(sort string, image Image) string {
+	b, _ := json.Marshal(imageCursor{sort, image.Filename, image.CreatedAt, image.Size})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor parses cursor received from client.
+func decodeCursor(cursor string) (*imageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	c := &imageCursor{}
+	if err = json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	if c.Filename == "" {
+		return nil, errors.New("cursor position is missing")
+	}
+	return c, nil
+}
+
+// parseImageQuery validates images list query parameters,
+// queryParamError is returned for parameters with unknown values.
+func parseImageQuery(params url.Values, userID uint64) (ImageQuery, error) {
+	query := ImageQuery{UserID: userID, Sort: "filename"}
+	var err error
+	if v := params.Get("limit"); v != "" {
+		if query.Limit, err = strconv.ParseUint(v, 10, 64); err != nil || query.Limit > MaxListLimit {
+			return query, queryParamError("limit")
+		}
+	}
+	// Offset is passed to database as signed 64 bit integer
+	if v := params.Get("offset"); v != "" {
+		if query.Offset, err = strconv.ParseUint(v, 10, 64); err != nil || query.Offset > math.MaxInt64 {
+			return query, queryParamError("offset")
+		}
+	}
+	if v := params.Get("sort"); v != "" {
+		if _, ok := imageSortColumns[v]; !ok {
+			return query, queryParamError("sort")
+		}
+		query.Sort = v
+	}
+	if v := params.Get("content_type"); v != "" {
+		known := false
+		for _, contentType := range contentTypes {
+			known = known || contentType == v
+		}
+		if !known {
+			return query, queryParamError("content_type")
+		}
+		query.ContentType = v
+	}
+	if v := params.Get("created_after"); v != "" {
+		if query.CreatedAfter, err = time.Parse(time.RFC3339, v); err != nil {
+			return query, queryParamError("created_after")
+		}
+	}
+	if v := params.Get("created_before"); v != "" {
+		if query.CreatedBefore, err = time.Parse(time.RFC3339, v); err != nil {
+			return query, queryParamError("created_before")
+		}
+	}
+	query.NameContains = params.Get("name_contains")
+	if tags := params["tag"]; len(tags) > 0 {
+		if query.Tags, err = parseTags(tags); err != nil {
+			return query, queryParamError("tag")
+		}
+	}
+	switch params.Get("tag_match") {
+	case "", "all":
+	case "any":
+		query.AnyTag = true
+	default:
+		return query, queryParamError("tag_match")
+	}
+	if v := params.Get("cursor"); v != "" {
+		cursor, err := decodeCursor(v)
+		if err != nil || cursor.Sort != query.Sort {
+			return query, queryParamError("cursor")
+		}
+		query.After = &Image{Filename: cursor.Filename, CreatedAt: cursor.CreatedAt, Size: cursor.Size}
+	}
+	return query, nil
+}
@@ -0,0 +1,100 @@
+package imgr
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sp4rd4/go-imager/util"
+)
+
+// Quota limits total size and number of images stored by user, zero limit means no limit.
+type Quota struct {
+	MaxBytes  int64
+	MaxImages int64
+}
+
+// Usage describes size and number of images stored by user along with quota of user.
+type Usage struct {
+	UserID     uint64 `json:"-" db:"user_id"`
+	UsedBytes  int64  `json:"used_bytes" db:"used_bytes"`
+	UsedImages int64  `json:"used_images" db:"used_images"`
+	MaxBytes   int64  `json:"max_bytes" db:"max_bytes"`
+	MaxImages  int64  `json:"max_images" db:"max_images"`
+}
+
+// ErrQuotaExceeded is returned when image doesn't fit into quota of user, its value is exceeded limit.
+type ErrQuotaExceeded string
+
+// Limits of Quota reported by ErrQuotaExceeded.
+const (
+	QuotaBytes  ErrQuotaExceeded = "bytes"
+	QuotaImages ErrQuotaExceeded = "images"
+)
+
+// Error is errors interface implementation for ErrQuotaExceeded
+func (qe ErrQuotaExceeded) Error() string {
+	return "quota of " + string(qe) + " is exceeded"
+}
+
+// check returns ErrQuotaExceeded if usage exceeds its quota.
+func (u Usage) check() error {
+	if u.MaxBytes > 0 && u.UsedBytes > u.MaxBytes {
+		return QuotaBytes
+	}
+	if u.MaxImages > 0 && u.UsedImages > u.MaxImages {
+		return QuotaImages
+	}
+	return nil
+}
+
+// WithQuota is functional option for setting default quota of LocalImageServer users,
+// zero limit means no limit and there are no limits by default. Quota can be overridden for user in storage.
+func WithQuota(quota Quota) Option {
+	return func(is *LocalImageServer) error {
+		if quota.MaxBytes < 0 || quota.MaxImages < 0 {
+			return errors.New("quota limits should not be negative")
+		}
+		is.quota = quota
+		return nil
+	}
+}
+
+// quotaFailure logs error of image that doesn't fit into quota and returns status and json body it's reported with,
+// exceeded storage size is reported as too large request and exceeded number of images as too many requests.
+func quotaFailure(err ErrQuotaExceeded, requestLogger *log.Entry) (int, string) {
+	requestLogger.Info(err)
+	if err == QuotaImages {
+		return http.StatusTooManyRequests, `{"error":"Image count quota exceeded"}`
+	}
+	return http.StatusRequestEntityTooLarge, `{"error":"Storage quota exceeded"}`
+}
+
+// GetUsage returns json with size and number of images stored by the current user and quota of user,
+// zero limit of quota means no limit.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 usage will not be returned.
+func (is *LocalImageServer) GetUsage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	usage := &Usage{UserID: userID}
+	if err = is.storage.LoadUsage(usage, is.quota); err != nil {
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(usage); err != nil {
+		requestLogger.Error(err)
+	}
+}
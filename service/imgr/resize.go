@@ -0,0 +1,128 @@
+package imgr
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Fit modes of resized images.
+const (
+	// FitContain scales image to fit into requested size, keeping aspect ratio.
+	FitContain = "contain"
+	// FitCover scales image to cover requested size, keeping aspect ratio and cropping what is outside.
+	FitCover = "cover"
+)
+
+// resizeDimensions returns size of resized image and part of source image that should be resized.
+// Zero width or height is calculated from the other one keeping aspect ratio.
+// Images are only scaled down, resized image is never bigger than resized part of source.
+func resizeDimensions(src image.Rectangle, width, height int, fit string) (int, int, image.Rectangle) {
+	sw, sh := src.Dx(), src.Dy()
+	part := src
+	switch {
+	case width == 0:
+		width = maxInt(1, int(math.Round(float64(sw*height)/float64(sh))))
+	case height == 0:
+		height = maxInt(1, int(math.Round(float64(sh*width)/float64(sw))))
+	case fit == FitCover:
+		// Centered part of source with requested aspect ratio is taken
+		if sw*height > sh*width {
+			cw := maxInt(1, sh*width/height)
+			part.Min.X += (sw - cw) / 2
+			part.Max.X = part.Min.X + cw
+		} else {
+			ch := maxInt(1, sw*height/width)
+			part.Min.Y += (sh - ch) / 2
+			part.Max.Y = part.Min.Y + ch
+		}
+	default:
+		scale := math.Min(float64(width)/float64(sw), float64(height)/float64(sh))
+		width, height = maxInt(1, int(math.Round(float64(sw)*scale))), maxInt(1, int(math.Round(float64(sh)*scale)))
+	}
+	// Resized image has aspect ratio of resized part, so it's limited by both its dimensions
+	if width > part.Dx() || height > part.Dy() {
+		return part.Dx(), part.Dy(), part
+	}
+	return width, height, part
+}
+
+// resize scales part of source image to given size,
+// every destination pixel is average of source pixels it covers, weighted by covered area.
+// Destination rows are accumulated one by one, so only two rows of scaled width are kept besides destination.
+func resize(src image.Image, part image.Rectangle, width, height int) *image.RGBA {
+	xWeights := resizeWeights(part.Min.X, part.Dx(), width)
+	yWeights := resizeWeights(part.Min.Y, part.Dy(), height)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	row := make([]float32, width*4)
+	sum := make([]float32, width*4)
+	for y, weights := range yWeights {
+		for i := range sum {
+			sum[i] = 0
+		}
+		// Source rows covered by destination row are scaled and added to it
+		for _, yw := range weights {
+			scaleRow(src, yw.index, xWeights, row)
+			for i, v := range row {
+				sum[i] += v * yw.weight
+			}
+		}
+		for x := 0; x < width; x++ {
+			i := x * 4
+			dst.SetRGBA(x, y, color.RGBA{channel(sum[i]), channel(sum[i+1]), channel(sum[i+2]), channel(sum[i+3])})
+		}
+	}
+	return dst
+}
+
+// scaleRow scales source row y to row of 16 bit color channels, 4 channels per destination pixel.
+func scaleRow(src image.Image, y int, xWeights [][]resizeWeight, row []float32) {
+	for x, weights := range xWeights {
+		var r, g, b, a float32
+		for _, w := range weights {
+			cr, cg, cb, ca := src.At(w.index, y).RGBA()
+			r += float32(cr) * w.weight
+			g += float32(cg) * w.weight
+			b += float32(cb) * w.weight
+			a += float32(ca) * w.weight
+		}
+		i := x * 4
+		row[i], row[i+1], row[i+2], row[i+3] = r, g, b, a
+	}
+}
+
+// resizeWeight is share of source pixel in destination pixel.
+type resizeWeight struct {
+	index  int
+	weight float32
+}
+
+// resizeWeights returns source pixels covered by every destination pixel
+// when size pixels starting from offset are scaled to scaled pixels.
+func resizeWeights(offset, size, scaled int) [][]resizeWeight {
+	scale := float64(size) / float64(scaled)
+	weights := make([][]resizeWeight, scaled)
+	for i := range weights {
+		start, end := float64(i)*scale, float64(i+1)*scale
+		for j := int(start); j < size && float64(j) < end; j++ {
+			covered := math.Min(end, float64(j+1)) - math.Max(start, float64(j))
+			if covered > 0 {
+				weights[i] = append(weights[i], resizeWeight{offset + j, float32(covered / scale)})
+			}
+		}
+	}
+	return weights
+}
+
+// channel converts 16 bit color channel value to 8 bit one.
+func channel(v float32) uint8 {
+	return uint8(math.Min(math.Max(math.Round(float64(v)/257), 0), 255))
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
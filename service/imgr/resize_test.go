@@ -0,0 +1,63 @@
+package imgr
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResizeDimensions(t *testing.T) {
+	src := image.Rect(0, 0, 400, 200)
+	examples := []struct {
+		name       string
+		width      int
+		height     int
+		fit        string
+		wantWidth  int
+		wantHeight int
+		wantPart   image.Rectangle
+	}{
+		{"Width only", 100, 0, FitContain, 100, 50, src},
+		{"Height only", 0, 100, FitCover, 200, 100, src},
+		{"Contain", 100, 100, FitContain, 100, 50, src},
+		{"Cover wide", 100, 100, FitCover, 100, 100, image.Rect(100, 0, 300, 200)},
+		{"Cover tall", 400, 100, FitCover, 400, 100, image.Rect(0, 50, 400, 150)},
+		{"Upscale", 800, 800, FitContain, 400, 200, src},
+		{"Upscale cover", 800, 100, FitCover, 400, 50, image.Rect(0, 75, 400, 125)},
+		{"Upscale width only", 1000, 0, FitCover, 400, 200, src},
+	}
+	for _, ex := range examples {
+		t.Run(ex.name, func(t *testing.T) {
+			width, height, part := resizeDimensions(src, ex.width, ex.height, ex.fit)
+			assert.Equal(t, ex.wantWidth, width, "Incorrect width")
+			assert.Equal(t, ex.wantHeight, height, "Incorrect height")
+			assert.Equal(t, ex.wantPart, part, "Incorrect resized part")
+		})
+	}
+}
+
+func TestResize(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		src.Set(x, 0, color.White)
+		src.Set(x, 1, color.RGBA{0, 0, 255, 255})
+	}
+
+	dst := resize(src, src.Bounds(), 2, 1)
+	assert.Equal(t, image.Rect(0, 0, 2, 1), dst.Bounds(), "Incorrect size")
+	assert.Equal(t, color.RGBA{128, 128, 255, 255}, dst.RGBAAt(0, 0), "Pixels should be averaged")
+
+	dst = resize(src, image.Rect(0, 1, 4, 2), 8, 2)
+	assert.Equal(t, color.RGBA{0, 0, 255, 255}, dst.RGBAAt(7, 1), "Only resized part should be used")
+
+	src = image.NewRGBA(image.Rect(0, 0, 3, 3))
+	for x := 0; x < 3; x++ {
+		for y := 0; y < 3; y++ {
+			src.Set(x, y, color.RGBA{10, 20, 30, 255})
+		}
+	}
+	dst = resize(src, src.Bounds(), 2, 2)
+	assert.Equal(t, color.RGBA{10, 20, 30, 255}, dst.RGBAAt(1, 1), "Partially covered pixels should be weighted")
+}
@@ -0,0 +1,505 @@
+package imgr
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"github.com/sp4rd4/go-imager/util"
+	"goji.io/pat"
+)
+
+// DefaultUploadSessionTTL is time upload sessions are kept after their last chunk unless other time is set.
+const DefaultUploadSessionTTL = 24 * time.Hour
+
+// maxCollectInterval is max interval between removals of abandoned upload sessions.
+const maxCollectInterval = time.Hour
+
+// MaxUploadSessions is max number of upload sessions user can have at once.
+const MaxUploadSessions = 10
+
+// chunkContentType is content type of upload session chunks.
+const chunkContentType = "application/offset+octet-stream"
+
+// ErrTooManyUploads is returned when upload session is created for user that has max number of sessions already.
+var ErrTooManyUploads = errors.New("too many upload sessions")
+
+// UploadSession describes image uploaded in chunks by several requests, image is created when session is finalized.
+// Chunks are blob keys of received chunks in their order, session is finalizing while image is created from them.
+type UploadSession struct {
+	ID         string         `json:"id" db:"id"`
+	URL        string         `json:"url" db:"-"`
+	Filename   string         `json:"filename" db:"filename"`
+	Length     int64          `json:"length" db:"upload_length"`
+	Offset     int64          `json:"offset" db:"upload_offset"`
+	CreatedAt  time.Time      `json:"created_at" db:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at" db:"updated_at"`
+	Chunks     pq.StringArray `json:"-" db:"chunks"`
+	Finalizing bool           `json:"-" db:"finalizing"`
+	UserID     uint64         `json:"-" db:"user_id"`
+}
+
+// headerError is returned when request header has invalid value.
+type headerError string
+
+func (he headerError) Error() string {
+	return "invalid header " + string(he)
+}
+
+// sessionPrefix returns prefix of blob keys of upload session chunks.
+func sessionPrefix(id string) string {
+	return "sessions/" + id + "/"
+}
+
+// uploadSessionURL returns URL of upload session.
+func uploadSessionURL(id string) string {
+	return "/uploads/" + id
+}
+
+// WithUploadSessionTTL is functional option for setting time upload sessions of LocalImageServer are kept
+// after their last chunk, abandoned sessions are removed along with their chunks.
+func WithUploadSessionTTL(ttl time.Duration) Option {
+	return func(is *LocalImageServer) error {
+		if ttl <= 0 {
+			return errors.New("upload session TTL should be positive")
+		}
+		is.uploadSessionTTL = ttl
+		return nil
+	}
+}
+
+// startUploadCollector starts removal of abandoned upload sessions in background until server is closed.
+func (is *LocalImageServer) startUploadCollector() {
+	interval := is.uploadSessionTTL
+	if interval > maxCollectInterval {
+		interval = maxCollectInterval
+	}
+	is.runPeriodically(interval, func() {
+		if err := is.collectUploadSessions(context.Background()); err != nil {
+			is.log.Error(err)
+		}
+	})
+}
+
+// collectUploadSessions removes upload sessions that weren't updated for upload session TTL
+// and aren't being finalized.
+func (is *LocalImageServer) collectUploadSessions(ctx context.Context) error {
+	before := time.Now().Add(-is.uploadSessionTTL)
+	sessions := make([]UploadSession, 0)
+	if err := is.storage.LoadStaleUploadSessions(&sessions, before); err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		// Session is removed only if it's still stale, it could be resumed or claimed since it was loaded
+		err := is.storage.DeleteStaleUploadSession(session.ID, before)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err == nil {
+			err = is.removeUploadChunks(ctx, session.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeUploadSession removes upload session and its chunks.
+// Session record is removed first, so chunks that are being received can't be recorded after their removal.
+func (is *LocalImageServer) removeUploadSession(ctx context.Context, session *UploadSession) error {
+	if err := is.storage.DeleteUploadSession(session.ID, session.UserID); err != nil {
+		return err
+	}
+	return is.removeUploadChunks(ctx, session.ID)
+}
+
+// removeUploadChunks removes stored chunks of removed upload session.
+func (is *LocalImageServer) removeUploadChunks(ctx context.Context, id string) error {
+	chunks, err := is.blobs.List(ctx, sessionPrefix(id))
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if err = is.blobs.Delete(ctx, chunk.Key); err != nil && err != ErrBlobNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadUploadSession loads upload session of the current user identified by upload URL path parameter.
+func (is *LocalImageServer) loadUploadSession(r *http.Request, userID uint64) (*UploadSession, error) {
+	session := &UploadSession{ID: pat.Param(r, "upload"), UserID: userID}
+	if err := is.storage.LoadUploadSession(session); err != nil {
+		return nil, err
+	}
+	session.URL = uploadSessionURL(session.ID)
+	return session, nil
+}
+
+// writeSessionHeaders sets headers describing progress of upload session.
+func (is *LocalImageServer) writeSessionHeaders(w http.ResponseWriter, session *UploadSession) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+	w.Header().Set("Upload-Expires", session.UpdatedAt.Add(is.uploadSessionTTL).UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// parseMetadata returns filename from Upload-Metadata header,
+// header is comma separated list of keys and base64 encoded values.
+func parseMetadata(header string) (string, error) {
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) != 2 || fields[0] != "filename" {
+			continue
+		}
+		filename, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(filename) == 0 {
+			break
+		}
+		return string(filename), nil
+	}
+	return "", headerError("Upload-Metadata")
+}
+
+// PostUpload creates upload session of image that is sent in chunks by following requests,
+// session is described by json and its URL is returned in Location header.
+// Length of upload counts toward quota of user until upload is removed, user can have up to 10 uploads at once.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 session will not be created.
+// * Upload-Length (required) Header with size of image in bytes, it should not exceed max upload size
+// * Upload-Metadata (required) Header with base64 encoded original name of image as filename key
+func (is *LocalImageServer) PostUpload(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	session := &UploadSession{UserID: userID}
+	session.Length, err = strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || session.Length <= 0 {
+		requestLogger.Info(headerError("Upload-Length"))
+		util.JSONResponse(w, http.StatusBadRequest, `{"error":"Invalid header Upload-Length"}`, requestLogger)
+		return
+	}
+	if session.Length > is.maxUploadSize {
+		requestLogger.Info(errImageTooLarge)
+		util.JSONResponse(w, http.StatusRequestEntityTooLarge, `{"error":"Image is too large"}`, requestLogger)
+		return
+	}
+	if session.Filename, err = parseMetadata(r.Header.Get("Upload-Metadata")); err != nil {
+		requestLogger.Info(err)
+		util.JSONResponse(w, http.StatusBadRequest, `{"error":"Invalid header Upload-Metadata"}`, requestLogger)
+		return
+	}
+
+	if session.ID, err = newULID(); err == nil {
+		err = is.storage.CreateUploadSession(session, &is.quota)
+	}
+	if errQ, ok := err.(ErrQuotaExceeded); ok {
+		status, body := quotaFailure(errQ, requestLogger)
+		util.JSONResponse(w, status, body, requestLogger)
+		return
+	}
+	if err == ErrTooManyUploads {
+		requestLogger.Info(err)
+		util.JSONResponse(w, http.StatusTooManyRequests, `{"error":"Too many uploads"}`, requestLogger)
+		return
+	}
+	if err != nil {
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+	session.URL = uploadSessionURL(session.ID)
+
+	is.writeSessionHeaders(w, session)
+	w.Header().Set("Location", session.URL)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err = json.NewEncoder(w).Encode(session); err != nil {
+		requestLogger.Error(err)
+	}
+}
+
+// HeadUpload reports progress of upload session of the current user in Upload-Offset and Upload-Length headers.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 progress will not be reported.
+// * upload (required) URL path parameter
+func (is *LocalImageServer) HeadUpload(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	session, err := is.loadUploadSession(r, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		requestLogger.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	is.writeSessionHeaders(w, session)
+	w.WriteHeader(http.StatusOK)
+}
+
+// PatchUpload stores request body as chunk of upload session of the current user,
+// new offset of session is returned in Upload-Offset header.
+// Chunks should be sent in order, so offset of chunk should match current offset of session.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 chunk will not be stored.
+// * upload (required) URL path parameter
+// * Upload-Offset (required) Header with offset of chunk in image
+// * Content-Type (required) Header, it should be application/offset+octet-stream
+func (is *LocalImageServer) PatchUpload(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	session, err := is.loadUploadSession(r, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			util.JSONResponse(w, http.StatusNotFound, `{"error":"Upload not found"}`, requestLogger)
+			return
+		}
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+	if r.Header.Get("Content-Type") != chunkContentType {
+		requestLogger.Info(headerError("Content-Type"))
+		util.JSONResponse(w, http.StatusUnsupportedMediaType, `{"error":"Unsupported chunk content type"}`, requestLogger)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		requestLogger.Info(headerError("Upload-Offset"))
+		util.JSONResponse(w, http.StatusBadRequest, `{"error":"Invalid header Upload-Offset"}`, requestLogger)
+		return
+	}
+	if offset != session.Offset {
+		requestLogger.Infof("chunk offset %d doesn't match upload offset %d", offset, session.Offset)
+		is.writeSessionHeaders(w, session)
+		util.JSONResponse(w, http.StatusConflict, `{"error":"Upload offset mismatch"}`, requestLogger)
+		return
+	}
+
+	status, body, err := is.storeChunk(ctx, r.Body, session)
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			requestLogger.Error(err)
+		} else {
+			requestLogger.Info(err)
+		}
+		util.JSONResponse(w, status, body, requestLogger)
+		return
+	}
+	is.writeSessionHeaders(w, session)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// storeChunk stores chunk of upload session in blob store and records it in session,
+// status and json body chunk is rejected with are returned along with error.
+// Every chunk is stored under its own key, so chunk rejected by concurrent request doesn't overwrite recorded one.
+func (is *LocalImageServer) storeChunk(
+	ctx context.Context, content io.Reader, session *UploadSession,
+) (int, string, error) {
+	id, err := newULID()
+	if err != nil {
+		return http.StatusInternalServerError, `{"error":"Internal server error"}`, err
+	}
+	key := fmt.Sprintf("%s%020d-%s", sessionPrefix(session.ID), session.Offset, id)
+	limited := &sizeLimitReader{content, session.Length - session.Offset}
+	err = is.blobs.Put(ctx, key, limited)
+	size := session.Length - session.Offset - limited.remaining
+	if err == nil && size > 0 {
+		err = is.storage.AppendUploadChunk(session, key, size)
+	}
+	if err == nil && size > 0 {
+		return 0, "", nil
+	}
+
+	if errD := is.blobs.Delete(ctx, key); errD != nil && errD != ErrBlobNotFound {
+		if err == nil {
+			err = errD
+		} else {
+			err = fmt.Errorf("First: %s, Second: %s", err, errD)
+		}
+	}
+	switch err {
+	case nil:
+		return http.StatusBadRequest, `{"error":"Chunk is empty"}`, errors.New("chunk is empty")
+	case errImageTooLarge:
+		return http.StatusRequestEntityTooLarge, `{"error":"Chunk exceeds upload length"}`, err
+	case sql.ErrNoRows:
+		// Other chunk was recorded at the same offset or session was removed meanwhile
+		return http.StatusConflict, `{"error":"Upload offset mismatch"}`, err
+	}
+	return http.StatusInternalServerError, `{"error":"Internal server error"}`, err
+}
+
+// FinalizeUpload creates image from chunks of complete upload session of the current user,
+// image is validated the same way as uploaded by PostImage and session is removed.
+// Upload that is being finalized by other request is reported as conflict.
+// Created image is returned as json with Location header pointing to its URL.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 image will not be created.
+// * upload (required) URL path parameter
+func (is *LocalImageServer) FinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	session, err := is.loadUploadSession(r, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			util.JSONResponse(w, http.StatusNotFound, `{"error":"Upload not found"}`, requestLogger)
+			return
+		}
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+	if session.Offset < session.Length {
+		requestLogger.Infof("upload %s has %d of %d bytes", session.ID, session.Offset, session.Length)
+		is.writeSessionHeaders(w, session)
+		util.JSONResponse(w, http.StatusConflict, `{"error":"Upload is incomplete"}`, requestLogger)
+		return
+	}
+	// Session is claimed, so concurrent finalizations don't create image twice,
+	// its update time is refreshed, so it isn't collected while image is created
+	if err = is.storage.ClaimUploadSession(session); err != nil {
+		if err == sql.ErrNoRows {
+			requestLogger.Infof("upload %s is being finalized already", session.ID)
+			util.JSONResponse(w, http.StatusConflict, `{"error":"Upload is being finalized"}`, requestLogger)
+			return
+		}
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+
+	content := &chunkReader{ctx: ctx, blobs: is.blobs, keys: session.Chunks}
+	up := is.receiveImage(ctx, session.Filename, content, userID)
+	if err = content.Close(); err != nil {
+		requestLogger.Error(err)
+	}
+	is.createImages(ctx, []*upload{up}, requestLogger)
+
+	// Session is released after internal errors, so finalization can be retried
+	if _, ok := up.err.(*uploadError); up.err == nil || ok {
+		err = is.removeUploadSession(ctx, session)
+	} else {
+		err = is.storage.ReleaseUploadSession(session.ID, session.UserID)
+	}
+	if err != nil {
+		requestLogger.Error(err)
+	}
+	writeUpload(w, up, requestLogger)
+}
+
+// DeleteUpload removes upload session of the current user along with its chunks.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 session will not be removed.
+// * upload (required) URL path parameter
+func (is *LocalImageServer) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	session := &UploadSession{ID: pat.Param(r, "upload"), UserID: userID}
+	if err = is.removeUploadSession(ctx, session); err != nil {
+		if err == sql.ErrNoRows {
+			util.JSONResponse(w, http.StatusNotFound, `{"error":"Upload not found"}`, requestLogger)
+			return
+		}
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// chunkReader reads chunks stored in blob store one after another, chunk is opened when it's reached.
+type chunkReader struct {
+	ctx     context.Context
+	blobs   BlobStore
+	keys    []string
+	current io.ReadCloser
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if cr.current == nil {
+			if len(cr.keys) == 0 {
+				return 0, io.EOF
+			}
+			chunk, err := cr.blobs.Get(cr.ctx, cr.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			cr.current, cr.keys = chunk, cr.keys[1:]
+		}
+		n, err := cr.current.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		err = cr.current.Close()
+		cr.current = nil
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// Close closes chunk that is being read.
+func (cr *chunkReader) Close() error {
+	if cr.current == nil {
+		return nil
+	}
+	err := cr.current.Close()
+	cr.current = nil
+	return err
+}
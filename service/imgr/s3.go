@@ -0,0 +1,493 @@
+package imgr
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3PartSize is the smallest multipart upload part size allowed by S3,
+// bigger blobs are uploaded in parts of this size, so only one part is kept in memory.
+const s3PartSize = 5 << 20
+
+// s3ResponseTimeout is time storage has to start responding to request of default client.
+const s3ResponseTimeout = 30 * time.Second
+
+// defaultS3Client is used when S3Config has no client, requests fail when storage can't be reached
+// or doesn't respond in time. Reading of response body isn't limited, so objects can be streamed to slow clients.
+var defaultS3Client = &http.Client{Transport: &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: s3ResponseTimeout,
+	ExpectContinueTimeout: time.Second,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+}}
+
+// emptyPayloadHash is SHA256 of empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Config describes connection to S3 compatible object storage.
+type S3Config struct {
+	// Endpoint is storage base URL, e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000,
+	// AWS endpoint of Region is used when empty.
+	Endpoint string
+	// Region is used for request signing, us-east-1 by default.
+	Region string
+	Bucket string
+	// Prefix is prepended to every blob key, e.g. "images/".
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// PathStyle enables bucket addressing via URL path instead of subdomain.
+	PathStyle bool
+	// Client is used for storage requests, client with connection and response timeouts by default.
+	Client *http.Client
+}
+
+// S3BlobStore is BlobStore that keeps blobs as objects in S3 compatible storage.
+// Requests are signed with AWS Signature Version 4, anonymous access is used without AccessKeyID.
+type S3BlobStore struct {
+	S3Config
+	endpoint *url.URL
+	now      func() time.Time
+}
+
+// s3Error is error response returned by storage.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return "s3: " + e.Code + ": " + e.Message
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+// NewS3BlobStore creates S3BlobStore for existing bucket.
+func NewS3BlobStore(cfg S3Config) (*S3BlobStore, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("bucket is missing")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, errors.New("endpoint should be absolute URL")
+	}
+	if cfg.Client == nil {
+		cfg.Client = defaultS3Client
+	}
+	return &S3BlobStore{cfg, endpoint, time.Now}, nil
+}
+
+// Put uploads blob as single object, or via multipart upload when it is bigger than s3PartSize.
+func (s *S3BlobStore) Put(ctx context.Context, key string, r io.Reader) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	// Buffer grows with content, so small blobs don't take whole part size
+	part := &bytes.Buffer{}
+	n, err := part.ReadFrom(io.LimitReader(r, s3PartSize))
+	if err != nil {
+		return err
+	}
+	if n < s3PartSize {
+		resp, err := s.do(ctx, http.MethodPut, s.Prefix+key, nil, nil, part.Bytes())
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	return s.putMultipart(ctx, s.Prefix+key, part, r)
+}
+
+func (s *S3BlobStore) putMultipart(ctx context.Context, object string, part *bytes.Buffer, r io.Reader) (err error) {
+	resp, err := s.do(ctx, http.MethodPost, object, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	var upload struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&upload)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Upload is aborted even if request context is done, so storage won't keep uploaded parts
+		if err != nil {
+			query := url.Values{"uploadId": {upload.UploadID}}
+			resp, errA := s.do(context.Background(), http.MethodDelete, object, query, nil, nil)
+			if errA == nil {
+				errA = resp.Body.Close()
+			}
+			if errA != nil {
+				err = fmt.Errorf("First: %s, Second: %s", err, errA)
+			}
+		}
+	}()
+
+	complete := s3CompleteUpload{}
+	for number := 1; part.Len() > 0; number++ {
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {upload.UploadID}}
+		resp, err := s.do(ctx, http.MethodPut, object, query, nil, part.Bytes())
+		if err != nil {
+			return err
+		}
+		complete.Parts = append(complete.Parts, s3CompletedPart{number, resp.Header.Get("ETag")})
+		if err = resp.Body.Close(); err != nil {
+			return err
+		}
+
+		part.Reset()
+		if _, err = part.ReadFrom(io.LimitReader(r, s3PartSize)); err != nil {
+			return err
+		}
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err = s.do(ctx, http.MethodPost, object, url.Values{"uploadId": {upload.UploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Completion may fail after 200 OK response was sent, in that case error is in response body
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return parseS3Error(result)
+}
+
+// Get returns reader that loads object content lazily, seeking is done via range requests.
+func (s *S3BlobStore) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{store: s, ctx: ctx, object: s.Prefix + key, size: info.Size}, nil
+}
+
+// Delete removes object.
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	// S3 reports success for missing objects, so existence is checked beforehand
+	if _, err := s.Stat(ctx, key); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodDelete, s.Prefix+key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Stat returns info about object.
+func (s *S3BlobStore) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	if err := checkKey(key); err != nil {
+		return BlobInfo{}, err
+	}
+	resp, err := s.do(ctx, http.MethodHead, s.Prefix+key, nil, nil, nil)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	if err = resp.Body.Close(); err != nil {
+		return BlobInfo{}, err
+	}
+	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{key, resp.ContentLength, modTime}, nil
+}
+
+// List returns info about objects which keys start with prefix, ordered by key.
+func (s *S3BlobStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	blobs := make([]BlobInfo, 0)
+	query := url.Values{"list-type": {"2"}, "prefix": {s.Prefix + prefix}}
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		result := s3ListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			blobs = append(blobs, BlobInfo{strings.TrimPrefix(object.Key, s.Prefix), object.Size, object.LastModified})
+		}
+		if !result.IsTruncated {
+			return blobs, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// do sends signed request for object, empty object stands for bucket itself.
+// Responses with non successful status are turned into errors, missing objects are reported as ErrBlobNotFound.
+func (s *S3BlobStore) do(
+	ctx context.Context,
+	method, object string,
+	query url.Values,
+	header http.Header,
+	payload []byte,
+) (*http.Response, error) {
+	u := *s.endpoint
+	objectPath := strings.TrimSuffix(u.Path, "/")
+	if s.PathStyle {
+		objectPath += "/" + s.Bucket
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+	}
+	if object != "" || objectPath == "" {
+		objectPath += "/" + object
+	}
+	u.Path = objectPath
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = canonicalS3Query(query)
+
+	var body io.Reader
+	payloadHash := emptyPayloadHash
+	if payload != nil {
+		body = bytes.NewReader(payload)
+		sum := sha256.Sum256(payload)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, payloadHash)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	err = parseS3Error(result)
+	errS3, ok := err.(*s3Error)
+	if (ok && errS3.Code == "NoSuchKey") || (err == nil && resp.StatusCode == http.StatusNotFound) {
+		return nil, ErrBlobNotFound
+	}
+	if err == nil {
+		err = fmt.Errorf("s3: unexpected response status %s", resp.Status)
+	}
+	return nil, err
+}
+
+// sign adds AWS Signature Version 4 authorization to request,
+// host, range, content and x-amz-* headers are signed.
+func (s *S3BlobStore) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.AccessKeyID == "" {
+		return
+	}
+
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for name, vals := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || name == "content-type" || name == "content-md5" || strings.HasPrefix(name, "x-amz-") {
+			names = append(names, name)
+			values[name] = strings.TrimSpace(strings.Join(vals, ","))
+		}
+	}
+	sort.Strings(names)
+	headers := ""
+	for _, name := range names {
+		headers += name + ":" + values[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.SecretAccessKey)
+	for _, part := range []string{date, s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalS3Query encodes query sorted by parameter name, as signature requires.
+func canonicalS3Query(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// s3Escape percent-encodes everything except unreserved characters and optionally slashes.
+func s3Escape(s string, escapeSlash bool) string {
+	escaped := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !escapeSlash) {
+			escaped = append(escaped, c)
+		} else {
+			escaped = append(escaped, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(escaped)
+}
+
+// parseS3Error returns error described by response body, if there is one.
+func parseS3Error(body []byte) error {
+	errS3 := &s3Error{}
+	var root struct {
+		XMLName xml.Name
+	}
+	if xml.Unmarshal(body, &root) != nil || root.XMLName.Local != "Error" {
+		return nil
+	}
+	if err := xml.Unmarshal(body, errS3); err != nil {
+		return err
+	}
+	return errS3
+}
+
+// s3Object is lazy reader of object content.
+type s3Object struct {
+	store  *S3BlobStore
+	ctx    context.Context
+	object string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.offset)}}
+		resp, err := o.store.do(o.ctx, http.MethodGet, o.object, nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	if err == io.EOF && o.offset < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != o.offset && o.body != nil {
+		if err := o.body.Close(); err != nil {
+			return 0, err
+		}
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	return o.body.Close()
+}
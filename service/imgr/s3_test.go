@@ -0,0 +1,288 @@
+package imgr_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sp4rd4/go-imager/service/imgr"
+)
+
+// fakeS3 is in-process stand-in for S3 compatible storage,
+// it supports only requests needed by S3BlobStore and checks that they are signed.
+type fakeS3 struct {
+	mu       sync.Mutex
+	bucket   string
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	pageSize int
+	parts    int
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:   bucket,
+		objects:  make(map[string][]byte),
+		uploads:  make(map[string]map[int][]byte),
+		pageSize: 2,
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Bucket is either subdomain or first path segment
+	object := strings.TrimPrefix(r.URL.Path, "/")
+	if strings.HasPrefix(r.Host, f.bucket+".") {
+		object = strings.TrimPrefix(object, "/")
+	} else if parts := strings.SplitN(object, "/", 2); parts[0] == f.bucket {
+		object = ""
+		if len(parts) == 2 {
+			object = parts[1]
+		}
+	} else {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		f.error(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	sum := sha256.Sum256(body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") ||
+		r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		f.error(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && object == "":
+		f.list(w, query.Get("prefix"), query.Get("continuation-token"))
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		id := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[query.Get("uploadId")][number] = body
+		f.parts++
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, number))
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		complete := struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}{}
+		if err = xml.Unmarshal(body, &complete); err != nil {
+			f.error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		content := make([]byte, 0)
+		for _, part := range complete.Parts {
+			content = append(content, f.uploads[query.Get("uploadId")][part.PartNumber]...)
+		}
+		f.objects[object] = content
+		delete(f.uploads, query.Get("uploadId"))
+		io.WriteString(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.objects[object] = body
+	case r.Method == http.MethodDelete:
+		delete(f.objects, object)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		content, ok := f.objects[object]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		var offset int
+		if _, err = fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset); err == nil {
+			content = content[offset:]
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if r.Method == http.MethodGet {
+			w.Write(content)
+		}
+	default:
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix, after string) {
+	keys := make([]string, 0)
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	truncated := len(keys) > f.pageSize
+	if truncated {
+		keys = keys[:f.pageSize]
+	}
+	io.WriteString(w, "<ListBucketResult>")
+	for _, key := range keys {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>",
+			key, len(f.objects[key]), time.Now().UTC().Format(time.RFC3339))
+	}
+	if truncated {
+		fmt.Fprintf(w, "<NextContinuationToken>%s</NextContinuationToken>", keys[len(keys)-1])
+	}
+	fmt.Fprintf(w, "<IsTruncated>%t</IsTruncated></ListBucketResult>", truncated)
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// newFakeS3Client routes requests for any host to fake server, so virtual-hosted buckets can be resolved.
+func newFakeS3Client(server *httptest.Server) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	}}
+}
+
+func TestNewS3BlobStore(t *testing.T) {
+	examples := []struct {
+		name    string
+		config  imgr.S3Config
+		wantErr error
+	}{
+		{"Missing bucket", imgr.S3Config{}, errors.New("bucket is missing")},
+		{"Relative endpoint", imgr.S3Config{Bucket: "b", Endpoint: "minio"}, errors.New("endpoint should be absolute URL")},
+		{"Default endpoint", imgr.S3Config{Bucket: "b"}, nil},
+		{"OK", imgr.S3Config{Bucket: "b", Endpoint: "http://minio:9000", PathStyle: true}, nil},
+	}
+	for _, ex := range examples {
+		t.Run(ex.name, func(t *testing.T) {
+			store, err := imgr.NewS3BlobStore(ex.config)
+			assert.EqualValues(t, ex.wantErr, err, "Expected different error")
+			if err == nil {
+				assert.NotEqual(t, http.DefaultClient, store.Client, "Client without timeouts should not be used")
+			}
+		})
+	}
+}
+
+func TestS3BlobStore(t *testing.T) {
+	examples := []struct {
+		name      string
+		pathStyle bool
+		prefix    string
+	}{
+		{"Path style", true, ""},
+		{"Virtual hosted style", false, ""},
+		{"With prefix", true, "images/"},
+	}
+	for _, ex := range examples {
+		fake := newFakeS3("bucket")
+		server := httptest.NewServer(fake)
+		store, err := imgr.NewS3BlobStore(imgr.S3Config{
+			Endpoint:        server.URL,
+			Bucket:          "bucket",
+			Prefix:          ex.prefix,
+			AccessKeyID:     "key",
+			SecretAccessKey: "secret",
+			PathStyle:       ex.pathStyle,
+			Client:          newFakeS3Client(server),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run(ex.name, func(t *testing.T) {
+			testBlobStore(t, store)
+			for key := range fake.objects {
+				assert.True(t, strings.HasPrefix(key, ex.prefix), "Object key %q should be prefixed", key)
+			}
+		})
+		server.Close()
+	}
+}
+
+func TestS3BlobStoreMultipart(t *testing.T) {
+	fake := newFakeS3("bucket")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	store, err := imgr.NewS3BlobStore(imgr.S3Config{
+		Endpoint:        server.URL,
+		Bucket:          "bucket",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	content := bytes.Repeat([]byte("0123456789"), 1<<20+1)
+
+	if err = store.Put(ctx, "big.png", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, fake.parts, "Content should be uploaded in parts")
+	assert.Equal(t, 0, len(fake.uploads), "Upload should be completed")
+
+	blob, err := store.Get(ctx, "big.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	b, err := ioutil.ReadAll(blob)
+	assert.Nil(t, err, "Blob should be readable")
+	assert.Equal(t, content, b, "Blob content is not as expected")
+
+	// Seeking should fetch content from new position
+	_, err = blob.Seek(-4, io.SeekEnd)
+	assert.Nil(t, err, "Blob should be seekable")
+	b, err = ioutil.ReadAll(blob)
+	assert.Nil(t, err, "Blob should be readable")
+	assert.Equal(t, "6789", string(b), "Blob content is not as expected")
+}
+
+func TestS3BlobStoreErrors(t *testing.T) {
+	server := httptest.NewServer(newFakeS3("bucket"))
+	defer server.Close()
+	store, err := imgr.NewS3BlobStore(imgr.S3Config{
+		Endpoint:        server.URL,
+		Bucket:          "other",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Put(context.Background(), "image.png", strings.NewReader("content"))
+	assert.EqualError(t, err, "s3: NoSuchBucket: NoSuchBucket", "Storage error should be reported")
+}
@@ -6,46 +6,100 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"math/rand"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
-	"github.com/oklog/ulid"
 	log "github.com/sirupsen/logrus"
 	"github.com/sp4rd4/go-imager/util"
+	"goji.io/pat"
 )
 
 // ImageServer defines interface for service that can list and process uploaded images.
 type ImageServer interface {
 	ListImages(w http.ResponseWriter, r *http.Request)
 	PostImage(w http.ResponseWriter, r *http.Request)
+	PostImport(w http.ResponseWriter, r *http.Request)
+	GetImage(w http.ResponseWriter, r *http.Request)
+	GetThumbnail(w http.ResponseWriter, r *http.Request)
+	PatchImage(w http.ResponseWriter, r *http.Request)
+	DeleteImage(w http.ResponseWriter, r *http.Request)
+	GetUsage(w http.ResponseWriter, r *http.Request)
+	GetArchive(w http.ResponseWriter, r *http.Request)
+	PutImageTags(w http.ResponseWriter, r *http.Request)
+	ListTags(w http.ResponseWriter, r *http.Request)
+	PostShare(w http.ResponseWriter, r *http.Request)
+	DeleteShare(w http.ResponseWriter, r *http.Request)
+	ListAlbums(w http.ResponseWriter, r *http.Request)
+	PostAlbum(w http.ResponseWriter, r *http.Request)
+	PatchAlbum(w http.ResponseWriter, r *http.Request)
+	DeleteAlbum(w http.ResponseWriter, r *http.Request)
+	ListAlbumImages(w http.ResponseWriter, r *http.Request)
+	PutAlbumImage(w http.ResponseWriter, r *http.Request)
+	DeleteAlbumImage(w http.ResponseWriter, r *http.Request)
+	PostUpload(w http.ResponseWriter, r *http.Request)
+	HeadUpload(w http.ResponseWriter, r *http.Request)
+	PatchUpload(w http.ResponseWriter, r *http.Request)
+	FinalizeUpload(w http.ResponseWriter, r *http.Request)
+	DeleteUpload(w http.ResponseWriter, r *http.Request)
+	Close() error
 }
 
-// LocalImageServer is ImageServer that stores images in local folder.
+// LocalImageServer is ImageServer that stores images in BlobStore, local folder is used by default.
 type LocalImageServer struct {
 	storage        Storage
-	staticPath     string
+	blobs          BlobStore
 	log            *log.Logger
 	requestUserKey util.RequestKey
 	requestIDKey   util.RequestKey
+	maxUploadSize  int64
+	maxWidth       int
+	maxHeight      int
+	maxRendition   int
+	formats        map[string]bool
+	keptEXIFTags   map[uint16]bool
+	quota          Quota
+	shareSecret    []byte
+
+	uploadSessionTTL time.Duration
+	importTimeout    time.Duration
+	importAllowList  []*net.IPNet
+	importClient     *http.Client
+
+	// Decoded images take up to 4 bytes per pixel, so number of images rendered at once is limited
+	renderSlots chan struct{}
+
+	derivatives          []Derivative
+	derivativeWorkers    int
+	derivativeRetryDelay time.Duration
+	derivativeJobs       chan derivativeJob
+
+	// Background workers run until server is closed
+	closing    chan struct{}
+	closeOnce  sync.Once
+	background sync.WaitGroup
 }
 
+// DefaultMaxUploadSize is max size of uploaded image used by LocalImageServer,
+// it matches request body limit of nginx proxy.
+const DefaultMaxUploadSize = 50 << 20
+
+// DefaultMaxDimension is max width and height of uploaded image used by LocalImageServer.
+const DefaultMaxDimension = 10000
+
+// maxConcurrentRenders is number of images LocalImageServer decodes and resizes at once.
+const maxConcurrentRenders = 4
+
 // User interface for getting needed user info from context value.
 type User interface {
 	ID() uint64
 }
 
-// imageData defines uploaded image data.
-type imageData struct {
-	filename string
-	data     []byte
-}
-
 // Option describes option for LocalImageServer initializer
 type Option func(*LocalImageServer) error
 
@@ -57,26 +111,92 @@ func NewLocalImageServer(storage Storage, options ...Option) (ImageServer, error
 	log.SetOutput(os.Stdout)
 	log := log.New()
 
-	is := &LocalImageServer{storage, ".", log, util.RequestUserKey, util.RequestIDKey}
+	is := &LocalImageServer{
+		storage:        storage,
+		blobs:          &FolderBlobStore{"."},
+		log:            log,
+		requestUserKey: util.RequestUserKey,
+		requestIDKey:   util.RequestIDKey,
+		maxUploadSize:  DefaultMaxUploadSize,
+		maxWidth:       DefaultMaxDimension,
+		maxHeight:      DefaultMaxDimension,
+		maxRendition:   DefaultMaxRenditionDimension,
+		formats:        map[string]bool{"gif": true, "jpeg": true, "png": true},
+		keptEXIFTags:   exifTagIDs(defaultKeptEXIFTags),
+
+		derivativeWorkers:    DefaultDerivativeWorkers,
+		derivativeRetryDelay: DefaultDerivativeRetryDelay,
+		uploadSessionTTL:     DefaultUploadSessionTTL,
+		importTimeout:        DefaultImportTimeout,
+		renderSlots:          make(chan struct{}, maxConcurrentRenders),
+		closing:              make(chan struct{}),
+	}
 	for _, option := range options {
 		if err := option(is); err != nil {
 			return nil, err
 		}
 	}
+	// Derivatives are served as thumbnails, so they can't be bigger than thumbnails
+	for _, derivative := range is.derivatives {
+		if derivative.Width > is.maxRendition || derivative.Height > is.maxRendition {
+			return nil, fmt.Errorf("derivative %s exceeds max rendition dimension %d", derivative.Name, is.maxRendition)
+		}
+	}
+	if len(is.derivatives) > 0 {
+		is.startDerivativeWorkers()
+	}
+	is.startUploadCollector()
+	is.importClient = is.newImportClient()
 	return is, nil
 }
 
-// WithStaticFolder is functional option for setting LocalImageServer static folder path.
+// Close stops background workers of LocalImageServer and waits for their current tasks,
+// derivatives that are still queued stay pending and are generated once server is started again.
+func (is *LocalImageServer) Close() error {
+	is.closeOnce.Do(func() {
+		close(is.closing)
+	})
+	is.background.Wait()
+	return nil
+}
+
+// runPeriodically runs task in background every interval until server is closed.
+func (is *LocalImageServer) runPeriodically(interval time.Duration, task func()) {
+	is.background.Add(1)
+	go func() {
+		defer is.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-is.closing:
+				return
+			case <-ticker.C:
+				task()
+			}
+		}
+	}()
+}
+
+// WithStaticFolder is functional option for storing LocalImageServer images in local folder.
 func WithStaticFolder(path string) Option {
 	return func(is *LocalImageServer) error {
-		fileInfo, err := os.Stat(path)
+		store, err := NewFolderBlobStore(path)
 		if err != nil {
 			return err
 		}
-		if !fileInfo.IsDir() {
-			return errors.New("path is not pointing to folder")
+		is.blobs = store
+		return nil
+	}
+}
+
+// WithBlobStore is functional option for setting LocalImageServer images content storage.
+func WithBlobStore(store BlobStore) Option {
+	return func(is *LocalImageServer) error {
+		if store == nil {
+			return errors.New("blob store is missing")
 		}
-		is.staticPath = path
+		is.blobs = store
 		return nil
 	}
 }
@@ -108,10 +228,64 @@ func WithLogger(logger *log.Logger) Option {
 	}
 }
 
-// PostImage saves image to statics folder of LocalImageServer and creates storage record about that image.
+// WithMaxUploadSize is functional option for setting LocalImageServer max size of uploaded image in bytes,
+// default size is DefaultMaxUploadSize.
+func WithMaxUploadSize(size int64) Option {
+	return func(is *LocalImageServer) error {
+		if size <= 0 {
+			return errors.New("max upload size should be positive")
+		}
+		is.maxUploadSize = size
+		return nil
+	}
+}
+
+// WithAllowedFormats is functional option for setting LocalImageServer image formats allowed for upload,
+// supported formats are gif, jpeg and png, all of them are allowed by default.
+func WithAllowedFormats(formats ...string) Option {
+	return func(is *LocalImageServer) error {
+		if len(formats) == 0 {
+			return errors.New("formats are missing")
+		}
+		allowed := make(map[string]bool)
+		for _, format := range formats {
+			if _, ok := contentTypes[format]; !ok {
+				return fmt.Errorf("format %s isn't supported", format)
+			}
+			allowed[format] = true
+		}
+		is.formats = allowed
+		return nil
+	}
+}
+
+// WithMaxDimensions is functional option for setting LocalImageServer max width and height of uploaded image,
+// that protects from images that take too much memory when decoded, default is DefaultMaxDimension for both.
+func WithMaxDimensions(width, height int) Option {
+	return func(is *LocalImageServer) error {
+		if width <= 0 || height <= 0 {
+			return errors.New("max dimensions should be positive")
+		}
+		is.maxWidth = width
+		is.maxHeight = height
+		return nil
+	}
+}
+
+// PostImage streams images to blob store of LocalImageServer and creates storage records about them.
+// Single image is returned as json with Location header pointing to its URL.
+// Several images are uploaded as batch, every image is processed independently
+// and multi-status response lists result of every image with its status and either created image or error,
+// storage records of batch are created at once.
+// Identical content is stored once and shared by images, it's removed when the last of them is deleted.
+// Generation of configured derivatives is queued after image is stored.
+// Images are validated by their header, images of not allowed formats
+// and images bigger than max upload size or max dimensions are rejected.
+// Images that don't fit into quota of user are rejected after they are read.
 // If context value defined by WithRequestUserKey doesn't contain variable
-// that implements User interface and returns ID()>0 image will not be processed.
-// * image (required) POST multipart-data file
+// that implements User interface and returns ID()>0 images will not be processed.
+// * image (required unless images[] are sent) POST multipart-data file, can be repeated
+// * images[] (required unless image is sent) POST multipart-data files uploaded as batch, up to 100 images
 func (is *LocalImageServer) PostImage(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	requestID, _ := ctx.Value(util.RequestIDKey).(string)
@@ -124,52 +298,159 @@ func (is *LocalImageServer) PostImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, err := extractImage(r, requestLogger)
+	uploads, batch, err := is.receiveImages(r, userID, requestLogger)
 	if err != nil {
 		requestLogger.Info(err)
 		util.JSONResponse(w, http.StatusUnprocessableEntity, `{"error":"No image is present"}`, requestLogger)
 		return
 	}
+	is.createImages(ctx, uploads, requestLogger)
 
-	now := time.Now()
-	entropy := rand.New(rand.NewSource(now.UnixNano()))
-	ulid, err := ulid.New(ulid.Timestamp(now), entropy)
-	if err != nil {
-		requestLogger.Error(err)
-		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+	if !batch {
+		writeUpload(w, uploads[0], requestLogger)
 		return
 	}
 
-	filename := ulid.String() + id.filename
-	if err = ioutil.WriteFile(filepath.Join(is.staticPath, filename), id.data, 0644); err != nil {
+	results := uploadResults{Items: make([]uploadResult, 0, len(uploads))}
+	for _, up := range uploads {
+		result := uploadResult{OriginalName: up.image.OriginalName, Status: http.StatusCreated, Image: up.image}
+		if up.err != nil {
+			var body string
+			result.Image = nil
+			result.Status, body = uploadFailure(up.err, requestLogger)
+			result.Error = errorMessage(body)
+		}
+		results.Items = append(results.Items, result)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMultiStatus)
+	if err = json.NewEncoder(w).Encode(results); err != nil {
 		requestLogger.Error(err)
-		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
-		return
 	}
+}
 
-	image := &Image{
-		Filename: filename,
-		UserID:   userID,
+// createImages creates storage records of received images and moves their uploaded content to content blobs,
+// uploaded content of images that aren't created is removed.
+func (is *LocalImageServer) createImages(ctx context.Context, uploads []*upload, requestLogger *log.Entry) {
+	received := make([]*upload, 0, len(uploads))
+	images := make([]*Image, 0, len(uploads))
+	for _, up := range uploads {
+		if up.err == nil {
+			received = append(received, up)
+			images = append(images, up.image)
+		}
 	}
-	if err = is.storage.CreateImage(image); err != nil {
-		// Due to ulid part in filename, unique index conflicts are treated as exceptional situations
-		if errU, ok := err.(ErrUniqueIndexConflict); ok {
-			requestLogger.Error(errU)
-			util.JSONResponse(w, http.StatusConflict, `{"error":"Image filename is taken"}`, requestLogger)
-			return
+	if len(images) == 0 {
+		return
+	}
+
+	errs, err := is.storage.CreateImages(images, &is.quota)
+	for i, up := range received {
+		if up.err = err; err == nil {
+			up.err = errs[i]
 		}
-		requestLogger.Error(err)
-		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		if up.err != nil {
+			// Blob without storage record would never be accessible
+			if errB := is.blobs.Delete(ctx, up.key); errB != nil {
+				up.err = fmt.Errorf("First: %s, Second: %s", up.err, errB)
+			}
+			continue
+		}
+		if up.err = is.storeContent(ctx, up.key, up.image); up.err != nil {
+			// Storage record without content would never be served
+			errD := is.storage.DeleteImage(up.image.Filename, up.image.UserID, is.removeBlob(ctx))
+			if errD != nil {
+				up.err = fmt.Errorf("First: %s, Second: %s", up.err, errD)
+			}
+			continue
+		}
+		up.image.URL = imageURL(up.image.Filename)
+		is.enqueueDerivatives(up.image, requestLogger)
+	}
+}
+
+// writeUpload writes created image as json with Location header pointing to its URL or error of image.
+func writeUpload(w http.ResponseWriter, up *upload, requestLogger *log.Entry) {
+	if up.err != nil {
+		status, body := uploadFailure(up.err, requestLogger)
+		util.JSONResponse(w, status, body, requestLogger)
 		return
 	}
+	w.Header().Set("Location", up.image.URL)
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(up.image); err != nil {
+		requestLogger.Error(err)
+	}
 }
 
-// ListImages returns json formatted images list assigned to the current user.
+// uploadResults is json envelope of results of images uploaded as batch.
+type uploadResults struct {
+	Items []uploadResult `json:"items"`
+}
+
+// uploadResult is result of image uploaded as batch, it contains either created image or error.
+type uploadResult struct {
+	OriginalName string `json:"original_name"`
+	Status       int    `json:"status"`
+	Image        *Image `json:"image,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// uploadFailure logs error of image that isn't created and returns status and json body it's reported with.
+func uploadFailure(err error, requestLogger *log.Entry) (int, string) {
+	switch errT := err.(type) {
+	case *uploadError:
+		requestLogger.Info(errT)
+		return errT.status, errT.body
+	case ErrQuotaExceeded:
+		return quotaFailure(errT, requestLogger)
+	case ErrUniqueIndexConflict:
+		// Due to ulid part in filename, unique index conflicts are treated as exceptional situations
+		requestLogger.Error(errT)
+		return http.StatusConflict, `{"error":"Image filename is taken"}`
+	}
+	requestLogger.Error(err)
+	return http.StatusInternalServerError, `{"error":"Internal server error"}`
+}
+
+// errorMessage returns message of json error body.
+func errorMessage(body string) string {
+	message := struct {
+		Error string `json:"error"`
+	}{}
+	if err := json.Unmarshal([]byte(body), &message); err != nil {
+		return body
+	}
+	return message.Error
+}
+
+// imageList is json envelope of images list.
+type imageList struct {
+	Items      []Image `json:"items"`
+	Total      uint64  `json:"total"`
+	Limit      uint64  `json:"limit"`
+	Offset     uint64  `json:"offset"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+// ListImages returns json formatted images list assigned to the current user,
+// wrapped in envelope with total count of images matching filters.
+// URLs of image derivatives are listed once they are generated, tags of images are listed too.
 // If context value defined by WithRequestUserKey doesn't contain variable
 // that implements User interface and returns ID()>0 no images will be loaded.
-// * limit (default: none) Query parameter that states size of returned selection
+// When there are more images, next_cursor is returned for loading next selection,
+// next and previous selections are also linked in Link header.
+// Invalid query parameters are rejected.
+// * limit (default: none) Query parameter that states size of returned selection, up to MaxListLimit
 // * offset (default: 0) Query parameter that states selection offset of returned selection
+// * cursor (default: none) Query parameter with next_cursor of previous selection with the same sort
+// * sort (default: filename) Query parameter, one of filename, created_at, -created_at, size
+// * content_type (default: none) Query parameter filtering images by content type
+// * created_after, created_before (default: none) Query parameters filtering images by RFC 3339 upload time
+// * name_contains (default: none) Query parameter filtering images by case insensitive part of original name
+// * tag (default: none) Query parameters filtering images by tags, can be repeated
+// * tag_match (default: all) Query parameter, all selects images having every tag, any selects images having some
 func (is *LocalImageServer) ListImages(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	requestID, _ := ctx.Value(util.RequestIDKey).(string)
@@ -181,49 +462,249 @@ func (is *LocalImageServer) ListImages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	params := r.URL.Query()
-	limit, _ := strconv.ParseUint(params.Get("limit"), 10, 64)
-	offset, _ := strconv.ParseUint(params.Get("offset"), 10, 64)
+	query, err := parseImageQuery(r.URL.Query(), userID)
+	if err != nil {
+		requestLogger.Info(err)
+		body := fmt.Sprintf(`{"error":"Invalid query parameter %s"}`, string(err.(queryParamError)))
+		util.JSONResponse(w, http.StatusBadRequest, body, requestLogger)
+		return
+	}
+	is.writeImageList(w, r, query, requestLogger)
+}
+
+// writeImageList writes json envelope with images selected by query, total count of them and links to next
+// and previous selections.
+func (is *LocalImageServer) writeImageList(
+	w http.ResponseWriter, r *http.Request, query ImageQuery, requestLogger *log.Entry,
+) {
+	limit := query.Limit
+	if limit > 0 {
+		// One more image is loaded to know if there is next selection
+		query.Limit = limit + 1
+	}
+
 	images := make([]Image, 0)
-	err = is.storage.LoadImages(&images, limit, offset, userID)
+	err := is.storage.LoadImages(&images, query)
 	if err != nil && err != sql.ErrNoRows {
 		requestLogger.Error(err)
 		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
 		return
 	}
+	list := imageList{Items: images, Limit: limit, Offset: query.Offset}
+	if err = is.storage.CountImages(&list.Total, query); err != nil {
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+	if limit > 0 && uint64(len(images)) > limit {
+		list.Items = images[:limit]
+		list.NextCursor = encodeCursor(query.Sort, images[limit-1])
+	}
+	for i := range list.Items {
+		list.Items[i].URL = imageURL(list.Items[i].Filename)
+	}
+	if err = is.setVariants(list.Items); err == nil {
+		err = is.setTags(list.Items)
+	}
+	if err != nil {
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+	for _, link := range listLinks(r.URL, list) {
+		w.Header().Add("Link", link)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
-	if err = json.NewEncoder(w).Encode(images); err != nil {
+	if err = json.NewEncoder(w).Encode(list); err != nil {
 		requestLogger.Error(err)
 		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
 		return
 	}
 }
 
-func extractImage(r *http.Request, log *log.Entry) (*imageData, error) {
-	file, info, err := r.FormFile("image")
+// listLinks returns RFC 5988 links to next and previous selections of images list,
+// next selection is linked by cursor, previous one by offset.
+func listLinks(u *url.URL, list imageList) []string {
+	links := make([]string, 0, 2)
+	if list.NextCursor != "" {
+		params := u.Query()
+		params.Del("offset")
+		params.Set("cursor", list.NextCursor)
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="next"`, u.Path, params.Encode()))
+	}
+	if list.Limit > 0 && list.Offset > 0 {
+		params := u.Query()
+		offset := uint64(0)
+		if list.Offset > list.Limit {
+			offset = list.Offset - list.Limit
+		}
+		params.Set("offset", strconv.FormatUint(offset, 10))
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="prev"`, u.Path, params.Encode()))
+	}
+	return links
+}
+
+// GetImage serves content of image uploaded by the current user,
+// supporting range and conditional requests. Image is converted to requested format,
+// which is negotiated by Accept header unless it's set explicitly.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 image will not be served, unless it's shared.
+// Images of other users are reported as missing.
+// * filename (required) URL path parameter
+// * share (default: none) Query parameter with share token, image is served to anyone with valid token,
+// only GET requests that are served full image count as views of share
+// * format (default: negotiated) Query parameter, one of png, jpeg, gif
+// * quality (default: original image or 85) Query parameter with JPEG quality from 1 to 100
+func (is *LocalImageServer) GetImage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	filename := pat.Param(r, "filename")
+	var userID uint64
+	var err error
+	if token := r.URL.Query().Get(shareParam); token != "" {
+		// View is counted for full GET only, it's returned when image isn't served in full after all
+		view := r.Method == http.MethodGet && r.Header.Get("Range") == ""
+		share, errS := is.sharedImage(token, filename, view)
+		if errS != nil {
+			if _, ok := errS.(shareError); ok {
+				requestLogger.Info(errS)
+				util.JSONResponse(w, http.StatusForbidden, `{"error":"Share link is invalid or expired"}`, requestLogger)
+				return
+			}
+			requestLogger.Error(errS)
+			util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+			return
+		}
+		userID = share.UserID
+		if view {
+			recorder := &statusRecorder{ResponseWriter: w}
+			w = recorder
+			defer func() {
+				if recorder.status == http.StatusOK {
+					return
+				}
+				if errR := is.storage.ReturnShareView(share.ID); errR != nil {
+					requestLogger.Error(errR)
+				}
+			}()
+		}
+	} else if userID, err = extracrtUserID(ctx); err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	image := &Image{Filename: filename, UserID: userID}
+	if err = is.storage.LoadImage(image); err != nil {
+		if err == sql.ErrNoRows {
+			util.JSONResponse(w, http.StatusNotFound, `{"error":"Image not found"}`, requestLogger)
+			return
+		}
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+
+	// Served representation depends on Accept header
+	w.Header().Set("Vary", "Accept")
+	rn, err := parseConversion(r, image)
 	if err != nil {
-		return nil, err
+		requestLogger.Info(err)
+		if err == errNotAcceptable {
+			util.JSONResponse(w, http.StatusNotAcceptable, `{"error":"Image format is not acceptable"}`, requestLogger)
+			return
+		}
+		body := fmt.Sprintf(`{"error":"Invalid query parameter %s"}`, string(err.(queryParamError)))
+		util.JSONResponse(w, http.StatusBadRequest, body, requestLogger)
+		return
+	}
+	if rn.format != "" {
+		is.serveRendition(w, r, image, rn, requestLogger)
+		return
+	}
+
+	info, err := is.blobs.Stat(ctx, image.blobKey())
+	var blob io.ReadSeekCloser
+	if err == nil {
+		blob, err = is.blobs.Get(ctx, image.blobKey())
+	}
+	if err != nil {
+		requestLogger.Error(err)
+		if err == ErrBlobNotFound {
+			util.JSONResponse(w, http.StatusNotFound, `{"error":"Image not found"}`, requestLogger)
+			return
+		}
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
 	}
 	defer func() {
-		if err = file.Close(); err != nil {
-			log.Error(err)
+		if err = blob.Close(); err != nil {
+			requestLogger.Error(err)
 		}
 	}()
 
-	bs, err := ioutil.ReadAll(file)
+	// Content of image never changes, so checksum of content and version of details are strong validator
+	if image.ContentType != "" {
+		w.Header().Set("Content-Type", image.ContentType)
+	}
+	w.Header().Set("ETag", imageETag(image))
+	http.ServeContent(w, r, image.Filename, info.ModTime, blob)
+}
+
+// DeleteImage removes image uploaded by the current user from storage and blob store, along with its renditions.
+// Image blob is removed before removal of storage record is committed and record is kept if blob can't be removed,
+// so neither records without blobs nor blobs without records are left behind.
+// Blob is kept while other images with identical content reference it.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 image will not be deleted.
+// Images of other users are reported as missing.
+// * filename (required) URL path parameter
+func (is *LocalImageServer) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	// Image is loaded to find its renditions
+	image := &Image{Filename: pat.Param(r, "filename"), UserID: userID}
+	err = is.storage.LoadImage(image)
+	if err == nil {
+		err = is.storage.DeleteImage(image.Filename, userID, is.removeBlob(ctx))
+	}
 	if err != nil {
-		return nil, err
+		if err == sql.ErrNoRows {
+			util.JSONResponse(w, http.StatusNotFound, `{"error":"Image not found"}`, requestLogger)
+			return
+		}
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
 	}
 
-	// http.DetectContentType specifies only first 512 bytes as relevant data for type checking
-	ct := http.DetectContentType(bs[:512])
-	if !strings.HasPrefix(ct, "image/") {
-		return nil, fmt.Errorf("content type is incorrect, received %s, should be image", ct)
+	// Renditions can be rendered again, so failing to remove them doesn't fail request
+	renditions, err := is.blobs.List(ctx, renditionsPrefix(image.ID))
+	if err != nil {
+		requestLogger.Error(err)
 	}
+	for _, rendition := range renditions {
+		if err = is.blobs.Delete(ctx, rendition.Key); err != nil && err != ErrBlobNotFound {
+			requestLogger.Error(err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	return &imageData{filepath.Base(info.Filename), bs}, nil
+// imageURL returns URL of image resource served by GetImage.
+func imageURL(filename string) string {
+	return "/images/" + url.PathEscape(filename)
 }
 
 func extracrtUserID(ctx context.Context) (uint64, error) {
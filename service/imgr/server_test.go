@@ -1,22 +1,36 @@
 package imgr_test
 
 import (
+	"archive/zip"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
 	"image/color"
+	"image/gif"
+	"image/jpeg"
 	"image/png"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
@@ -24,6 +38,8 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/sp4rd4/go-imager/service/imgr"
 	"github.com/sp4rd4/go-imager/util"
+	goji "goji.io"
+	"goji.io/pat"
 )
 
 func TestNewLocalImageServer(t *testing.T) {
@@ -35,6 +51,15 @@ func TestNewLocalImageServer(t *testing.T) {
 	}{
 		{"OK", &imgr.DB{}, []imgr.Option{imgr.WithRequestKeys("key1", "key2")}, nil},
 		{"Nil DB", nil, []imgr.Option{}, errors.New("missing storage")},
+		{
+			"Derivative over max rendition",
+			&imgr.DB{},
+			[]imgr.Option{
+				imgr.WithMaxRenditionDimension(100),
+				imgr.WithDerivatives(imgr.Derivative{Name: "large", Width: 200, Fit: imgr.FitContain}),
+			},
+			errors.New("derivative large exceeds max rendition dimension 100"),
+		},
 	}
 	for _, ex := range examples {
 		t.Run(ex.name, func(t *testing.T) {
@@ -108,46 +133,2655 @@ func TestLocalImageServerWithLogger(t *testing.T) {
 	}
 }
 
+func TestLocalImageServerWithBlobStore(t *testing.T) {
+	examples := []struct {
+		name    string
+		store   imgr.BlobStore
+		wantErr error
+	}{
+		{"Nil store", nil, errors.New("blob store is missing")},
+		{"OK", imgr.NewMemoryBlobStore(), nil},
+	}
+	for _, ex := range examples {
+		is := &imgr.LocalImageServer{}
+		t.Run(ex.name, func(t *testing.T) {
+			assert.EqualValues(t, ex.wantErr, imgr.WithBlobStore(ex.store)(is), "Expected different error")
+		})
+	}
+}
+
+func TestLocalImageServerWithAllowedFormats(t *testing.T) {
+	examples := []struct {
+		name    string
+		formats []string
+		wantErr error
+	}{
+		{"No formats", nil, errors.New("formats are missing")},
+		{"Unknown format", []string{"png", "bmp"}, errors.New("format bmp isn't supported")},
+		{"OK", []string{"png", "jpeg"}, nil},
+	}
+	for _, ex := range examples {
+		is := &imgr.LocalImageServer{}
+		t.Run(ex.name, func(t *testing.T) {
+			assert.EqualValues(t, ex.wantErr, imgr.WithAllowedFormats(ex.formats...)(is), "Expected different error")
+		})
+	}
+}
+
+func TestLocalImageServerWithMaxDimensions(t *testing.T) {
+	examples := []struct {
+		name    string
+		width   int
+		height  int
+		wantErr error
+	}{
+		{"Zero width", 0, 100, errors.New("max dimensions should be positive")},
+		{"Negative height", 100, -1, errors.New("max dimensions should be positive")},
+		{"OK", 4096, 4096, nil},
+	}
+	for _, ex := range examples {
+		is := &imgr.LocalImageServer{}
+		t.Run(ex.name, func(t *testing.T) {
+			assert.EqualValues(t, ex.wantErr, imgr.WithMaxDimensions(ex.width, ex.height)(is), "Expected different error")
+		})
+	}
+}
+
+func TestLocalImageServerWithMaxRenditionDimension(t *testing.T) {
+	examples := []struct {
+		name    string
+		size    int
+		wantErr error
+	}{
+		{"Zero size", 0, errors.New("max rendition dimension should be positive")},
+		{"OK", 1024, nil},
+	}
+	for _, ex := range examples {
+		is := &imgr.LocalImageServer{}
+		t.Run(ex.name, func(t *testing.T) {
+			assert.EqualValues(t, ex.wantErr, imgr.WithMaxRenditionDimension(ex.size)(is), "Expected different error")
+		})
+	}
+}
+
+func TestLocalImageServerWithDerivatives(t *testing.T) {
+	examples := []struct {
+		name        string
+		derivatives []imgr.Derivative
+		wantErr     error
+	}{
+		{
+			"Invalid name",
+			[]imgr.Derivative{{Name: "Thumb", Width: 10, Fit: imgr.FitContain}},
+			errors.New(`derivative name "Thumb" is invalid or duplicated`),
+		},
+		{
+			"Duplicated name",
+			[]imgr.Derivative{{Name: "a", Width: 10, Fit: imgr.FitContain}, {Name: "a", Height: 10, Fit: imgr.FitCover}},
+			errors.New(`derivative name "a" is invalid or duplicated`),
+		},
+		{
+			"Missing size",
+			[]imgr.Derivative{{Name: "thumb", Fit: imgr.FitContain}},
+			errors.New("derivative thumb should have positive size"),
+		},
+		{
+			"Unknown fit",
+			[]imgr.Derivative{{Name: "thumb", Width: 10, Height: 10, Fit: "fill"}},
+			errors.New("derivative thumb has unknown fit fill"),
+		},
+		{"OK", []imgr.Derivative{{Name: "thumb", Width: 10, Height: 10, Fit: imgr.FitCover}}, nil},
+	}
+	for _, ex := range examples {
+		is := &imgr.LocalImageServer{}
+		t.Run(ex.name, func(t *testing.T) {
+			assert.EqualValues(t, ex.wantErr, imgr.WithDerivatives(ex.derivatives...)(is), "Expected different error")
+		})
+	}
+}
+
+func TestLocalImageServerWithDerivativeRetryDelay(t *testing.T) {
+	examples := []struct {
+		name    string
+		delay   time.Duration
+		wantErr error
+	}{
+		{"Zero", 0, errors.New("derivative retry delay should be positive")},
+		{"OK", time.Second, nil},
+	}
+	for _, ex := range examples {
+		is := &imgr.LocalImageServer{}
+		t.Run(ex.name, func(t *testing.T) {
+			assert.EqualValues(t, ex.wantErr, imgr.WithDerivativeRetryDelay(ex.delay)(is), "Expected different error")
+		})
+	}
+}
+
+func TestLocalImageServerWithDerivativeWorkers(t *testing.T) {
+	examples := []struct {
+		name    string
+		workers int
+		wantErr error
+	}{
+		{"Zero workers", 0, errors.New("derivative workers number should be positive")},
+		{"OK", 4, nil},
+	}
+	for _, ex := range examples {
+		is := &imgr.LocalImageServer{}
+		t.Run(ex.name, func(t *testing.T) {
+			assert.EqualValues(t, ex.wantErr, imgr.WithDerivativeWorkers(ex.workers)(is), "Expected different error")
+		})
+	}
+}
+
+func TestLocalImageServerWithKeptEXIFTags(t *testing.T) {
+	examples := []struct {
+		name    string
+		tags    []string
+		wantErr error
+	}{
+		{"Unknown tag", []string{"DateTimeOriginal", "GPSLatitude"}, errors.New("EXIF tag GPSLatitude isn't supported")},
+		{"No tags", nil, nil},
+		{"OK", []string{"Make", "Model"}, nil},
+	}
+	for _, ex := range examples {
+		is := &imgr.LocalImageServer{}
+		t.Run(ex.name, func(t *testing.T) {
+			assert.EqualValues(t, ex.wantErr, imgr.WithKeptEXIFTags(ex.tags...)(is), "Expected different error")
+		})
+	}
+}
+
+func TestLocalImageServerWithQuota(t *testing.T) {
+	examples := []struct {
+		name    string
+		quota   imgr.Quota
+		wantErr error
+	}{
+		{"Negative bytes", imgr.Quota{MaxBytes: -1}, errors.New("quota limits should not be negative")},
+		{"Negative images", imgr.Quota{MaxImages: -1}, errors.New("quota limits should not be negative")},
+		{"No limits", imgr.Quota{}, nil},
+		{"OK", imgr.Quota{MaxBytes: 1 << 30, MaxImages: 1000}, nil},
+	}
+	for _, ex := range examples {
+		is := &imgr.LocalImageServer{}
+		t.Run(ex.name, func(t *testing.T) {
+			assert.EqualValues(t, ex.wantErr, imgr.WithQuota(ex.quota)(is), "Expected different error")
+		})
+	}
+}
+
+func TestParseDerivative(t *testing.T) {
+	examples := []struct {
+		name        string
+		description string
+		want        imgr.Derivative
+		wantErr     error
+	}{
+		{"Box", "thumb 128x96 cover", imgr.Derivative{"thumb", 128, 96, imgr.FitCover}, nil},
+		{"Width", "medium 1024w", imgr.Derivative{"medium", 1024, 0, imgr.FitContain}, nil},
+		{"Height", "strip  64h ", imgr.Derivative{"strip", 0, 64, imgr.FitContain}, nil},
+		{
+			"Missing size",
+			"thumb",
+			imgr.Derivative{},
+			errors.New(`derivative "thumb" should have name, size and optional fit`),
+		},
+		{"Invalid size", "thumb 128", imgr.Derivative{}, errors.New(`derivative "thumb 128" has invalid size`)},
+	}
+	for _, ex := range examples {
+		t.Run(ex.name, func(t *testing.T) {
+			derivative, err := imgr.ParseDerivative(ex.description)
+			assert.EqualValues(t, ex.wantErr, err, "Expected different error")
+			assert.Equal(t, ex.want, derivative, "Parsed derivative is not as expected")
+		})
+	}
+}
+
+func TestLocalImageServerWithMaxUploadSize(t *testing.T) {
+	examples := []struct {
+		name    string
+		size    int64
+		wantErr error
+	}{
+		{"Zero size", 0, errors.New("max upload size should be positive")},
+		{"OK", 1 << 20, nil},
+	}
+	for _, ex := range examples {
+		is := &imgr.LocalImageServer{}
+		t.Run(ex.name, func(t *testing.T) {
+			assert.EqualValues(t, ex.wantErr, imgr.WithMaxUploadSize(ex.size)(is), "Expected different error")
+		})
+	}
+}
+
 type stubStoreNil bool
 
-func (ss stubStoreNil) CreateImage(_ *imgr.Image) (err error) {
-	if !ss {
-		err = errors.New("storage error")
+func (ss stubStoreNil) CreateImage(_ *imgr.Image, _ *imgr.Quota) (err error) {
+	if !ss {
+		err = errors.New("storage error")
+	}
+	return
+}
+func (ss stubStoreNil) CreateImages(images []*imgr.Image, quota *imgr.Quota) ([]error, error) {
+	errs := make([]error, len(images))
+	for i, img := range images {
+		errs[i] = ss.CreateImage(img, quota)
+	}
+	return errs, nil
+}
+func (ss stubStoreNil) LoadImage(_ *imgr.Image) (err error) {
+	return
+}
+func (ss stubStoreNil) LoadImages(_ *[]imgr.Image, _ imgr.ImageQuery) (err error) {
+	return
+}
+func (ss stubStoreNil) CountImages(_ *uint64, _ imgr.ImageQuery) (err error) {
+	return
+}
+func (ss stubStoreNil) UpdateImageDetails(_ *imgr.Image) (err error) {
+	return
+}
+func (ss stubStoreNil) DeleteImage(_ string, _ uint64, _ func(string) error) (err error) {
+	return
+}
+func (ss stubStoreNil) CreateDerivatives(_ uint64, _ []string) (err error) {
+	return
+}
+func (ss stubStoreNil) UpdateDerivative(_ *imgr.ImageDerivative) (err error) {
+	return
+}
+func (ss stubStoreNil) LoadDerivatives(_ *[]imgr.ImageDerivative, _ []uint64) (err error) {
+	return
+}
+func (ss stubStoreNil) LoadUnfinishedDerivatives(_ *[]imgr.PendingDerivative, _ []string, _ time.Time, _ int) error {
+	return nil
+}
+func (ss stubStoreNil) LoadUsage(_ *imgr.Usage, _ imgr.Quota) (err error) {
+	return
+}
+
+func (ss stubStoreNil) CreateAlbum(_ *imgr.Album) (err error) {
+	return
+}
+func (ss stubStoreNil) LoadAlbum(_ *imgr.Album) (err error) {
+	return
+}
+func (ss stubStoreNil) LoadAlbums(_ *[]imgr.Album, _ uint64) (err error) {
+	return
+}
+func (ss stubStoreNil) RenameAlbum(_ *imgr.Album) (err error) {
+	return
+}
+func (ss stubStoreNil) DeleteAlbum(_, _ uint64) (err error) {
+	return
+}
+func (ss stubStoreNil) AddAlbumImage(_, _ uint64) (err error) {
+	return
+}
+func (ss stubStoreNil) RemoveAlbumImage(_, _ uint64) (err error) {
+	return
+}
+
+func (ss stubStoreNil) SetImageTags(_ uint64, _ []string) (err error) {
+	return
+}
+
+func (ss stubStoreNil) LoadImageTags(_ *[]imgr.ImageTag, _ []uint64) (err error) {
+	return
+}
+
+func (ss stubStoreNil) LoadTagCounts(_ *[]imgr.TagCount, _ uint64) (err error) {
+	return
+}
+
+func (ss stubStoreNil) CreateShare(_ *imgr.Share) (err error) {
+	return
+}
+
+func (ss stubStoreNil) LoadShare(_ *imgr.Share, _ string) (err error) {
+	return
+}
+
+func (ss stubStoreNil) UseShare(_ *imgr.Share, _ string) (err error) {
+	return
+}
+
+func (ss stubStoreNil) ReturnShareView(_ uint64) (err error) {
+	return
+}
+
+func (ss stubStoreNil) DeleteShare(_, _ uint64) (err error) {
+	return
+}
+
+func (ss stubStoreNil) CreateUploadSession(_ *imgr.UploadSession, _ *imgr.Quota) (err error) {
+	return
+}
+
+func (ss stubStoreNil) LoadUploadSession(_ *imgr.UploadSession) (err error) {
+	return
+}
+
+func (ss stubStoreNil) ClaimUploadSession(_ *imgr.UploadSession) (err error) {
+	return
+}
+
+func (ss stubStoreNil) ReleaseUploadSession(_ string, _ uint64) (err error) {
+	return
+}
+
+func (ss stubStoreNil) AppendUploadChunk(_ *imgr.UploadSession, _ string, _ int64) (err error) {
+	return
+}
+
+func (ss stubStoreNil) DeleteUploadSession(_ string, _ uint64) (err error) {
+	return
+}
+
+func (ss stubStoreNil) DeleteStaleUploadSession(_ string, _ time.Time) (err error) {
+	return
+}
+
+func (ss stubStoreNil) LoadStaleUploadSessions(_ *[]imgr.UploadSession, _ time.Time) (err error) {
+	return
+}
+
+// stubBlobStoreBroken is BlobStore that fails on every operation.
+type stubBlobStoreBroken struct{}
+
+func (stubBlobStoreBroken) Put(_ context.Context, _ string, _ io.Reader) error {
+	return errors.New("blob store error")
+}
+func (stubBlobStoreBroken) Get(_ context.Context, _ string) (io.ReadSeekCloser, error) {
+	return nil, errors.New("blob store error")
+}
+func (stubBlobStoreBroken) Delete(_ context.Context, _ string) error {
+	return errors.New("blob store error")
+}
+func (stubBlobStoreBroken) Stat(_ context.Context, _ string) (imgr.BlobInfo, error) {
+	return imgr.BlobInfo{}, errors.New("blob store error")
+}
+func (stubBlobStoreBroken) List(_ context.Context, _ string) ([]imgr.BlobInfo, error) {
+	return nil, errors.New("blob store error")
+}
+
+func newStubBlobStore(valid bool, blobs ...string) imgr.BlobStore {
+	if !valid {
+		return stubBlobStoreBroken{}
+	}
+	store := imgr.NewMemoryBlobStore()
+	for _, key := range blobs {
+		if err := store.Put(context.Background(), key, strings.NewReader(key+" content")); err != nil {
+			panic(err)
+		}
+	}
+	return store
+}
+
+func TestLocalImageServerPostImage(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	for _, ex := range examplesLocalImageServerPostImage {
+		options := []imgr.Option{imgr.WithLogger(log), imgr.WithBlobStore(newStubBlobStore(ex.blobStore))}
+		is, err := imgr.NewLocalImageServer(stubStoreNil(ex.storage), append(options, ex.options...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := generateRequest(t, ex.requestPost.file, ex.requestPost.context)
+		w := httptest.NewRecorder()
+
+		t.Run(ex.name, func(t *testing.T) {
+			is.PostImage(w, req)
+
+			// Check log message if there's expected one
+			if len(ex.want.logMessage) > 0 && assert.Equal(t, 1, len(hook.Entries), "Should have log entry") {
+				assert.Regexp(
+					t,
+					regexp.MustCompile(ex.want.logMessage),
+					hook.Entries[0].Message,
+					"Incorrect log entry message",
+				)
+			}
+
+			// Check response
+			assert.Equal(t, ex.want.statusCode, w.Result().StatusCode, "Incorrect response code")
+			b, err := ioutil.ReadAll(w.Result().Body)
+			w.Result().Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Regexp(t, ex.want.body, string(b), "Incorrect response body")
+
+			hook.Reset()
+		})
+	}
+}
+
+func TestLocalImageServerPostImageMetadata(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	storage := &stubStoreRecorder{stubStoreOwned: true}
+	blobs := newStubBlobStore(true)
+	is, err := imgr.NewLocalImageServer(storage, imgr.WithLogger(log), imgr.WithBlobStore(blobs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := generateRequest(t, fileValid, map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)})
+	w := httptest.NewRecorder()
+	is.PostImage(w, req)
+
+	if !assert.Equal(t, http.StatusCreated, w.Result().StatusCode, "Incorrect response code") ||
+		!assert.Equal(t, 1, len(storage.created), "Image record should be created") {
+		return
+	}
+	image := storage.created[0]
+	blob, err := blobs.Get(context.Background(), image.BlobKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	content, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+
+	assert.Regexp(t, "^[0-9A-Z]{26}image.png$", image.Filename, "Incorrect filename")
+	assert.Equal(t, "image.png", image.OriginalName, "Incorrect original name")
+	assert.Equal(t, "image/png", image.ContentType, "Incorrect content type")
+	assert.Equal(t, int64(len(content)), image.Size, "Incorrect size")
+	assert.Equal(t, 50, image.Width, "Incorrect width")
+	assert.Equal(t, 50, image.Height, "Incorrect height")
+	assert.Equal(t, hex.EncodeToString(sum[:]), image.SHA256, "Incorrect checksum")
+	assert.Equal(t, "content/"+image.SHA256, image.BlobKey, "Content should be stored by checksum")
+	assert.Equal(t, uint64(1), image.UserID, "Incorrect user")
+
+	// Created image should be returned
+	assert.Equal(t, "/images/"+image.Filename, w.Result().Header.Get("Location"), "Incorrect location")
+	var created map[string]interface{}
+	if err = json.NewDecoder(w.Result().Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]interface{}{
+		"id":            float64(1),
+		"filename":      image.Filename,
+		"url":           "/images/" + image.Filename,
+		"original_name": "image.png",
+		"content_type":  "image/png",
+		"size_bytes":    float64(image.Size),
+		"width":         float64(50),
+		"height":        float64(50),
+		"sha256":        image.SHA256,
+		"created_at":    "2018-04-04T00:00:00Z",
+	}, created, "Created image is not as expected")
+}
+
+func TestLocalImageServerPostImageDeduplication(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	storage := &stubStoreRecorder{stubStoreOwned: true}
+	blobs := newStubBlobStore(true)
+	is, err := imgr.NewLocalImageServer(storage, imgr.WithLogger(log), imgr.WithBlobStore(blobs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := goji.NewMux()
+	mux.HandleFunc(pat.Delete("/images/:filename"), is.DeleteImage)
+	ctx := map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)}
+
+	// The same content is uploaded twice
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		is.PostImage(w, generateRequest(t, fileValid, ctx))
+		assert.Equal(t, http.StatusCreated, w.Result().StatusCode, "Incorrect response code")
+	}
+	if !assert.Equal(t, 2, len(storage.created), "Image records should be created") {
+		return
+	}
+	assert.NotEqual(t, storage.created[0].Filename, storage.created[1].Filename, "Filenames should be unique")
+	assert.Equal(t, storage.created[0].BlobKey, storage.created[1].BlobKey, "Content should be shared")
+	stored, err := blobs.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Equal(t, 1, len(stored), "Content should be stored once") {
+		assert.Equal(t, storage.created[0].BlobKey, stored[0].Key, "Uploaded blobs should be removed")
+	}
+
+	// Content is removed with the last image
+	for i, created := range storage.created {
+		req, err := http.NewRequest("DELETE", "/images/"+created.Filename, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), util.RequestUserKey, stubUser(1))))
+		assert.Equal(t, http.StatusNoContent, w.Result().StatusCode, "Incorrect response code")
+
+		_, err = blobs.Stat(context.Background(), created.BlobKey)
+		if i == 0 {
+			assert.Nil(t, err, "Content referenced by other image should be kept")
+		} else {
+			assert.Equal(t, imgr.ErrBlobNotFound, err, "Unreferenced content should be removed")
+		}
+	}
+}
+
+func TestLocalImageServerPostImageQuota(t *testing.T) {
+	examples := []struct {
+		name       string
+		quota      imgr.Quota
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			"images", imgr.Quota{MaxImages: 1},
+			http.StatusTooManyRequests, `{"error":"Image count quota exceeded"}`,
+		},
+		{
+			"bytes", imgr.Quota{MaxBytes: 200},
+			http.StatusRequestEntityTooLarge, `{"error":"Storage quota exceeded"}`,
+		},
+	}
+	for _, ex := range examples {
+		t.Run(ex.name, func(t *testing.T) {
+			log, hook := test.NewNullLogger()
+			storage := &stubStoreRecorder{stubStoreOwned: true}
+			blobs := newStubBlobStore(true)
+			is, err := imgr.NewLocalImageServer(
+				storage, imgr.WithLogger(log), imgr.WithBlobStore(blobs), imgr.WithQuota(ex.quota),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)}
+
+			// The first image fits into quota
+			w := httptest.NewRecorder()
+			is.PostImage(w, generateRequest(t, fileValid, ctx))
+			assert.Equal(t, http.StatusCreated, w.Result().StatusCode, "Incorrect response code")
+
+			w = httptest.NewRecorder()
+			is.PostImage(w, generateRequest(t, fileValid, ctx))
+			assert.Equal(t, ex.wantStatus, w.Result().StatusCode, "Incorrect response code")
+			b, err := ioutil.ReadAll(w.Result().Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, ex.wantBody, string(b), "Incorrect response body")
+			if assert.Equal(t, 1, len(hook.Entries), "Should have log entry") {
+				assert.Equal(t, "quota of "+ex.name+" is exceeded", hook.Entries[0].Message, "Incorrect log entry")
+			}
+
+			assert.Equal(t, 1, len(storage.created), "Image over quota should not be created")
+			stored, err := blobs.List(context.Background(), "uploads/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Empty(t, stored, "Uploaded blob should be removed")
+		})
+	}
+}
+
+func TestLocalImageServerPostImageEXIF(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	storage := &stubStoreRecorder{stubStoreOwned: true}
+	blobs := newStubBlobStore(true)
+	is, err := imgr.NewLocalImageServer(storage, imgr.WithLogger(log), imgr.WithBlobStore(blobs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := generateRequest(t, fileEXIF, map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)})
+	w := httptest.NewRecorder()
+	is.PostImage(w, req)
+
+	if !assert.Equal(t, http.StatusCreated, w.Result().StatusCode, "Incorrect response code") ||
+		!assert.Equal(t, 1, len(storage.created), "Image record should be created") {
+		return
+	}
+	created := storage.created[0]
+	blob, err := blobs.Get(context.Background(), created.BlobKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	content, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+
+	assert.Equal(t, "image/jpeg", created.ContentType, "Incorrect content type")
+	assert.Equal(t, int64(len(content)), created.Size, "Incorrect size")
+	assert.Equal(t, hex.EncodeToString(sum[:]), created.SHA256, "Incorrect checksum")
+	assert.Equal(t, 20, created.Width, "Image should be rotated")
+	assert.Equal(t, 40, created.Height, "Image should be rotated")
+	if assert.NotNil(t, created.CapturedAt, "Capture time should be recorded") {
+		assert.Equal(t, time.Date(2018, 4, 1, 8, 20, 30, 0, time.UTC), *created.CapturedAt, "Incorrect capture time")
+	}
+
+	// Location, device and comment are removed, capture time is kept
+	for _, private := range []string{"Phone", "Secret comment", "N\x00\x00\x00"} {
+		assert.False(t, bytes.Contains(content, []byte(private)), "Private data should be removed")
+	}
+	assert.True(t, bytes.Contains(content, []byte("2018:04:01 10:20:30")), "Capture time should be kept")
+
+	stored, err := jpeg.Decode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, image.Rect(0, 0, 20, 40), stored.Bounds(), "Incorrect stored image size")
+	// Image is rotated clockwise, so left half of original is on top
+	r, _, b, _ := stored.At(10, 10).RGBA()
+	assert.True(t, r > b, "Top half should be red")
+	r, _, b, _ = stored.At(10, 30).RGBA()
+	assert.True(t, b > r, "Bottom half should be blue")
+
+	var response map[string]interface{}
+	if err = json.NewDecoder(w.Result().Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "2018-04-01T08:20:30Z", response["captured_at"], "Capture time should be returned")
+}
+
+func TestLocalImageServerPostImageDerivatives(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	storage := &stubStoreRecorder{stubStoreOwned: true}
+	blobs := newStubBlobStore(true)
+	is, err := imgr.NewLocalImageServer(
+		storage,
+		imgr.WithLogger(log),
+		imgr.WithBlobStore(blobs),
+		imgr.WithDerivatives(
+			imgr.Derivative{Name: "thumb", Width: 10, Height: 10, Fit: imgr.FitCover},
+			imgr.Derivative{Name: "medium", Width: 20, Fit: imgr.FitContain},
+		),
+		imgr.WithDerivativeWorkers(1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer is.Close()
+
+	req := generateRequest(t, fileValid, map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)})
+	w := httptest.NewRecorder()
+	is.PostImage(w, req)
+	if !assert.Equal(t, http.StatusCreated, w.Result().StatusCode, "Incorrect response code") {
+		return
+	}
+
+	// Derivatives are generated in background
+	want := map[string]string{"1/thumb": imgr.DerivativeReady, "1/medium": imgr.DerivativeReady}
+	for i := 0; i < 100 && !assert.ObjectsAreEqual(want, storage.derivativeStatuses()); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, want, storage.derivativeStatuses(), "Derivatives should be generated")
+
+	prefix := fmt.Sprintf("renditions/%d/", storage.created[0].ID)
+	for key, size := range map[string]int{
+		prefix + "10x10-cover-q0.png":  10,
+		prefix + "20x0-contain-q0.png": 20,
+	} {
+		blob, err := blobs.Get(context.Background(), key)
+		if !assert.Nil(t, err, "Derivative %s should be stored", key) {
+			continue
+		}
+		config, err := png.DecodeConfig(blob)
+		blob.Close()
+		assert.Nil(t, err, "Derivative should be valid image")
+		assert.Equal(t, size, config.Width, "Incorrect derivative width")
+	}
+}
+
+func TestLocalImageServerRetryDerivatives(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	// Derivatives are left pending by previous run, gone.png is deleted since then
+	storage := &stubStoreRecorder{
+		stubStoreOwned: true,
+		created: []imgr.Image{
+			{ID: 1, Filename: "gone.png", UserID: 1, ContentType: "image/png", BlobKey: "image2.png"},
+			{ID: 2, Filename: "image1.png", UserID: 1, ContentType: "image/png"},
+		},
+		deleted:     []string{"gone.png"},
+		derivatives: map[string]string{"1/thumb": imgr.DerivativePending, "2/thumb": imgr.DerivativePending},
+	}
+	blobs := newImageBlobStore(t)
+	is, err := imgr.NewLocalImageServer(
+		storage,
+		imgr.WithLogger(log),
+		imgr.WithBlobStore(blobs),
+		imgr.WithDerivatives(imgr.Derivative{Name: "thumb", Width: 10, Fit: imgr.FitContain}),
+		imgr.WithDerivativeWorkers(1),
+		imgr.WithDerivativeRetryDelay(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100 && storage.derivativeStatuses()["2/thumb"] != imgr.DerivativeReady; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = is.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, imgr.DerivativeReady, storage.derivativeStatuses()["2/thumb"], "Derivative should be generated")
+	assert.Equal(
+		t, imgr.DerivativePending, storage.derivativeStatuses()["1/thumb"],
+		"Derivative of deleted image shouldn't be generated",
+	)
+	keys, err := blobs.List(context.Background(), "renditions/1/")
+	assert.Nil(t, err, "Renditions should be listed")
+	assert.Empty(t, keys, "Renditions of deleted image shouldn't be stored")
+}
+
+func generateRequest(t *testing.T, fileType byte, contextVals map[util.RequestKey]interface{}) *http.Request {
+	var req *http.Request
+	var err error
+	if fileType == fileMissing {
+		// No file should be sent
+		req, err = http.NewRequest("POST", "", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		// Create file
+		var file *os.File
+		body := &bytes.Buffer{}
+		multi := multipart.NewWriter(body)
+		defer multi.Close()
+
+		// createFile defines file content based on a byte const fileType
+		file, err = os.Open(createFile(t, fileType))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		defer os.Remove(file.Name())
+
+		fileWriter, err := multi.CreateFormFile("image", file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = io.Copy(fileWriter, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err = http.NewRequest("POST", "", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", multi.FormDataContentType())
+	}
+
+	ctx := req.Context()
+	for k, v := range contextVals {
+		ctx = context.WithValue(ctx, k, v)
+	}
+
+	return req.WithContext(ctx)
+}
+
+func createFile(t *testing.T, kind byte) string {
+	filename := "image.png"
+	f, err := os.Create("image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	switch kind {
+	case fileNonImage:
+		_, err = f.WriteString("Text file content")
+	case fileBroken:
+		_, err = f.WriteString("a\xe0\xe5\xf0\xe9\xe1\xf8\xf1\xe9\xe8\xe4Z")
+	case fileMalformed:
+		_, err = f.WriteString("\x89PNG\r\n\x1a\nbroken header")
+	case fileValid:
+		img := image.NewRGBA(image.Rect(0, 0, 50, 50))
+		img.Set(10, 10, color.RGBA{255, 0, 0, 255})
+		err = png.Encode(f, img)
+	case fileGIF:
+		img := image.NewPaletted(image.Rect(0, 0, 20, 10), color.Palette{color.Black, color.White})
+		err = gif.Encode(f, img, nil)
+	case fileEXIF:
+		_, err = f.Write(exifJPEG(t))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+// exifJPEG returns 40x20 JPEG image with red left and blue right half, that is rotated by EXIF orientation,
+// taken at 2018-04-01 10:20:30 +02:00 by "Phone" with GPS location and having comment.
+func exifJPEG(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if x >= 20 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	encoded := &bytes.Buffer{}
+	if err := jpeg.Encode(encoded, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Little endian TIFF with IFD0 at 8, Exif IFD at 68 and GPS IFD at 126
+	tiff := &bytes.Buffer{}
+	write := func(values ...interface{}) {
+		for _, v := range values {
+			if err := binary.Write(tiff, binary.LittleEndian, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	tiff.WriteString("II*\x00")
+	write(uint32(8), uint16(4))
+	write(uint16(0x010F), uint16(2), uint32(6), uint32(62))
+	write(uint16(0x0112), uint16(3), uint32(1), uint16(6), uint16(0))
+	write(uint16(0x8769), uint16(4), uint32(1), uint32(68))
+	write(uint16(0x8825), uint16(4), uint32(1), uint32(126))
+	write(uint32(0))
+	tiff.WriteString("Phone\x00")
+	write(uint16(2))
+	write(uint16(0x9003), uint16(2), uint32(20), uint32(98))
+	write(uint16(0x9011), uint16(2), uint32(7), uint32(118))
+	write(uint32(0))
+	tiff.WriteString("2018:04:01 10:20:30\x00+02:00\x00\x00")
+	write(uint16(1))
+	write(uint16(0x0001), uint16(2), uint32(2), []byte("N\x00\x00\x00"))
+	write(uint32(0))
+
+	segments := &bytes.Buffer{}
+	for _, segment := range []struct {
+		marker  byte
+		payload string
+	}{{0xE1, "Exif\x00\x00" + tiff.String()}, {0xFE, "Secret comment"}} {
+		segments.Write([]byte{0xFF, segment.marker})
+		if err := binary.Write(segments, binary.BigEndian, uint16(len(segment.payload)+2)); err != nil {
+			t.Fatal(err)
+		}
+		segments.WriteString(segment.payload)
+	}
+	return append(append([]byte{0xFF, 0xD8}, segments.Bytes()...), encoded.Bytes()[2:]...)
+}
+
+type stubStoreSlice bool
+
+func (ss stubStoreSlice) CreateImage(_ *imgr.Image, _ *imgr.Quota) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) CreateImages(images []*imgr.Image, quota *imgr.Quota) ([]error, error) {
+	errs := make([]error, len(images))
+	for i, img := range images {
+		errs[i] = ss.CreateImage(img, quota)
+	}
+	return errs, nil
+}
+
+func (ss stubStoreSlice) LoadImage(_ *imgr.Image) (err error) {
+	return
+}
+
+// LoadImages selects from filename1, filename2, filename3 images of user 1 according to query,
+// IDs of images are their positions in selection.
+func (ss stubStoreSlice) LoadImages(in *[]imgr.Image, query imgr.ImageQuery) (err error) {
+	if !ss {
+		return errors.New("storage error")
+	}
+	images := make([]imgr.Image, 0)
+	for i, filename := range []string{"filename1", "filename2", "filename3"} {
+		if (query.After == nil || filename > query.After.Filename) && stubTagged(uint64(i+1), query) {
+			images = append(images, imgr.Image{ID: uint64(i + 1), Filename: filename, UserID: 1})
+		}
+	}
+	if query.Offset > uint64(len(images)) {
+		query.Offset = uint64(len(images))
+	}
+	images = images[query.Offset:]
+	if query.Limit > 0 && query.Limit < uint64(len(images)) {
+		images = images[:query.Limit]
+	}
+	*in = images
+	return nil
+}
+
+func (ss stubStoreSlice) CountImages(count *uint64, _ imgr.ImageQuery) (err error) {
+	*count = 3
+	return
+}
+
+func (ss stubStoreSlice) UpdateImageDetails(_ *imgr.Image) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) DeleteImage(_ string, _ uint64, _ func(string) error) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) CreateDerivatives(_ uint64, _ []string) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) UpdateDerivative(_ *imgr.ImageDerivative) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) LoadUnfinishedDerivatives(_ *[]imgr.PendingDerivative, _ []string, _ time.Time, _ int) error {
+	return nil
+}
+
+// stubTags are tags of images listed by stubStoreSlice.
+var stubTags = map[uint64][]string{1: {"cats"}, 2: {"cats", "outdoor"}}
+
+// stubTagged reports if image with given ID matches tags of query.
+func stubTagged(id uint64, query imgr.ImageQuery) bool {
+	matched := 0
+	for _, tag := range query.Tags {
+		for _, imageTag := range stubTags[id] {
+			if tag == imageTag {
+				matched++
+			}
+		}
+	}
+	return matched == len(query.Tags) || query.AnyTag && matched > 0
+}
+
+// LoadDerivatives returns ready thumb derivative of image 1 and pending thumb derivative of image 2.
+func (ss stubStoreSlice) LoadDerivatives(in *[]imgr.ImageDerivative, _ []uint64) (err error) {
+	*in = []imgr.ImageDerivative{
+		{ImageID: 1, Name: "thumb", Status: imgr.DerivativeReady},
+		{ImageID: 2, Name: "thumb", Status: imgr.DerivativePending},
+	}
+	return
+}
+
+func (ss stubStoreSlice) LoadUsage(_ *imgr.Usage, _ imgr.Quota) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) CreateAlbum(_ *imgr.Album) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) LoadAlbum(_ *imgr.Album) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) LoadAlbums(_ *[]imgr.Album, _ uint64) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) RenameAlbum(_ *imgr.Album) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) DeleteAlbum(_, _ uint64) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) AddAlbumImage(_, _ uint64) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) RemoveAlbumImage(_, _ uint64) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) SetImageTags(_ uint64, _ []string) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) LoadImageTags(in *[]imgr.ImageTag, imageIDs []uint64) (err error) {
+	for _, id := range imageIDs {
+		for _, tag := range stubTags[id] {
+			*in = append(*in, imgr.ImageTag{ImageID: id, Tag: tag})
+		}
+	}
+	return
+}
+
+func (ss stubStoreSlice) LoadTagCounts(_ *[]imgr.TagCount, _ uint64) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) CreateShare(_ *imgr.Share) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) LoadShare(_ *imgr.Share, _ string) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) UseShare(_ *imgr.Share, _ string) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) ReturnShareView(_ uint64) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) DeleteShare(_, _ uint64) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) CreateUploadSession(_ *imgr.UploadSession, _ *imgr.Quota) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) LoadUploadSession(_ *imgr.UploadSession) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) ClaimUploadSession(_ *imgr.UploadSession) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) ReleaseUploadSession(_ string, _ uint64) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) AppendUploadChunk(_ *imgr.UploadSession, _ string, _ int64) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) DeleteUploadSession(_ string, _ uint64) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) DeleteStaleUploadSession(_ string, _ time.Time) (err error) {
+	return
+}
+
+func (ss stubStoreSlice) LoadStaleUploadSessions(_ *[]imgr.UploadSession, _ time.Time) (err error) {
+	return
+}
+
+func TestLocalImageServerListImages(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	for _, ex := range examplesLocalImageServerListImages {
+		is, err := imgr.NewLocalImageServer(
+			stubStoreSlice(ex.storage),
+			imgr.WithLogger(log),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		params := url.Values{}
+		params.Set("limit", fmt.Sprint(ex.requestList.limit))
+		params.Set("offset", fmt.Sprint(ex.requestList.offset))
+		if ex.requestList.cursor != "" {
+			params.Set("cursor", ex.requestList.cursor)
+		}
+		for k, v := range ex.requestList.filters {
+			params.Set(k, v)
+		}
+		for _, tag := range ex.requestList.tags {
+			params.Add("tag", tag)
+		}
+		req, err := http.NewRequest("GET", "/images?"+params.Encode(), http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := req.Context()
+		for k, v := range ex.requestList.context {
+			ctx = context.WithValue(ctx, k, v)
+		}
+
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
+
+		t.Run(ex.name, func(t *testing.T) {
+			is.ListImages(w, req)
+
+			// Check log message if there's expected one
+			if len(ex.want.logMessage) > 0 && assert.Equal(t, 1, len(hook.Entries), "Should have log entry") {
+				assert.Regexp(
+					t,
+					regexp.MustCompile(ex.want.logMessage),
+					hook.Entries[0].Message,
+					"Incorrect log entry message",
+				)
+			}
+
+			// Check response
+			assert.Equal(t, ex.want.statusCode, w.Result().StatusCode, "Incorrect response code")
+			b, err := ioutil.ReadAll(w.Result().Body)
+			w.Result().Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Empty expected body signals for correct json to be expected as body
+			if len(ex.want.body) > 0 {
+				assert.Regexp(t, ex.want.body, string(b), "Incorrect response body")
+			} else {
+				list := struct {
+					Items []imgr.Image `json:"items"`
+				}{}
+				err = json.Unmarshal(b, &list)
+				assert.Nil(t, err, "Response body should be valid json")
+				assert.NotNil(t, list.Items, "Response body should contain images")
+			}
+
+			hook.Reset()
+		})
+	}
+}
+
+// stubStoreOwned has image1.png, image3.png, image4.png owned by user 1 and image2.png owned by user 2.
+type stubStoreOwned bool
+
+func (ss stubStoreOwned) CreateImage(_ *imgr.Image, _ *imgr.Quota) (err error) {
+	return
+}
+
+func (ss stubStoreOwned) CreateImages(images []*imgr.Image, quota *imgr.Quota) ([]error, error) {
+	errs := make([]error, len(images))
+	for i, img := range images {
+		errs[i] = ss.CreateImage(img, quota)
+	}
+	return errs, nil
+}
+
+func (ss stubStoreOwned) LoadImage(img *imgr.Image) (err error) {
+	if !ss {
+		return errors.New("storage error")
+	}
+	owners := map[string]uint64{"image1.png": 1, "image2.png": 2, "image3.png": 1, "image4.png": 1}
+	if owner, ok := owners[img.Filename]; !ok || owner != img.UserID {
+		return sql.ErrNoRows
+	}
+	// Images are numbered by their filenames and have checksums of stub blob content
+	img.ID = uint64(img.Filename[5] - '0')
+	img.SHA256 = fmt.Sprintf("%x", sha256.Sum256([]byte(img.Filename+" content")))
+	return
+}
+
+func (ss stubStoreOwned) LoadImages(_ *[]imgr.Image, _ imgr.ImageQuery) (err error) {
+	return
+}
+
+func (ss stubStoreOwned) CountImages(_ *uint64, _ imgr.ImageQuery) (err error) {
+	return
+}
+
+// UpdateImageDetails treats image3.png as modified concurrently, other images are updated from version 0.
+func (ss stubStoreOwned) UpdateImageDetails(img *imgr.Image) (err error) {
+	if img.Filename == "image3.png" {
+		return sql.ErrNoRows
+	}
+	img.Version++
+	img.CreatedAt = time.Date(2018, 4, 4, 0, 0, 0, 0, time.UTC)
+	return
+}
+
+// DeleteImage treats every blob as unreferenced, images own blobs stored under their filenames.
+func (ss stubStoreOwned) DeleteImage(filename string, userID uint64, remove func(string) error) (err error) {
+	if err = ss.LoadImage(&imgr.Image{Filename: filename, UserID: userID}); err != nil {
+		return
+	}
+	return remove(filename)
+}
+
+func (ss stubStoreOwned) CreateDerivatives(_ uint64, _ []string) (err error) {
+	return
+}
+
+func (ss stubStoreOwned) UpdateDerivative(_ *imgr.ImageDerivative) (err error) {
+	return
+}
+
+func (ss stubStoreOwned) LoadDerivatives(_ *[]imgr.ImageDerivative, _ []uint64) (err error) {
+	return
+}
+
+func (ss stubStoreOwned) LoadUnfinishedDerivatives(_ *[]imgr.PendingDerivative, _ []string, _ time.Time, _ int) error {
+	return nil
+}
+
+// LoadUsage returns usage of 3 images of 2048 bytes with quota overridden for user 2.
+func (ss stubStoreOwned) LoadUsage(usage *imgr.Usage, quota imgr.Quota) (err error) {
+	if !ss {
+		return errors.New("storage error")
+	}
+	usage.UsedBytes, usage.UsedImages = 2048, 3
+	usage.MaxBytes, usage.MaxImages = quota.MaxBytes, quota.MaxImages
+	if usage.UserID == 2 {
+		usage.MaxBytes = 1 << 20
+	}
+	return
+}
+
+// CreateAlbum creates album 3, name Taken is already used.
+func (ss stubStoreOwned) CreateAlbum(album *imgr.Album) (err error) {
+	if !ss {
+		return errors.New("storage error")
+	}
+	if album.Name == "Taken" {
+		return imgr.ErrUniqueIndexConflict("albums")
+	}
+	album.ID = 3
+	album.CreatedAt = time.Date(2018, 4, 4, 0, 0, 0, 0, time.UTC)
+	return
+}
+
+// LoadAlbum loads album 1 of user 1 and album 2 of user 2.
+func (ss stubStoreOwned) LoadAlbum(album *imgr.Album) (err error) {
+	if !ss {
+		return errors.New("storage error")
+	}
+	names := map[uint64]string{1: "Holidays", 2: "Pets"}
+	name, ok := names[album.ID]
+	if !ok || album.ID != album.UserID {
+		return sql.ErrNoRows
+	}
+	album.Name = name
+	album.CreatedAt = time.Date(2018, 4, 4, 0, 0, 0, 0, time.UTC)
+	return
+}
+
+func (ss stubStoreOwned) LoadAlbums(albums *[]imgr.Album, userID uint64) (err error) {
+	album := imgr.Album{ID: userID, UserID: userID}
+	if err = ss.LoadAlbum(&album); err == nil {
+		*albums = append(*albums, album)
+	}
+	return
+}
+
+func (ss stubStoreOwned) RenameAlbum(album *imgr.Album) (err error) {
+	if album.Name == "Taken" {
+		return imgr.ErrUniqueIndexConflict("albums")
+	}
+	return ss.LoadAlbum(&imgr.Album{ID: album.ID, UserID: album.UserID})
+}
+
+func (ss stubStoreOwned) DeleteAlbum(id, userID uint64) (err error) {
+	return ss.LoadAlbum(&imgr.Album{ID: id, UserID: userID})
+}
+
+func (ss stubStoreOwned) AddAlbumImage(_, _ uint64) (err error) {
+	return
+}
+
+// RemoveAlbumImage removes images from album, except image3.png that isn't in album.
+func (ss stubStoreOwned) RemoveAlbumImage(_, imageID uint64) (err error) {
+	if imageID == 3 {
+		return sql.ErrNoRows
+	}
+	return
+}
+
+func (ss stubStoreOwned) SetImageTags(_ uint64, _ []string) (err error) {
+	if !ss {
+		return errors.New("storage error")
+	}
+	return
+}
+
+func (ss stubStoreOwned) LoadImageTags(_ *[]imgr.ImageTag, _ []uint64) (err error) {
+	return
+}
+
+// LoadTagCounts returns tags of user 1.
+func (ss stubStoreOwned) LoadTagCounts(counts *[]imgr.TagCount, userID uint64) (err error) {
+	if !ss {
+		return errors.New("storage error")
+	}
+	if userID == 1 {
+		*counts = append(*counts, imgr.TagCount{Tag: "cats", Count: 2}, imgr.TagCount{Tag: "outdoor", Count: 1})
+	}
+	return
+}
+
+// CreateShare numbers shares by their max views, so share without views limit is share 1.
+func (ss stubStoreOwned) CreateShare(share *imgr.Share) (err error) {
+	if !ss {
+		return errors.New("storage error")
+	}
+	share.ID = uint64(share.MaxViews) + 1
+	return
+}
+
+// LoadShare loads share the same way as UseShare does.
+func (ss stubStoreOwned) LoadShare(share *imgr.Share, filename string) (err error) {
+	return ss.UseShare(share, filename)
+}
+
+func (ss stubStoreOwned) ReturnShareView(_ uint64) (err error) {
+	return
+}
+
+// UseShare allows views of image1.png of user 1 by share 1, other shares are used up.
+func (ss stubStoreOwned) UseShare(share *imgr.Share, filename string) (err error) {
+	if !ss {
+		return errors.New("storage error")
+	}
+	if share.ID != 1 || filename != "image1.png" {
+		return sql.ErrNoRows
+	}
+	share.ImageID, share.UserID = 1, 1
+	return
+}
+
+// DeleteShare revokes share 1 of image 1.
+func (ss stubStoreOwned) DeleteShare(id, imageID uint64) (err error) {
+	if id != 1 || imageID != 1 {
+		return sql.ErrNoRows
+	}
+	return
+}
+
+// CreateUploadSession fails for broken storage, stubStoreOwned has no upload sessions.
+func (ss stubStoreOwned) CreateUploadSession(_ *imgr.UploadSession, _ *imgr.Quota) (err error) {
+	if !ss {
+		return errors.New("storage error")
+	}
+	return
+}
+
+func (ss stubStoreOwned) LoadUploadSession(_ *imgr.UploadSession) (err error) {
+	if !ss {
+		return errors.New("storage error")
+	}
+	return sql.ErrNoRows
+}
+
+func (ss stubStoreOwned) ClaimUploadSession(_ *imgr.UploadSession) (err error) {
+	return sql.ErrNoRows
+}
+
+func (ss stubStoreOwned) ReleaseUploadSession(_ string, _ uint64) (err error) {
+	return sql.ErrNoRows
+}
+
+func (ss stubStoreOwned) AppendUploadChunk(_ *imgr.UploadSession, _ string, _ int64) (err error) {
+	return sql.ErrNoRows
+}
+
+func (ss stubStoreOwned) DeleteUploadSession(_ string, _ uint64) (err error) {
+	return sql.ErrNoRows
+}
+
+func (ss stubStoreOwned) DeleteStaleUploadSession(_ string, _ time.Time) (err error) {
+	return sql.ErrNoRows
+}
+
+func (ss stubStoreOwned) LoadStaleUploadSessions(_ *[]imgr.UploadSession, _ time.Time) (err error) {
+	return
+}
+
+// stubStoreRecorder is stubStoreOwned that keeps track of deleted and created images and derivative statuses.
+type stubStoreRecorder struct {
+	stubStoreOwned
+	created []imgr.Image
+	deleted []string
+	refs    map[string]int
+	views   int64
+
+	mu          sync.Mutex
+	derivatives map[string]string
+}
+
+func (ss *stubStoreRecorder) CreateDerivatives(imageID uint64, names []string) (err error) {
+	for _, name := range names {
+		err = ss.UpdateDerivative(&imgr.ImageDerivative{ImageID: imageID, Name: name, Status: imgr.DerivativePending})
+	}
+	return
+}
+
+func (ss *stubStoreRecorder) UpdateDerivative(derivative *imgr.ImageDerivative) (err error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.derivatives == nil {
+		ss.derivatives = make(map[string]string)
+	}
+	ss.derivatives[fmt.Sprintf("%d/%s", derivative.ImageID, derivative.Name)] = derivative.Status
+	return
+}
+
+// UseShare counts views of shares allowed by stubStoreOwned.
+func (ss *stubStoreRecorder) UseShare(share *imgr.Share, filename string) (err error) {
+	if err = ss.stubStoreOwned.UseShare(share, filename); err == nil {
+		ss.views++
+	}
+	return
+}
+
+func (ss *stubStoreRecorder) ReturnShareView(_ uint64) (err error) {
+	ss.views--
+	return
+}
+
+// derivativeStatuses returns copy of recorded derivative statuses.
+func (ss *stubStoreRecorder) derivativeStatuses() map[string]string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	statuses := make(map[string]string)
+	for k, v := range ss.derivatives {
+		statuses[k] = v
+	}
+	return statuses
+}
+
+func (ss *stubStoreRecorder) CreateImage(img *imgr.Image, quota *imgr.Quota) (err error) {
+	// Quota is checked the same way as DB.CreateImage does
+	usage := imgr.Usage{UsedBytes: img.Size, UsedImages: 1}
+	for _, created := range ss.created {
+		if created.UserID == img.UserID {
+			usage.UsedBytes += created.Size
+			usage.UsedImages++
+		}
+	}
+	if quota != nil {
+		if quota.MaxBytes > 0 && usage.UsedBytes > quota.MaxBytes {
+			return imgr.QuotaBytes
+		}
+		if quota.MaxImages > 0 && usage.UsedImages > quota.MaxImages {
+			return imgr.QuotaImages
+		}
+	}
+
+	// Generated fields are set the same way as DB.CreateImage does
+	img.ID = uint64(len(ss.created) + 1)
+	img.CreatedAt = time.Date(2018, 4, 4, 0, 0, 0, 0, time.UTC)
+	ss.created = append(ss.created, *img)
+	if ss.refs == nil {
+		ss.refs = make(map[string]int)
+	}
+	ss.refs[img.BlobKey]++
+	return
+}
+
+func (ss *stubStoreRecorder) CreateImages(images []*imgr.Image, quota *imgr.Quota) ([]error, error) {
+	errs := make([]error, len(images))
+	for i, img := range images {
+		errs[i] = ss.CreateImage(img, quota)
+	}
+	return errs, nil
+}
+
+// LoadUnfinishedDerivatives returns pending and failed derivatives of created images in order of their creation.
+func (ss *stubStoreRecorder) LoadUnfinishedDerivatives(
+	pending *[]imgr.PendingDerivative, names []string, _ time.Time, limit int,
+) (err error) {
+	statuses := ss.derivativeStatuses()
+	for _, created := range ss.created {
+		for _, name := range names {
+			status := statuses[fmt.Sprintf("%d/%s", created.ID, name)]
+			if len(*pending) < limit && (status == imgr.DerivativePending || status == imgr.DerivativeFailed) {
+				*pending = append(*pending, imgr.PendingDerivative{Image: created, Name: name})
+			}
+		}
+	}
+	return
+}
+
+// LoadImage loads created images that aren't deleted, other images are loaded as stubStoreOwned does.
+func (ss *stubStoreRecorder) LoadImage(img *imgr.Image) (err error) {
+	for _, filename := range ss.deleted {
+		if filename == img.Filename {
+			return sql.ErrNoRows
+		}
+	}
+	for _, created := range ss.created {
+		if created.Filename == img.Filename && created.UserID == img.UserID {
+			*img = created
+			return
+		}
+	}
+	return ss.stubStoreOwned.LoadImage(img)
+}
+
+// DeleteImage removes blob of image once it isn't referenced, image is kept when blob can't be removed
+// the same way as DB.DeleteImage does.
+func (ss *stubStoreRecorder) DeleteImage(filename string, userID uint64, remove func(string) error) (err error) {
+	image := &imgr.Image{Filename: filename, UserID: userID}
+	if err = ss.LoadImage(image); err != nil {
+		return
+	}
+	if image.BlobKey == "" {
+		err = remove(image.Filename)
+	} else if ss.refs[image.BlobKey] <= 1 {
+		err = remove(image.BlobKey)
+	}
+	if err != nil {
+		return
+	}
+	if image.BlobKey != "" {
+		ss.refs[image.BlobKey]--
+	}
+	ss.deleted = append(ss.deleted, filename)
+	return
+}
+
+// stubStoreSessions is stubStoreRecorder that keeps upload sessions in memory the same way as DB does.
+type stubStoreSessions struct {
+	stubStoreRecorder
+	sessionsMu sync.Mutex
+	sessions   map[string]imgr.UploadSession
+}
+
+// CreateUploadSession reserves session in usage of user and limits number of sessions the same way as DB does.
+func (ss *stubStoreSessions) CreateUploadSession(session *imgr.UploadSession, quota *imgr.Quota) (err error) {
+	ss.sessionsMu.Lock()
+	defer ss.sessionsMu.Unlock()
+	if ss.sessions == nil {
+		ss.sessions = make(map[string]imgr.UploadSession)
+	}
+	usage := imgr.Usage{UsedBytes: session.Length, UsedImages: 1}
+	sessions := 0
+	for _, stored := range ss.sessions {
+		if stored.UserID == session.UserID {
+			usage.UsedBytes += stored.Length
+			usage.UsedImages++
+			sessions++
+		}
+	}
+	for _, created := range ss.created {
+		if created.UserID == session.UserID {
+			usage.UsedBytes += created.Size
+			usage.UsedImages++
+		}
+	}
+	if sessions >= imgr.MaxUploadSessions {
+		return imgr.ErrTooManyUploads
+	}
+	if quota != nil {
+		if quota.MaxBytes > 0 && usage.UsedBytes > quota.MaxBytes {
+			return imgr.QuotaBytes
+		}
+		if quota.MaxImages > 0 && usage.UsedImages > quota.MaxImages {
+			return imgr.QuotaImages
+		}
+	}
+	if session.UpdatedAt.IsZero() {
+		session.CreatedAt, session.UpdatedAt = time.Now(), time.Now()
+	}
+	ss.sessions[session.ID] = *session
+	return
+}
+
+func (ss *stubStoreSessions) LoadUploadSession(session *imgr.UploadSession) (err error) {
+	ss.sessionsMu.Lock()
+	defer ss.sessionsMu.Unlock()
+	stored, ok := ss.sessions[session.ID]
+	if !ok || stored.UserID != session.UserID {
+		return sql.ErrNoRows
+	}
+	*session = stored
+	return
+}
+
+func (ss *stubStoreSessions) ClaimUploadSession(session *imgr.UploadSession) (err error) {
+	ss.sessionsMu.Lock()
+	defer ss.sessionsMu.Unlock()
+	stored, ok := ss.sessions[session.ID]
+	if !ok || stored.UserID != session.UserID || stored.Finalizing {
+		return sql.ErrNoRows
+	}
+	stored.Finalizing = true
+	stored.UpdatedAt = time.Now()
+	ss.sessions[session.ID] = stored
+	*session = stored
+	return
+}
+
+func (ss *stubStoreSessions) ReleaseUploadSession(id string, userID uint64) (err error) {
+	ss.sessionsMu.Lock()
+	defer ss.sessionsMu.Unlock()
+	stored, ok := ss.sessions[id]
+	if !ok || stored.UserID != userID {
+		return sql.ErrNoRows
+	}
+	stored.Finalizing = false
+	stored.UpdatedAt = time.Now()
+	ss.sessions[id] = stored
+	return
+}
+
+func (ss *stubStoreSessions) AppendUploadChunk(session *imgr.UploadSession, key string, size int64) (err error) {
+	ss.sessionsMu.Lock()
+	defer ss.sessionsMu.Unlock()
+	stored, ok := ss.sessions[session.ID]
+	if !ok || stored.UserID != session.UserID || stored.Offset != session.Offset || stored.Finalizing {
+		return sql.ErrNoRows
+	}
+	stored.Offset += size
+	stored.Chunks = append(stored.Chunks, key)
+	stored.UpdatedAt = time.Now()
+	ss.sessions[session.ID] = stored
+	*session = stored
+	return
+}
+
+func (ss *stubStoreSessions) DeleteUploadSession(id string, userID uint64) (err error) {
+	ss.sessionsMu.Lock()
+	defer ss.sessionsMu.Unlock()
+	if stored, ok := ss.sessions[id]; !ok || stored.UserID != userID {
+		return sql.ErrNoRows
+	}
+	delete(ss.sessions, id)
+	return
+}
+
+func (ss *stubStoreSessions) DeleteStaleUploadSession(id string, before time.Time) (err error) {
+	ss.sessionsMu.Lock()
+	defer ss.sessionsMu.Unlock()
+	if stored, ok := ss.sessions[id]; !ok || !stored.UpdatedAt.Before(before) || stored.Finalizing {
+		return sql.ErrNoRows
+	}
+	delete(ss.sessions, id)
+	return
+}
+
+func (ss *stubStoreSessions) LoadStaleUploadSessions(sessions *[]imgr.UploadSession, before time.Time) (err error) {
+	ss.sessionsMu.Lock()
+	defer ss.sessionsMu.Unlock()
+	for _, stored := range ss.sessions {
+		if stored.UpdatedAt.Before(before) && !stored.Finalizing {
+			*sessions = append(*sessions, stored)
+		}
+	}
+	return
+}
+
+func TestLocalImageServerListImagesCursor(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	is, err := imgr.NewLocalImageServer(stubStoreSlice(true), imgr.WithLogger(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filenames := make([]string, 0)
+	pages := 0
+	cursor := ""
+	for {
+		req, err := http.NewRequest("GET", "/images?limit=2&cursor="+url.QueryEscape(cursor), http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), util.RequestUserKey, stubUser(1)))
+		w := httptest.NewRecorder()
+		is.ListImages(w, req)
+		if !assert.Equal(t, http.StatusOK, w.Result().StatusCode, "Incorrect response code") || pages > 3 {
+			return
+		}
+
+		list := struct {
+			Items      []imgr.Image `json:"items"`
+			NextCursor string       `json:"next_cursor"`
+		}{}
+		if err = json.NewDecoder(w.Result().Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for _, image := range list.Items {
+			filenames = append(filenames, image.Filename)
+		}
+		if list.NextCursor == "" {
+			break
+		}
+		cursor = list.NextCursor
+	}
+	assert.Equal(t, 2, pages, "Images should be listed in two pages")
+	assert.Equal(t, []string{"filename1", "filename2", "filename3"}, filenames, "Listed images are not as expected")
+}
+
+func TestLocalImageServerListImagesVariants(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	is, err := imgr.NewLocalImageServer(
+		stubStoreSlice(true),
+		imgr.WithLogger(log),
+		imgr.WithDerivatives(imgr.Derivative{Name: "thumb", Width: 128, Height: 128, Fit: imgr.FitCover}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "/images", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), util.RequestUserKey, stubUser(1)))
+	w := httptest.NewRecorder()
+	is.ListImages(w, req)
+	if !assert.Equal(t, http.StatusOK, w.Result().StatusCode, "Incorrect response code") {
+		return
+	}
+
+	list := struct {
+		Items []imgr.Image `json:"items"`
+	}{}
+	if err = json.NewDecoder(w.Result().Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if assert.Equal(t, 3, len(list.Items), "Incorrect items count") {
+		assert.Equal(
+			t,
+			map[string]string{"thumb": "/images/filename1/thumbnail?fit=cover&h=128&w=128"},
+			list.Items[0].Variants,
+			"Ready variant should be listed",
+		)
+		assert.Nil(t, list.Items[1].Variants, "Pending variant should not be listed")
+	}
+}
+
+func TestLocalImageServerListImagesEnvelope(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	is, err := imgr.NewLocalImageServer(stubStoreSlice(true), imgr.WithLogger(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "/images?limit=1&offset=1&sort=filename", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), util.RequestUserKey, stubUser(1)))
+	w := httptest.NewRecorder()
+	is.ListImages(w, req)
+	if !assert.Equal(t, http.StatusOK, w.Result().StatusCode, "Incorrect response code") {
+		return
+	}
+
+	list := struct {
+		Items      []imgr.Image `json:"items"`
+		Total      uint64       `json:"total"`
+		Limit      uint64       `json:"limit"`
+		Offset     uint64       `json:"offset"`
+		NextCursor string       `json:"next_cursor"`
+	}{}
+	if err = json.NewDecoder(w.Result().Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(list.Items), "Incorrect items count")
+	assert.Equal(t, uint64(3), list.Total, "Incorrect total")
+	assert.Equal(t, uint64(1), list.Limit, "Incorrect limit")
+	assert.Equal(t, uint64(1), list.Offset, "Incorrect offset")
+	assert.NotEmpty(t, list.NextCursor, "Next cursor should be present")
+
+	assert.Equal(t, []string{
+		`</images?cursor=` + list.NextCursor + `&limit=1&sort=filename>; rel="next"`,
+		`</images?limit=1&offset=0&sort=filename>; rel="prev"`,
+	}, w.Result().Header["Link"], "Incorrect links")
+}
+
+func TestLocalImageServerGetImage(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	blobs := newStubBlobStore(true, "image1.png", "image2.png")
+
+	for _, ex := range examplesLocalImageServerGetImage {
+		is, err := imgr.NewLocalImageServer(
+			stubStoreOwned(ex.storage),
+			imgr.WithLogger(log),
+			imgr.WithBlobStore(blobs),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux := goji.NewMux()
+		mux.HandleFunc(pat.Get("/images/:filename"), is.GetImage)
+
+		req, err := http.NewRequest("GET", "/images/"+ex.requestGet.filename, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range ex.requestGet.headers {
+			req.Header.Set(k, v)
+		}
+		ctx := req.Context()
+		for k, v := range ex.requestGet.context {
+			ctx = context.WithValue(ctx, k, v)
+		}
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
+
+		t.Run(ex.name, func(t *testing.T) {
+			mux.ServeHTTP(w, req)
+
+			// Check log message if there's expected one
+			if len(ex.want.logMessage) > 0 && assert.Equal(t, 1, len(hook.Entries), "Should have log entry") {
+				assert.Regexp(
+					t,
+					regexp.MustCompile(ex.want.logMessage),
+					hook.Entries[0].Message,
+					"Incorrect log entry message",
+				)
+			}
+
+			// Check response
+			assert.Equal(t, ex.want.statusCode, w.Result().StatusCode, "Incorrect response code")
+			b, err := ioutil.ReadAll(w.Result().Body)
+			w.Result().Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, ex.want.body, string(b), "Incorrect response body")
+
+			hook.Reset()
+		})
+	}
+}
+
+func TestLocalImageServerGetUsage(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	for _, ex := range examplesLocalImageServerGetUsage {
+		is, err := imgr.NewLocalImageServer(
+			stubStoreOwned(ex.storage),
+			imgr.WithLogger(log),
+			imgr.WithQuota(imgr.Quota{MaxBytes: 4096, MaxImages: 10}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("GET", "/images/usage", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := req.Context()
+		for k, v := range ex.requestGet.context {
+			ctx = context.WithValue(ctx, k, v)
+		}
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
+
+		t.Run(ex.name, func(t *testing.T) {
+			is.GetUsage(w, req)
+
+			// Check log message if there's expected one
+			if len(ex.want.logMessage) > 0 && assert.Equal(t, 1, len(hook.Entries), "Should have log entry") {
+				assert.Regexp(
+					t,
+					regexp.MustCompile(ex.want.logMessage),
+					hook.Entries[0].Message,
+					"Incorrect log entry message",
+				)
+			}
+
+			// Check response
+			assert.Equal(t, ex.want.statusCode, w.Result().StatusCode, "Incorrect response code")
+			b, err := ioutil.ReadAll(w.Result().Body)
+			w.Result().Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, ex.want.body, string(b), "Incorrect response body")
+
+			hook.Reset()
+		})
+	}
+}
+
+// newImageBlobStore returns blob store with image1.png and image2.png 40x20 PNG images and given stub blobs.
+func newImageBlobStore(t *testing.T, blobs ...string) imgr.BlobStore {
+	store := newStubBlobStore(true, blobs...)
+	for _, key := range []string{"image1.png", "image2.png"} {
+		buf := &bytes.Buffer{}
+		if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 40, 20))); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Put(context.Background(), key, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestLocalImageServerGetImageConversion(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	for _, ex := range examplesLocalImageServerGetImageConversion {
+		is, err := imgr.NewLocalImageServer(
+			stubStoreOwned(true),
+			imgr.WithLogger(log),
+			imgr.WithBlobStore(newImageBlobStore(t)),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux := goji.NewMux()
+		mux.HandleFunc(pat.Get("/images/:filename"), is.GetImage)
+
+		req, err := http.NewRequest("GET", "/images/image1.png?"+ex.query, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range ex.requestGet.headers {
+			req.Header.Set(k, v)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), util.RequestUserKey, stubUser(1)))
+		w := httptest.NewRecorder()
+
+		t.Run(ex.name, func(t *testing.T) {
+			mux.ServeHTTP(w, req)
+
+			// Check log message if there's expected one
+			if len(ex.want.logMessage) > 0 && assert.Equal(t, 1, len(hook.Entries), "Should have log entry") {
+				assert.Regexp(
+					t,
+					regexp.MustCompile(ex.want.logMessage),
+					hook.Entries[0].Message,
+					"Incorrect log entry message",
+				)
+			}
+
+			// Check response
+			assert.Equal(t, ex.want.statusCode, w.Result().StatusCode, "Incorrect response code")
+			assert.Equal(t, "Accept", w.Result().Header.Get("Vary"), "Response should vary by Accept header")
+			b, err := ioutil.ReadAll(w.Result().Body)
+			w.Result().Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ex.wantType == "" {
+				assert.Equal(t, ex.want.body, string(b), "Incorrect response body")
+				hook.Reset()
+				return
+			}
+
+			assert.Equal(t, ex.wantType, w.Result().Header.Get("Content-Type"), "Incorrect content type")
+			_, format, err := image.DecodeConfig(bytes.NewReader(b))
+			assert.Nil(t, err, "Served image should be valid")
+			assert.Equal(t, ex.wantType, "image/"+format, "Incorrect image format")
+
+			hook.Reset()
+		})
+	}
+}
+
+func TestLocalImageServerGetThumbnail(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	for _, ex := range examplesLocalImageServerGetThumbnail {
+		// 10x0 rendition of image1.png is cached, image4.png has no blob
+		blobs := newImageBlobStore(t, "renditions/1/10x0-contain-q0.png")
+		is, err := imgr.NewLocalImageServer(
+			stubStoreOwned(ex.storage),
+			imgr.WithLogger(log),
+			imgr.WithBlobStore(blobs),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux := goji.NewMux()
+		mux.HandleFunc(pat.Get("/images/:filename/thumbnail"), is.GetThumbnail)
+
+		target := "/images/" + ex.requestGet.filename + "/thumbnail?" + ex.query
+		req, err := http.NewRequest("GET", target, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := req.Context()
+		for k, v := range ex.requestGet.context {
+			ctx = context.WithValue(ctx, k, v)
+		}
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
+
+		t.Run(ex.name, func(t *testing.T) {
+			mux.ServeHTTP(w, req)
+
+			// Check log message if there's expected one
+			if len(ex.want.logMessage) > 0 && assert.Equal(t, 1, len(hook.Entries), "Should have log entry") {
+				assert.Regexp(
+					t,
+					regexp.MustCompile(ex.want.logMessage),
+					hook.Entries[0].Message,
+					"Incorrect log entry message",
+				)
+			}
+
+			// Check response
+			assert.Equal(t, ex.want.statusCode, w.Result().StatusCode, "Incorrect response code")
+			b, err := ioutil.ReadAll(w.Result().Body)
+			w.Result().Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ex.wantWidth == 0 {
+				assert.Regexp(t, ex.want.body, string(b), "Incorrect response body")
+				hook.Reset()
+				return
+			}
+
+			// Rendition should be served and cached
+			assert.Equal(t, ex.wantType, w.Result().Header.Get("Content-Type"), "Incorrect content type")
+			config, format, err := image.DecodeConfig(bytes.NewReader(b))
+			if assert.Nil(t, err, "Rendition should be valid image") {
+				assert.Equal(t, "image/"+format, ex.wantType, "Incorrect rendition format")
+				assert.Equal(t, ex.wantWidth, config.Width, "Incorrect rendition width")
+				assert.Equal(t, ex.wantHeight, config.Height, "Incorrect rendition height")
+			}
+			renditions, err := blobs.List(context.Background(), "renditions/1/")
+			assert.Nil(t, err, "Renditions should be listed")
+			assert.Equal(t, 2, len(renditions), "Rendition should be cached")
+
+			hook.Reset()
+		})
+	}
+}
+
+func TestLocalImageServerGetThumbnailCacheLimit(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	// Cache of image1.png is full
+	cached := make([]string, 0, 32)
+	for i := 100; i < 132; i++ {
+		cached = append(cached, fmt.Sprintf("renditions/1/%dx0-contain-q0.png", i))
+	}
+	blobs := newImageBlobStore(t, cached...)
+	is, err := imgr.NewLocalImageServer(stubStoreOwned(true), imgr.WithLogger(log), imgr.WithBlobStore(blobs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := goji.NewMux()
+	mux.HandleFunc(pat.Get("/images/:filename/thumbnail"), is.GetThumbnail)
+
+	req, err := http.NewRequest("GET", "/images/image1.png/thumbnail?w=20", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), util.RequestUserKey, stubUser(1)))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode, "Rendition should be served")
+	config, _, err := image.DecodeConfig(w.Result().Body)
+	if assert.Nil(t, err, "Rendition should be valid image") {
+		assert.Equal(t, 20, config.Width, "Incorrect rendition width")
+	}
+	assert.Regexp(t, `^"[0-9a-f]{64}"$`, w.Result().Header.Get("ETag"), "Incorrect ETag")
+	renditions, err := blobs.List(context.Background(), "renditions/1/")
+	assert.Nil(t, err, "Renditions should be listed")
+	assert.Equal(t, 32, len(renditions), "Rendition should not be cached")
+	if assert.Equal(t, 1, len(hook.Entries), "Should have log entry") {
+		assert.Regexp(t, "isn't cached", hook.Entries[0].Message, "Incorrect log entry message")
+	}
+}
+
+func TestLocalImageServerDeleteImage(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	for _, ex := range examplesLocalImageServerDeleteImage {
+		blobs := newStubBlobStore(
+			ex.blobStore, "image1.png", "image2.png", "image4.png", "renditions/1/10x0-contain-q0.png",
+		)
+		storage := &stubStoreRecorder{stubStoreOwned: stubStoreOwned(ex.storage)}
+		is, err := imgr.NewLocalImageServer(
+			storage,
+			imgr.WithLogger(log),
+			imgr.WithBlobStore(blobs),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux := goji.NewMux()
+		mux.HandleFunc(pat.Delete("/images/:filename"), is.DeleteImage)
+
+		req, err := http.NewRequest("DELETE", "/images/"+ex.requestGet.filename, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := req.Context()
+		for k, v := range ex.requestGet.context {
+			ctx = context.WithValue(ctx, k, v)
+		}
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
+
+		t.Run(ex.name, func(t *testing.T) {
+			mux.ServeHTTP(w, req)
+
+			// Check log message if there's expected one
+			if len(ex.want.logMessage) > 0 && assert.Equal(t, 1, len(hook.Entries), "Should have log entry") {
+				assert.Regexp(
+					t,
+					regexp.MustCompile(ex.want.logMessage),
+					hook.Entries[0].Message,
+					"Incorrect log entry message",
+				)
+			}
+
+			// Check response
+			assert.Equal(t, ex.want.statusCode, w.Result().StatusCode, "Incorrect response code")
+			b, err := ioutil.ReadAll(w.Result().Body)
+			w.Result().Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, ex.want.body, string(b), "Incorrect response body")
+
+			// Check storage and blob store consistency
+			assert.Equal(t, ex.wantRemoved, len(storage.deleted) == 1, "Unexpected storage record removal")
+			assert.Equal(t, 0, len(storage.created), "Storage record should not be recreated")
+			if ex.wantRemoved {
+				_, err = blobs.Stat(context.Background(), ex.requestGet.filename)
+				assert.Equal(t, imgr.ErrBlobNotFound, err, "Image blob should be removed")
+				// Images are numbered by their filenames
+				prefix := fmt.Sprintf("renditions/%c/", ex.requestGet.filename[5])
+				renditions, err := blobs.List(context.Background(), prefix)
+				assert.Nil(t, err, "Renditions should be listed")
+				assert.Equal(t, 0, len(renditions), "Image renditions should be removed")
+			}
+
+			hook.Reset()
+		})
+	}
+}
+
+func TestLocalImageServerAlbums(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	for _, ex := range examplesLocalImageServerAlbums {
+		is, err := imgr.NewLocalImageServer(stubStoreOwned(ex.storage), imgr.WithLogger(log))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux := goji.NewMux()
+		mux.HandleFunc(pat.Get("/albums"), is.ListAlbums)
+		mux.HandleFunc(pat.Post("/albums"), is.PostAlbum)
+		mux.HandleFunc(pat.Patch("/albums/:album"), is.PatchAlbum)
+		mux.HandleFunc(pat.Delete("/albums/:album"), is.DeleteAlbum)
+		mux.HandleFunc(pat.Get("/albums/:album/images"), is.ListAlbumImages)
+		mux.HandleFunc(pat.Put("/albums/:album/images/:filename"), is.PutAlbumImage)
+		mux.HandleFunc(pat.Delete("/albums/:album/images/:filename"), is.DeleteAlbumImage)
+
+		form := url.Values{}
+		if ex.requestAlbum.name != "" {
+			form.Set("name", ex.requestAlbum.name)
+		}
+		req, err := http.NewRequest(ex.method, ex.path, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := req.Context()
+		for k, v := range ex.requestAlbum.context {
+			ctx = context.WithValue(ctx, k, v)
+		}
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
+
+		t.Run(ex.name, func(t *testing.T) {
+			mux.ServeHTTP(w, req)
+
+			// Check log message if there's expected one
+			if len(ex.want.logMessage) > 0 && assert.Equal(t, 1, len(hook.Entries), "Should have log entry") {
+				assert.Regexp(
+					t,
+					regexp.MustCompile(ex.want.logMessage),
+					hook.Entries[0].Message,
+					"Incorrect log entry message",
+				)
+			}
+
+			// Check response
+			assert.Equal(t, ex.want.statusCode, w.Result().StatusCode, "Incorrect response code")
+			b, err := ioutil.ReadAll(w.Result().Body)
+			w.Result().Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, ex.want.body, string(b), "Incorrect response body")
+			if ex.want.statusCode == http.StatusCreated {
+				assert.Equal(t, "/albums/3", w.Result().Header.Get("Location"), "Incorrect location")
+			}
+
+			hook.Reset()
+		})
+	}
+}
+
+func TestLocalImageServerTags(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	for _, ex := range examplesLocalImageServerTags {
+		is, err := imgr.NewLocalImageServer(stubStoreOwned(ex.storage), imgr.WithLogger(log))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux := goji.NewMux()
+		mux.HandleFunc(pat.Get("/images/tags"), is.ListTags)
+		mux.HandleFunc(pat.Put("/images/:filename/tags"), is.PutImageTags)
+
+		form := url.Values{"tag": ex.requestTags.tags}
+		req, err := http.NewRequest(ex.method, ex.path, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := req.Context()
+		for k, v := range ex.requestTags.context {
+			ctx = context.WithValue(ctx, k, v)
+		}
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
+
+		t.Run(ex.name, func(t *testing.T) {
+			mux.ServeHTTP(w, req)
+
+			// Check log message if there's expected one
+			if len(ex.want.logMessage) > 0 && assert.Equal(t, 1, len(hook.Entries), "Should have log entry") {
+				assert.Regexp(
+					t,
+					regexp.MustCompile(ex.want.logMessage),
+					hook.Entries[0].Message,
+					"Incorrect log entry message",
+				)
+			}
+
+			// Check response
+			assert.Equal(t, ex.want.statusCode, w.Result().StatusCode, "Incorrect response code")
+			b, err := ioutil.ReadAll(w.Result().Body)
+			w.Result().Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, ex.want.body, string(b), "Incorrect response body")
+
+			hook.Reset()
+		})
+	}
+}
+
+func TestLocalImageServerShares(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	for _, ex := range examplesLocalImageServerShares {
+		is, err := imgr.NewLocalImageServer(
+			stubStoreOwned(ex.storage),
+			imgr.WithLogger(log),
+			imgr.WithShareSecret([]byte("share secret")),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux := goji.NewMux()
+		mux.HandleFunc(pat.Post("/images/:filename/share"), is.PostShare)
+		mux.HandleFunc(pat.Delete("/images/:filename/share/:share"), is.DeleteShare)
+
+		form := url.Values{}
+		for k, v := range ex.requestShare.form {
+			form.Set(k, v)
+		}
+		req, err := http.NewRequest(ex.method, ex.path, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := req.Context()
+		for k, v := range ex.requestShare.context {
+			ctx = context.WithValue(ctx, k, v)
+		}
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
+
+		t.Run(ex.name, func(t *testing.T) {
+			mux.ServeHTTP(w, req)
+
+			// Check log message if there's expected one
+			if len(ex.want.logMessage) > 0 && assert.Equal(t, 1, len(hook.Entries), "Should have log entry") {
+				assert.Regexp(
+					t,
+					regexp.MustCompile(ex.want.logMessage),
+					hook.Entries[0].Message,
+					"Incorrect log entry message",
+				)
+			}
+
+			// Check response
+			assert.Equal(t, ex.want.statusCode, w.Result().StatusCode, "Incorrect response code")
+			b, err := ioutil.ReadAll(w.Result().Body)
+			w.Result().Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Regexp(t, ex.want.body, string(b), "Incorrect response body")
+
+			hook.Reset()
+		})
+	}
+}
+
+func TestLocalImageServerGetSharedImage(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	newServer := func(secret string) imgr.ImageServer {
+		is, err := imgr.NewLocalImageServer(
+			stubStoreOwned(true),
+			imgr.WithLogger(log),
+			imgr.WithBlobStore(newStubBlobStore(true, "image1.png")),
+			imgr.WithShareSecret([]byte(secret)),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return is
+	}
+	is := newServer("share secret")
+	mux := goji.NewMux()
+	mux.HandleFunc(pat.Post("/images/:filename/share"), is.PostShare)
+	mux.HandleFunc(pat.Get("/images/:filename"), is.GetImage)
+	share := func(maxViews string) string {
+		req, err := http.NewRequest("POST", "/images/image1.png/share", strings.NewReader("max_views="+maxViews))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), util.RequestUserKey, stubUser(1))))
+		created := &imgr.Share{}
+		if err = json.NewDecoder(w.Result().Body).Decode(created); err != nil {
+			t.Fatal(err)
+		}
+		return created.URL
+	}
+	shared, usedUp := share("0"), share("1")
+
+	otherMux := goji.NewMux()
+	otherMux.HandleFunc(pat.Get("/images/:filename"), newServer("other secret").GetImage)
+
+	for _, ex := range []struct {
+		name       string
+		mux        *goji.Mux
+		url        string
+		statusCode int
+		body       string
+	}{
+		{"Shared image", mux, shared, http.StatusOK, "image1.png content"},
+		{"Tampered token", mux, strings.Replace(shared, "share=1.", "share=3.", 1), http.StatusForbidden, ""},
+		{"Token of other image", mux, strings.Replace(shared, "image1.png", "image3.png", 1), http.StatusForbidden, ""},
+		{"Used up share", mux, usedUp, http.StatusForbidden, ""},
+		{"Token of other server", otherMux, shared, http.StatusForbidden, ""},
+		{"Missing token", mux, "/images/image1.png", http.StatusUnauthorized, ""},
+	} {
+		t.Run(ex.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", ex.url, http.NoBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			ex.mux.ServeHTTP(w, req)
+
+			assert.Equal(t, ex.statusCode, w.Result().StatusCode, "Incorrect response code")
+			if ex.body != "" {
+				assert.Equal(t, ex.body, w.Body.String(), "Incorrect response body")
+			}
+		})
+	}
+}
+
+func TestSkipForShared(t *testing.T) {
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		})
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	shared := pat.Get("/images/:filename")
+	mux := goji.NewMux()
+	mux.HandleFunc(pat.Get("/images/usage"), ok)
+	mux.HandleFunc(shared, ok)
+	mux.HandleFunc(pat.Get("/images/:filename/thumbnail"), ok)
+	mux.HandleFunc(pat.Delete("/images/:filename"), ok)
+	mux.Use(imgr.SkipForShared(shared, auth))
+	for _, ex := range []struct {
+		method     string
+		url        string
+		statusCode int
+	}{
+		{"GET", "/images/image1.png?share=token", http.StatusOK},
+		{"HEAD", "/images/image1.png?share=token", http.StatusOK},
+		{"GET", "/images/image1.png", http.StatusUnauthorized},
+		{"GET", "/images/image1.png?share=", http.StatusUnauthorized},
+		{"DELETE", "/images/image1.png?share=token", http.StatusUnauthorized},
+		{"GET", "/images/usage?share=token", http.StatusUnauthorized},
+		{"GET", "/images/image1.png/thumbnail?share=token", http.StatusUnauthorized},
+	} {
+		req, err := http.NewRequest(ex.method, ex.url, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		assert.Equal(t, ex.statusCode, w.Result().StatusCode, "Incorrect response code of %s %s", ex.method, ex.url)
+	}
+}
+
+func TestLocalImageServerGetSharedImageViews(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	storage := &stubStoreRecorder{stubStoreOwned: true}
+	is, err := imgr.NewLocalImageServer(
+		storage,
+		imgr.WithLogger(log),
+		imgr.WithBlobStore(newStubBlobStore(true, "image1.png")),
+		imgr.WithShareSecret([]byte("share secret")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := goji.NewMux()
+	mux.HandleFunc(pat.Post("/images/:filename/share"), is.PostShare)
+	mux.HandleFunc(pat.Get("/images/:filename"), is.GetImage)
+	req := httptest.NewRequest("POST", "/images/image1.png/share", http.NoBody)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), util.RequestUserKey, stubUser(1))))
+	share := &imgr.Share{}
+	if err = json.NewDecoder(w.Result().Body).Decode(share); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(method string, headers map[string]string, query string) *http.Response {
+		req := httptest.NewRequest(method, share.URL+query, http.NoBody)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Result()
+	}
+	res := get("GET", nil, "")
+	if !assert.Equal(t, http.StatusOK, res.StatusCode, "Shared image should be served") {
+		return
+	}
+	etag := res.Header.Get("ETag")
+
+	for _, ex := range []struct {
+		name       string
+		method     string
+		headers    map[string]string
+		query      string
+		statusCode int
+	}{
+		{"HEAD", "HEAD", nil, "", http.StatusOK},
+		{"Range", "GET", map[string]string{"Range": "bytes=0-4"}, "", http.StatusPartialContent},
+		{"Not modified", "GET", map[string]string{"If-None-Match": etag}, "", http.StatusNotModified},
+		{"Not acceptable", "GET", map[string]string{"Accept": "text/html"}, "", http.StatusNotAcceptable},
+		{"Invalid format", "GET", nil, "&format=bmp", http.StatusBadRequest},
+	} {
+		t.Run(ex.name, func(t *testing.T) {
+			res := get(ex.method, ex.headers, ex.query)
+			assert.Equal(t, ex.statusCode, res.StatusCode, "Incorrect response code")
+			assert.Equal(t, int64(1), storage.views, "View should not be counted")
+		})
+	}
+}
+
+func TestLocalImageServerPostImageBatch(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 30, 10))); err != nil {
+		t.Fatal(err)
+	}
+	valid, text := buf.Bytes(), []byte("Text file content")
+	tooMany := make([][]byte, 101)
+	for i := range tooMany {
+		tooMany[i] = text
+	}
+
+	for _, ex := range []struct {
+		name     string
+		field    string
+		files    [][]byte
+		quota    imgr.Quota
+		statuses []int
+		created  int
+	}{
+		{
+			name:     "Batch",
+			field:    "images[]",
+			files:    [][]byte{valid, text, valid},
+			statuses: []int{http.StatusCreated, http.StatusUnsupportedMediaType, http.StatusCreated},
+			created:  2,
+		},
+		{
+			name:     "Repeated image parts",
+			field:    "image",
+			files:    [][]byte{valid, valid},
+			statuses: []int{http.StatusCreated, http.StatusCreated},
+			created:  2,
+		},
+		{
+			name:     "Single image in batch",
+			field:    "images[]",
+			files:    [][]byte{valid},
+			statuses: []int{http.StatusCreated},
+			created:  1,
+		},
+		{
+			name:     "Quota exceeded by batch",
+			field:    "images[]",
+			files:    [][]byte{valid, valid, valid},
+			quota:    imgr.Quota{MaxImages: 2},
+			statuses: []int{http.StatusCreated, http.StatusCreated, http.StatusTooManyRequests},
+			created:  2,
+		},
+		{
+			name:    "Too many images",
+			field:   "images[]",
+			files:   tooMany,
+			created: 0,
+		},
+	} {
+		t.Run(ex.name, func(t *testing.T) {
+			storage := &stubStoreRecorder{stubStoreOwned: true}
+			is, err := imgr.NewLocalImageServer(
+				storage,
+				imgr.WithLogger(log),
+				imgr.WithBlobStore(newStubBlobStore(true)),
+				imgr.WithQuota(ex.quota),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body := &bytes.Buffer{}
+			multi := multipart.NewWriter(body)
+			for i, file := range ex.files {
+				part, err := multi.CreateFormFile(ex.field, fmt.Sprintf("image%d.png", i+1))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err = part.Write(file); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = multi.Close(); err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest("POST", "/images", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", multi.FormDataContentType())
+			req = req.WithContext(context.WithValue(req.Context(), util.RequestUserKey, stubUser(1)))
+			w := httptest.NewRecorder()
+			is.PostImage(w, req)
+
+			assert.Equal(t, http.StatusMultiStatus, w.Result().StatusCode, "Incorrect response code")
+			results := struct {
+				Items []struct {
+					OriginalName string      `json:"original_name"`
+					Status       int         `json:"status"`
+					Image        *imgr.Image `json:"image"`
+					Error        string      `json:"error"`
+				} `json:"items"`
+			}{}
+			if err = json.NewDecoder(w.Result().Body).Decode(&results); err != nil {
+				t.Fatal(err)
+			}
+			if !assert.Equal(t, len(ex.files), len(results.Items), "Every image should have result") {
+				return
+			}
+			for i, result := range results.Items {
+				assert.Equal(t, fmt.Sprintf("image%d.png", i+1), result.OriginalName, "Incorrect original name")
+				switch {
+				case i >= 100:
+					assert.Equal(t, http.StatusRequestEntityTooLarge, result.Status, "Incorrect status")
+					assert.Equal(t, "Too many images in request", result.Error, "Incorrect error")
+				case ex.statuses == nil:
+					assert.Equal(t, http.StatusUnsupportedMediaType, result.Status, "Incorrect status")
+				case ex.statuses[i] == http.StatusCreated:
+					assert.Equal(t, http.StatusCreated, result.Status, "Incorrect status")
+					if assert.NotNil(t, result.Image, "Created image should be returned") {
+						assert.Regexp(t, "^/images/[0-9A-Z]{26}image", result.Image.URL, "Incorrect URL")
+					}
+				default:
+					assert.Equal(t, ex.statuses[i], result.Status, "Incorrect status")
+					assert.Nil(t, result.Image, "Image should not be returned")
+					assert.NotEmpty(t, result.Error, "Error should be returned")
+				}
+			}
+			assert.Equal(t, ex.created, len(storage.created), "Incorrect number of created images")
+
+			hook.Reset()
+		})
 	}
-	return
 }
-func (ss stubStoreNil) LoadImages(_ *[]imgr.Image, _, _, _ uint64) (err error) {
-	return
+
+// uploadMux routes upload session requests to handlers of is.
+func uploadMux(is imgr.ImageServer) *goji.Mux {
+	mux := goji.NewMux()
+	mux.HandleFunc(pat.Post("/uploads"), is.PostUpload)
+	mux.HandleFunc(pat.Head("/uploads/:upload"), is.HeadUpload)
+	mux.HandleFunc(pat.Patch("/uploads/:upload"), is.PatchUpload)
+	mux.HandleFunc(pat.Post("/uploads/:upload/finalize"), is.FinalizeUpload)
+	mux.HandleFunc(pat.Delete("/uploads/:upload"), is.DeleteUpload)
+	return mux
 }
 
-func TestLocalImageServerPostImage(t *testing.T) {
+func TestLocalImageServerUploads(t *testing.T) {
 	log, hook := test.NewNullLogger()
-	for _, ex := range examplesLocalImageServerPostImage {
-		staticPath, err := ioutil.TempDir("", "static")
+	for _, ex := range examplesLocalImageServerUploads {
+		is, err := imgr.NewLocalImageServer(stubStoreOwned(ex.storage), imgr.WithLogger(log))
 		if err != nil {
-			t.Fatal("Unable to create temp dir")
+			t.Fatal(err)
 		}
+		mux := uploadMux(is)
 
-		is, err := imgr.NewLocalImageServer(
-			stubStoreNil(ex.storage),
-			imgr.WithLogger(log),
-			imgr.WithStaticFolder(staticPath),
-		)
+		req, err := http.NewRequest(ex.method, ex.path, http.NoBody)
 		if err != nil {
 			t.Fatal(err)
 		}
-
-		if ex.staticPath {
-			defer os.RemoveAll(staticPath)
-		} else {
-			os.RemoveAll(staticPath)
+		for k, v := range ex.requestUpload.headers {
+			req.Header.Set(k, v)
 		}
-
-		req := generateRequest(t, ex.requestPost.file, ex.requestPost.context)
+		ctx := req.Context()
+		for k, v := range ex.requestUpload.context {
+			ctx = context.WithValue(ctx, k, v)
+		}
+		req = req.WithContext(ctx)
 		w := httptest.NewRecorder()
 
 		t.Run(ex.name, func(t *testing.T) {
-			is.PostImage(w, req)
+			mux.ServeHTTP(w, req)
 
 			// Check log message if there's expected one
 			if len(ex.want.logMessage) > 0 && assert.Equal(t, 1, len(hook.Entries), "Should have log entry") {
@@ -167,133 +2801,682 @@ func TestLocalImageServerPostImage(t *testing.T) {
 				t.Fatal(err)
 			}
 			assert.Regexp(t, ex.want.body, string(b), "Incorrect response body")
+			if ex.want.statusCode == http.StatusCreated {
+				assert.Regexp(t, "^/uploads/[0-9A-Z]{26}$", w.Result().Header.Get("Location"), "Incorrect location")
+				assert.Equal(t, "0", w.Result().Header.Get("Upload-Offset"), "Incorrect offset")
+			}
 
 			hook.Reset()
 		})
 	}
 }
 
-func generateRequest(t *testing.T, fileType byte, contextVals map[util.RequestKey]interface{}) *http.Request {
-	var req *http.Request
-	var err error
-	if fileType == fileMissing {
-		// No file should be sent
-		req, err = http.NewRequest("POST", "", http.NoBody)
+func TestLocalImageServerUploadChunks(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	storage := &stubStoreSessions{stubStoreRecorder: stubStoreRecorder{stubStoreOwned: true}}
+	blobs := newStubBlobStore(true)
+	is, err := imgr.NewLocalImageServer(storage, imgr.WithLogger(log), imgr.WithBlobStore(blobs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer is.Close()
+	mux := uploadMux(is)
+	content, err := ioutil.ReadFile(createFile(t, fileValid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("image.png")
+	half := len(content) / 2
+
+	send := func(method, path string, headers map[string]string, body []byte) *http.Response {
+		req, err := http.NewRequest(method, path, bytes.NewReader(body))
 		if err != nil {
 			t.Fatal(err)
 		}
-	} else {
-		// Create file
-		var file *os.File
-		body := &bytes.Buffer{}
-		multi := multipart.NewWriter(body)
-		defer multi.Close()
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), util.RequestUserKey, stubUser(1)))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Result()
+	}
+	chunk := func(offset int) map[string]string {
+		return map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": strconv.Itoa(offset)}
+	}
 
-		// createFile defines file content based on a byte const fileType
-		file, err = os.Open(createFile(t, fileType))
-		if err != nil {
-			t.Fatal(err)
+	res := send("POST", "/uploads", map[string]string{
+		"Upload-Length":   strconv.Itoa(len(content)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("photo.png")),
+	}, nil)
+	if !assert.Equal(t, http.StatusCreated, res.StatusCode, "Upload should be created") {
+		return
+	}
+	location := res.Header.Get("Location")
+
+	res = send("PATCH", location, map[string]string{"Upload-Offset": "0"}, content[:half])
+	assert.Equal(t, http.StatusUnsupportedMediaType, res.StatusCode, "Chunk content type should be checked")
+	res = send("PATCH", location, chunk(1), content[:half])
+	assert.Equal(t, http.StatusConflict, res.StatusCode, "Chunk offset should match upload offset")
+	assert.Equal(t, "0", res.Header.Get("Upload-Offset"), "Upload offset should be reported")
+
+	res = send("PATCH", location, chunk(0), content[:half])
+	assert.Equal(t, http.StatusNoContent, res.StatusCode, "Chunk should be stored")
+	assert.Equal(t, strconv.Itoa(half), res.Header.Get("Upload-Offset"), "Offset should include chunk")
+
+	res = send("HEAD", location, nil, nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode, "Progress should be reported")
+	assert.Equal(t, strconv.Itoa(half), res.Header.Get("Upload-Offset"), "Incorrect offset")
+	assert.Equal(t, strconv.Itoa(len(content)), res.Header.Get("Upload-Length"), "Incorrect length")
+	assert.Equal(t, "no-store", res.Header.Get("Cache-Control"), "Progress should not be cached")
+
+	res = send("POST", location+"/finalize", nil, nil)
+	assert.Equal(t, http.StatusConflict, res.StatusCode, "Incomplete upload should not be finalized")
+
+	res = send("PATCH", location, chunk(half), append(content[half:len(content):len(content)], 0))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode, "Chunk should not exceed upload length")
+	res = send("PATCH", location, chunk(half), content[half:])
+	assert.Equal(t, http.StatusNoContent, res.StatusCode, "Last chunk should be stored")
+	assert.Equal(t, strconv.Itoa(len(content)), res.Header.Get("Upload-Offset"), "Upload should be complete")
+
+	res = send("POST", location+"/finalize", nil, nil)
+	if !assert.Equal(t, http.StatusCreated, res.StatusCode, "Image should be created") ||
+		!assert.Equal(t, 1, len(storage.created), "Image record should be created") {
+		return
+	}
+	image := storage.created[0]
+	sum := sha256.Sum256(content)
+	assert.Equal(t, "/images/"+image.Filename, res.Header.Get("Location"), "Incorrect location")
+	assert.Equal(t, "photo.png", image.OriginalName, "Incorrect original name")
+	assert.Equal(t, int64(len(content)), image.Size, "Incorrect size")
+	assert.Equal(t, hex.EncodeToString(sum[:]), image.SHA256, "Chunks should be assembled in order")
+
+	// Session and its chunks should be removed
+	res = send("HEAD", location, nil, nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "Upload should be removed")
+	chunks, err := blobs.List(context.Background(), "sessions/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, chunks, "Chunks should be removed")
+}
+
+func TestLocalImageServerUploadInvalidImage(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	storage := &stubStoreSessions{stubStoreRecorder: stubStoreRecorder{stubStoreOwned: true}}
+	blobs := newStubBlobStore(true)
+	is, err := imgr.NewLocalImageServer(storage, imgr.WithLogger(log), imgr.WithBlobStore(blobs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer is.Close()
+	mux := uploadMux(is)
+	content := []byte("Text file content")
+
+	storage.CreateUploadSession(&imgr.UploadSession{
+		ID: "01CAZXMDDNQ63H7ZEA53Y0G4K0", Filename: "notes.txt", Length: int64(len(content)), UserID: 1,
+	}, nil)
+	req := httptest.NewRequest("PATCH", "/uploads/01CAZXMDDNQ63H7ZEA53Y0G4K0", bytes.NewReader(content))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+	req = req.WithContext(context.WithValue(req.Context(), util.RequestUserKey, stubUser(1)))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if !assert.Equal(t, http.StatusNoContent, w.Result().StatusCode, "Chunk should be stored") {
+		return
+	}
+
+	req = httptest.NewRequest("POST", "/uploads/01CAZXMDDNQ63H7ZEA53Y0G4K0/finalize", http.NoBody)
+	req = req.WithContext(context.WithValue(req.Context(), util.RequestUserKey, stubUser(1)))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Result().StatusCode, "Content should be validated")
+	assert.Empty(t, storage.created, "Image should not be created")
+	assert.Empty(t, storage.sessions, "Rejected upload should be removed")
+}
+
+func TestLocalImageServerUploadLimits(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	storage := &stubStoreSessions{stubStoreRecorder: stubStoreRecorder{stubStoreOwned: true}}
+	storage.CreateUploadSession(&imgr.UploadSession{ID: "01CAZXMDDNQ63H7ZEA53Y0G4K0", Length: 100, UserID: 1}, nil)
+	for i := 0; i < imgr.MaxUploadSessions; i++ {
+		storage.CreateUploadSession(&imgr.UploadSession{ID: "session" + strconv.Itoa(i), Length: 1, UserID: 2}, nil)
+	}
+	is, err := imgr.NewLocalImageServer(storage, imgr.WithLogger(log), imgr.WithQuota(imgr.Quota{MaxBytes: 150}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer is.Close()
+	mux := uploadMux(is)
+
+	for _, ex := range []struct {
+		name       string
+		userID     uint64
+		length     string
+		statusCode int
+	}{
+		{"Upload fitting into quota", 1, "50", http.StatusCreated},
+		{"Upload exceeding quota with other uploads", 1, "1", http.StatusRequestEntityTooLarge},
+		{"Upload exceeding number of uploads", 2, "1", http.StatusTooManyRequests},
+	} {
+		t.Run(ex.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/uploads", http.NoBody)
+			req.Header.Set("Upload-Length", ex.length)
+			req.Header.Set("Upload-Metadata", "filename aW1hZ2UucG5n")
+			req = req.WithContext(context.WithValue(req.Context(), util.RequestUserKey, stubUser(ex.userID)))
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			assert.Equal(t, ex.statusCode, w.Result().StatusCode, "Incorrect response code")
+		})
+	}
+}
+
+func TestLocalImageServerUploadFinalizing(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	storage := &stubStoreSessions{stubStoreRecorder: stubStoreRecorder{stubStoreOwned: true}}
+	key := "sessions/01CAZXMDDNQ63H7ZEA53Y0G4K0/00000000000000000000-01CAZXMDDNQ63H7ZEA53Y0G4K1"
+	blobs := newImageBlobStore(t)
+	content, err := blobs.Get(context.Background(), "image1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = blobs.Put(context.Background(), key, content); err != nil {
+		t.Fatal(err)
+	}
+	content.Close()
+	info, err := blobs.Stat(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Upload is being finalized by other request
+	storage.CreateUploadSession(&imgr.UploadSession{
+		ID: "01CAZXMDDNQ63H7ZEA53Y0G4K0", Filename: "image.png", Length: info.Size, Offset: info.Size, UserID: 1,
+		Chunks: []string{key}, Finalizing: true,
+	}, nil)
+	is, err := imgr.NewLocalImageServer(storage, imgr.WithLogger(log), imgr.WithBlobStore(blobs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer is.Close()
+	mux := uploadMux(is)
+
+	req := httptest.NewRequest("POST", "/uploads/01CAZXMDDNQ63H7ZEA53Y0G4K0/finalize", http.NoBody)
+	req = req.WithContext(context.WithValue(req.Context(), util.RequestUserKey, stubUser(1)))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusConflict, w.Result().StatusCode, "Upload should not be finalized twice")
+	assert.Empty(t, storage.created, "Image should not be created")
+	assert.Len(t, storage.sessions, 1, "Upload should be kept for other request")
+}
+
+func TestLocalImageServerUploadCollection(t *testing.T) {
+	log, _ := test.NewNullLogger()
+	storage := &stubStoreSessions{stubStoreRecorder: stubStoreRecorder{stubStoreOwned: true}}
+	key := "sessions/01CAZXMDDNQ63H7ZEA53Y0G4K0/00000000000000000000-01CAZXMDDNQ63H7ZEA53Y0G4K1"
+	blobs := newStubBlobStore(true, key)
+	storage.CreateUploadSession(&imgr.UploadSession{
+		ID: "01CAZXMDDNQ63H7ZEA53Y0G4K0", Length: 100, Offset: 20, UserID: 1,
+		Chunks: []string{key}, UpdatedAt: time.Now().Add(-time.Hour),
+	}, nil)
+	storage.CreateUploadSession(&imgr.UploadSession{
+		ID: "01CAZXMDDNQ63H7ZEA53Y0G4K2", Length: 100, UserID: 1, UpdatedAt: time.Now().Add(time.Hour),
+	}, nil)
+	// Upload is being finalized by other request
+	storage.CreateUploadSession(&imgr.UploadSession{
+		ID: "01CAZXMDDNQ63H7ZEA53Y0G4K3", Length: 100, Offset: 100, UserID: 1,
+		UpdatedAt: time.Now().Add(-time.Hour), Finalizing: true,
+	}, nil)
+
+	is, err := imgr.NewLocalImageServer(
+		storage, imgr.WithLogger(log), imgr.WithBlobStore(blobs), imgr.WithUploadSessionTTL(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer is.Close()
+
+	for i := 0; i < 100; i++ {
+		storage.sessionsMu.Lock()
+		remaining := len(storage.sessions)
+		storage.sessionsMu.Unlock()
+		if remaining == 2 {
+			break
 		}
-		defer file.Close()
-		defer os.Remove(file.Name())
+		time.Sleep(10 * time.Millisecond)
+	}
+	storage.sessionsMu.Lock()
+	_, ok := storage.sessions["01CAZXMDDNQ63H7ZEA53Y0G4K2"]
+	_, finalizing := storage.sessions["01CAZXMDDNQ63H7ZEA53Y0G4K3"]
+	assert.Equal(t, 2, len(storage.sessions), "Abandoned upload should be removed")
+	assert.True(t, ok, "Active upload should be kept")
+	assert.True(t, finalizing, "Upload being finalized should be kept")
+	storage.sessionsMu.Unlock()
+	_, err = blobs.Stat(context.Background(), key)
+	assert.Equal(t, imgr.ErrBlobNotFound, err, "Chunks of abandoned upload should be removed")
+}
 
-		fileWriter, err := multi.CreateFormFile("image", file.Name())
-		if err != nil {
-			t.Fatal(err)
+func TestLocalImageServerImport(t *testing.T) {
+	content, err := ioutil.ReadFile(createFile(t, fileValid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("image.png")
+	origin := http.NewServeMux()
+	origin.HandleFunc("/photo.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	})
+	origin.HandleFunc("/notes.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Text file content"))
+	})
+	origin.HandleFunc("/redirect/", func(w http.ResponseWriter, r *http.Request) {
+		hops, _ := strconv.Atoi(path.Base(r.URL.Path))
+		if hops == 0 {
+			http.Redirect(w, r, "/photo.png", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/redirect/"+strconv.Itoa(hops-1), http.StatusFound)
+	})
+	origin.HandleFunc("/slow.png", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+			w.Write(content)
+		case <-r.Context().Done():
 		}
+	})
+	server := httptest.NewServer(origin)
+	defer server.Close()
 
-		_, err = io.Copy(fileWriter, file)
+	log, hook := test.NewNullLogger()
+	allowLoopback := imgr.WithImportAllowList("127.0.0.0/8", "::1/128")
+	for _, ex := range []struct {
+		name    string
+		url     string
+		options []imgr.Option
+		context map[util.RequestKey]interface{}
+		want
+	}{
+		{
+			name:    "Import image",
+			url:     server.URL + "/photo.png?size=large",
+			options: []imgr.Option{allowLoopback},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+			want: want{
+				body: `^{"id":1,"filename":"[0-9A-Z]{26}photo.png","url":"/images/[0-9A-Z]{26}photo.png",` +
+					`"original_name":"photo.png"`,
+				statusCode: http.StatusCreated,
+			},
+		},
+		{
+			name:    "Import after redirects",
+			url:     server.URL + "/redirect/4",
+			options: []imgr.Option{allowLoopback},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+			want: want{
+				body:       `"original_name":"4"`,
+				statusCode: http.StatusCreated,
+			},
+		},
+		{
+			name:    "Too many redirects",
+			url:     server.URL + "/redirect/5",
+			options: []imgr.Option{allowLoopback},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+			want: want{
+				body:       `^{"error":"Image can't be fetched"}$`,
+				statusCode: http.StatusBadGateway,
+				logMessage: "image URL has too many redirects",
+			},
+		},
+		{
+			name:    "Loopback address",
+			url:     server.URL + "/photo.png",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+			want: want{
+				body:       `^{"error":"Image URL is not allowed"}$`,
+				statusCode: http.StatusUnprocessableEntity,
+				logMessage: "image URL resolves to denied address",
+			},
+		},
+		{
+			name:    "Missing image",
+			url:     server.URL + "/missing.png",
+			options: []imgr.Option{allowLoopback},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+			want: want{
+				body:       `^{"error":"Image can't be fetched"}$`,
+				statusCode: http.StatusBadGateway,
+				logMessage: "image URL responded with 404 Not Found",
+			},
+		},
+		{
+			name:    "Slow origin",
+			url:     server.URL + "/slow.png",
+			options: []imgr.Option{allowLoopback, imgr.WithImportTimeout(50 * time.Millisecond)},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+			want: want{
+				body:       `^{"error":"Image fetch timed out"}$`,
+				statusCode: http.StatusGatewayTimeout,
+				logMessage: "Client.Timeout exceeded",
+			},
+		},
+		{
+			name:    "Not image",
+			url:     server.URL + "/notes.txt",
+			options: []imgr.Option{allowLoopback},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+			want: want{
+				body:       `^{"error":"Unsupported image format"}$`,
+				statusCode: http.StatusUnsupportedMediaType,
+				logMessage: "image: unknown format",
+			},
+		},
+		{
+			name:    "Image exceeding max upload size",
+			url:     server.URL + "/photo.png",
+			options: []imgr.Option{allowLoopback, imgr.WithMaxUploadSize(100)},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+			want: want{
+				body:       `^{"error":"Image is too large"}$`,
+				statusCode: http.StatusRequestEntityTooLarge,
+				logMessage: "image exceeds max upload size",
+			},
+		},
+		{
+			name:    "Invalid URL",
+			url:     "file:///etc/passwd",
+			options: []imgr.Option{allowLoopback},
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+			want: want{
+				body:       `^{"error":"Invalid form value url"}$`,
+				statusCode: http.StatusUnprocessableEntity,
+				logMessage: "invalid form value url",
+			},
+		},
+		{
+			name:    "Unauthorized",
+			url:     server.URL + "/photo.png",
+			options: []imgr.Option{allowLoopback},
+			want: want{
+				body:       `^{"error":"Unauthorized"}$`,
+				statusCode: http.StatusUnauthorized,
+				logMessage: "no valid user_id provided",
+			},
+		},
+	} {
+		options := []imgr.Option{imgr.WithLogger(log), imgr.WithBlobStore(newStubBlobStore(true))}
+		is, err := imgr.NewLocalImageServer(&stubStoreRecorder{stubStoreOwned: true}, append(options, ex.options...)...)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		req, err = http.NewRequest("POST", "", body)
+		form := url.Values{"url": {ex.url}}
+		req, err := http.NewRequest("POST", "/images/import", strings.NewReader(form.Encode()))
 		if err != nil {
 			t.Fatal(err)
 		}
-		req.Header.Set("Content-Type", multi.FormDataContentType())
-	}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		ctx := req.Context()
+		for k, v := range ex.context {
+			ctx = context.WithValue(ctx, k, v)
+		}
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
 
-	ctx := req.Context()
-	for k, v := range contextVals {
-		ctx = context.WithValue(ctx, k, v)
-	}
+		t.Run(ex.name, func(t *testing.T) {
+			is.PostImport(w, req)
 
-	return req.WithContext(ctx)
+			// Check log message if there's expected one
+			if len(ex.want.logMessage) > 0 && assert.Equal(t, 1, len(hook.Entries), "Should have log entry") {
+				assert.Regexp(
+					t,
+					regexp.MustCompile(ex.want.logMessage),
+					hook.Entries[0].Message,
+					"Incorrect log entry message",
+				)
+			}
+
+			// Check response
+			assert.Equal(t, ex.want.statusCode, w.Result().StatusCode, "Incorrect response code")
+			b, err := ioutil.ReadAll(w.Result().Body)
+			w.Result().Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Regexp(t, ex.want.body, string(b), "Incorrect response body")
+
+			hook.Reset()
+		})
+	}
 }
 
-func createFile(t *testing.T, kind byte) string {
-	filename := "image.png"
-	f, err := os.Create("image.png")
+func TestLocalImageServerGetArchive(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	blobs := newStubBlobStore(true, "filename1", "filename2")
+	is, err := imgr.NewLocalImageServer(stubStoreSlice(true), imgr.WithLogger(log), imgr.WithBlobStore(blobs))
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer f.Close()
 
-	switch kind {
-	case fileNonImage:
-		_, err = f.WriteString("Text file content")
-	case fileBroken:
-		_, err = f.WriteString("a\xe0\xe5\xf0\xe9\xe1\xf8\xf1\xe9\xe8\xe4Z")
-	case fileValid:
-		img := image.NewRGBA(image.Rect(0, 0, 50, 50))
-		img.Set(10, 10, color.RGBA{255, 0, 0, 255})
-		err = png.Encode(f, img)
+	for _, ex := range []struct {
+		name       string
+		query      string
+		contents   map[string]string
+		manifest   []string
+		logMessage string
+	}{
+		{
+			name:     "Archive of all images",
+			query:    "?limit=1",
+			contents: map[string]string{"filename1": "filename1 content", "filename2": "filename2 content"},
+			manifest: []string{"filename1", "filename2"},
+			// Image without content is skipped
+			logMessage: "content of filename3 is missing",
+		},
+		{
+			name:     "Archive of tagged images",
+			query:    "?tag=outdoor",
+			contents: map[string]string{"filename2": "filename2 content"},
+			manifest: []string{"filename2"},
+		},
+	} {
+		req := httptest.NewRequest("GET", "/images/archive"+ex.query, http.NoBody)
+		req = req.WithContext(context.WithValue(req.Context(), util.RequestUserKey, stubUser(1)))
+		w := httptest.NewRecorder()
+
+		t.Run(ex.name, func(t *testing.T) {
+			is.GetArchive(w, req)
+
+			if len(ex.logMessage) > 0 && assert.Equal(t, 1, len(hook.Entries), "Should have log entry") {
+				assert.Regexp(t, ex.logMessage, hook.Entries[0].Message, "Incorrect log entry message")
+			}
+			assert.Equal(t, http.StatusOK, w.Result().StatusCode, "Incorrect response code")
+			assert.Equal(t, "application/zip", w.Result().Header.Get("Content-Type"), "Incorrect content type")
+			body := w.Body.Bytes()
+			archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			contents := make(map[string]string)
+			manifest := struct {
+				Items []imgr.Image `json:"items"`
+			}{}
+			for _, file := range archive.File {
+				entry, err := file.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if file.Name == "manifest.json" {
+					err = json.NewDecoder(entry).Decode(&manifest)
+				} else {
+					var b []byte
+					b, err = ioutil.ReadAll(entry)
+					contents[file.Name] = string(b)
+				}
+				entry.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			assert.Equal(t, ex.contents, contents, "Incorrect archived images")
+			filenames := make([]string, 0)
+			for _, image := range manifest.Items {
+				filenames = append(filenames, image.Filename)
+				assert.Equal(t, "/images/"+image.Filename, image.URL, "Manifest should have image URLs")
+				assert.Equal(t, stubTags[image.ID], image.Tags, "Manifest should have image tags")
+			}
+			assert.Equal(t, ex.manifest, filenames, "Incorrect manifest")
+
+			hook.Reset()
+		})
 	}
+}
+
+func TestLocalImageServerGetArchiveAborted(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	is, err := imgr.NewLocalImageServer(
+		stubStoreSlice(true), imgr.WithLogger(log), imgr.WithBlobStore(stubBlobStoreBroken{}),
+	)
 	if err != nil {
 		t.Fatal(err)
 	}
+	req := httptest.NewRequest("GET", "/images/archive", http.NoBody)
+	req = req.WithContext(context.WithValue(req.Context(), util.RequestUserKey, stubUser(1)))
+	w := httptest.NewRecorder()
 
-	return filename
+	// Status is sent already, so response is aborted instead of being completed with incomplete archive
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() { is.GetArchive(w, req) }, "Archive should be aborted")
+	if assert.Equal(t, 1, len(hook.Entries), "Should have log entry") {
+		assert.Equal(t, "blob store error", hook.LastEntry().Message, "Incorrect log entry message")
+	}
 }
 
-type stubStoreSlice bool
+func TestLocalImageServerGetArchiveErrors(t *testing.T) {
+	log, hook := test.NewNullLogger()
+	for _, ex := range []struct {
+		name    string
+		storage imgr.Storage
+		query   string
+		context map[util.RequestKey]interface{}
+		want
+	}{
+		{
+			name:    "Album of other user",
+			storage: stubStoreOwned(true),
+			query:   "?album=2",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+			want: want{
+				body:       `{"error":"Album not found"}`,
+				statusCode: http.StatusNotFound,
+			},
+		},
+		{
+			name:    "Invalid album",
+			storage: stubStoreOwned(true),
+			query:   "?album=holidays",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+			want: want{
+				body:       `{"error":"Invalid query parameter album"}`,
+				statusCode: http.StatusBadRequest,
+				logMessage: "invalid query parameter album",
+			},
+		},
+		{
+			name:    "Invalid date",
+			storage: stubStoreSlice(true),
+			query:   "?created_after=yesterday",
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+			want: want{
+				body:       `{"error":"Invalid query parameter created_after"}`,
+				statusCode: http.StatusBadRequest,
+				logMessage: "invalid query parameter created_after",
+			},
+		},
+		{
+			name:    "Storage error",
+			storage: stubStoreSlice(false),
+			context: map[util.RequestKey]interface{}{util.RequestUserKey: stubUser(1)},
+			want: want{
+				body:       `{"error":"Internal server error"}`,
+				statusCode: http.StatusInternalServerError,
+				logMessage: "storage error",
+			},
+		},
+		{
+			name:    "Unauthorized",
+			storage: stubStoreSlice(true),
+			want: want{
+				body:       `{"error":"Unauthorized"}`,
+				statusCode: http.StatusUnauthorized,
+				logMessage: "no valid user_id provided",
+			},
+		},
+	} {
+		is, err := imgr.NewLocalImageServer(ex.storage, imgr.WithLogger(log))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "/images/archive"+ex.query, http.NoBody)
+		ctx := req.Context()
+		for k, v := range ex.context {
+			ctx = context.WithValue(ctx, k, v)
+		}
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
 
-func (ss stubStoreSlice) CreateImage(_ *imgr.Image) (err error) {
-	return
-}
+		t.Run(ex.name, func(t *testing.T) {
+			is.GetArchive(w, req)
 
-func (ss stubStoreSlice) LoadImages(in *[]imgr.Image, _, _, _ uint64) (err error) {
-	if !ss {
-		err = errors.New("storage error")
-	} else {
-		*in = []imgr.Image{
-			{Filename: "filename1", UserID: 1},
-			{Filename: "filename2", UserID: 1},
-			{Filename: "filename3", UserID: 1},
-		}
+			// Check log message if there's expected one
+			if len(ex.want.logMessage) > 0 && assert.Equal(t, 1, len(hook.Entries), "Should have log entry") {
+				assert.Regexp(
+					t,
+					regexp.MustCompile(ex.want.logMessage),
+					hook.Entries[0].Message,
+					"Incorrect log entry message",
+				)
+			}
+
+			// Check response
+			assert.Equal(t, ex.want.statusCode, w.Result().StatusCode, "Incorrect response code")
+			assert.Equal(t, ex.want.body, w.Body.String(), "Incorrect response body")
+
+			hook.Reset()
+		})
 	}
-	return err
 }
 
-func TestLocalImageServerListImages(t *testing.T) {
+func TestLocalImageServerPatchImage(t *testing.T) {
 	log, hook := test.NewNullLogger()
-	for _, ex := range examplesLocalImageServerListImages {
-		is, err := imgr.NewLocalImageServer(
-			stubStoreSlice(ex.storage),
-			imgr.WithLogger(log),
-		)
+	for _, ex := range examplesLocalImageServerPatchImage {
+		is, err := imgr.NewLocalImageServer(stubStoreOwned(ex.storage), imgr.WithLogger(log))
 		if err != nil {
 			t.Fatal(err)
 		}
+		mux := goji.NewMux()
+		mux.HandleFunc(pat.Patch("/images/:filename"), is.PatchImage)
 
-		req, err := http.NewRequest("GET", "", http.NoBody)
+		form := url.Values{}
+		for k, v := range ex.requestDetails.form {
+			form.Set(k, v)
+		}
+		req, err := http.NewRequest("PATCH", ex.path, strings.NewReader(form.Encode()))
 		if err != nil {
 			t.Fatal(err)
 		}
-
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if ex.ifMatch != "" {
+			req.Header.Set("If-Match", ex.ifMatch)
+		}
 		ctx := req.Context()
-		for k, v := range ex.requestList.context {
+		for k, v := range ex.requestDetails.context {
 			ctx = context.WithValue(ctx, k, v)
 		}
-
 		req = req.WithContext(ctx)
-		req.URL.Query().Add("limit", fmt.Sprint(ex.requestList.limit))
-		req.URL.Query().Add("offset", fmt.Sprint(ex.requestList.offset))
 		w := httptest.NewRecorder()
 
 		t.Run(ex.name, func(t *testing.T) {
-			is.ListImages(w, req)
+			mux.ServeHTTP(w, req)
 
 			// Check log message if there's expected one
 			if len(ex.want.logMessage) > 0 && assert.Equal(t, 1, len(hook.Entries), "Should have log entry") {
@@ -312,13 +3495,14 @@ func TestLocalImageServerListImages(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-
-			// Empty expected body signals for correct json to be expected as body
-			if len(ex.want.body) > 0 {
-				assert.Regexp(t, ex.want.body, string(b), "Incorrect response body")
-			} else {
-				err = json.Unmarshal(b, &[]imgr.Image{})
-				assert.Nil(t, err, "Response body should be valid json")
+			assert.Regexp(t, ex.want.body, string(b), "Incorrect response body")
+			switch ex.want.statusCode {
+			case http.StatusOK:
+				assert.Regexp(t, `-v1"$`, w.Result().Header.Get("ETag"), "ETag of updated version should be returned")
+			case http.StatusPreconditionFailed:
+				if ex.ifMatch != "" {
+					assert.Regexp(t, `-v0"$`, w.Result().Header.Get("ETag"), "ETag of current version should be returned")
+				}
 			}
 
 			hook.Reset()
@@ -0,0 +1,292 @@
+package imgr
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sp4rd4/go-imager/util"
+	"goji.io"
+	"goji.io/middleware"
+	"goji.io/pat"
+)
+
+// DefaultShareDuration is time share links stay valid for unless other duration is requested.
+const DefaultShareDuration = 24 * time.Hour
+
+// MaxShareDuration is max time share links stay valid for.
+const MaxShareDuration = 30 * 24 * time.Hour
+
+// shareParam is query parameter of image URL that share token is passed in.
+const shareParam = "share"
+
+// Share grants access to image without authentication until it expires,
+// zero MaxViews means number of views isn't limited.
+type Share struct {
+	ID        uint64    `json:"id" db:"id"`
+	URL       string    `json:"url" db:"-"`
+	ImageID   uint64    `json:"-" db:"image_id"`
+	UserID    uint64    `json:"-" db:"user_id"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+	MaxViews  int64     `json:"max_views" db:"max_views"`
+	Views     int64     `json:"-" db:"views"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// formValueError is returned when form value has invalid value.
+type formValueError string
+
+func (fve formValueError) Error() string {
+	return "invalid form value " + string(fve)
+}
+
+// shareError is returned when image can't be accessed by share token.
+type shareError string
+
+func (se shareError) Error() string {
+	return "share token is " + string(se)
+}
+
+const (
+	errShareInvalid  shareError = "invalid"
+	errShareExpired  shareError = "expired"
+	errShareRejected shareError = "revoked or used up"
+)
+
+// WithShareSecret is functional option for setting secret share tokens of LocalImageServer are signed with,
+// images can't be shared without it.
+func WithShareSecret(secret []byte) Option {
+	return func(is *LocalImageServer) error {
+		if len(secret) == 0 {
+			return errors.New("share secret should not be empty")
+		}
+		is.shareSecret = secret
+		return nil
+	}
+}
+
+// SkipForShared wraps authentication middleware, so requests with share token routed to pattern of shared images
+// skip it. Such requests are authorized by token in GetImage, requests of other routes are authenticated as usual.
+func SkipForShared(shared goji.Pattern, auth func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		authenticated := auth(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if middleware.Pattern(r.Context()) == shared && r.URL.Query().Get(shareParam) != "" &&
+				(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			authenticated.ServeHTTP(w, r)
+		})
+	}
+}
+
+// signShare returns token of share, token keeps share ID and expiration time signed by HMAC-SHA256.
+func (is *LocalImageServer) signShare(share *Share) string {
+	payload := strconv.FormatUint(share.ID, 10) + "." + strconv.FormatInt(share.ExpiresAt.Unix(), 10)
+	mac := hmac.New(sha256.New, is.shareSecret)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyShare returns ID of share if token is signed by server and isn't expired.
+func (is *LocalImageServer) verifyShare(token string) (uint64, error) {
+	parts := strings.Split(token, ".")
+	if len(is.shareSecret) == 0 || len(parts) != 3 {
+		return 0, errShareInvalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, errShareInvalid
+	}
+	mac := hmac.New(sha256.New, is.shareSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return 0, errShareInvalid
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, errShareInvalid
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, errShareInvalid
+	}
+	if !time.Now().Before(time.Unix(expires, 0)) {
+		return 0, errShareExpired
+	}
+	return id, nil
+}
+
+// sharedImage returns share of image by token and counts view of image if view is set,
+// shareError is returned when token can't be used for image.
+func (is *LocalImageServer) sharedImage(token, filename string, view bool) (*Share, error) {
+	id, err := is.verifyShare(token)
+	if err != nil {
+		return nil, err
+	}
+	share := &Share{ID: id}
+	if view {
+		err = is.storage.UseShare(share, filename)
+	} else {
+		err = is.storage.LoadShare(share, filename)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errShareRejected
+		}
+		return nil, err
+	}
+	return share, nil
+}
+
+// statusRecorder is http.ResponseWriter that records status of response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+// shareURL returns URL of image with share token.
+func (is *LocalImageServer) shareURL(filename string, share *Share) string {
+	return imageURL(filename) + "?" + url.Values{shareParam: {is.signShare(share)}}.Encode()
+}
+
+// parseShare validates share form values.
+func parseShare(r *http.Request) (*Share, error) {
+	duration := DefaultShareDuration
+	if v := r.FormValue("expires_in"); v != "" {
+		seconds, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || seconds <= 0 || seconds > int64(MaxShareDuration/time.Second) {
+			return nil, formValueError("expires_in")
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+	share := &Share{ExpiresAt: time.Now().Add(duration).UTC().Truncate(time.Second)}
+	if v := r.FormValue("max_views"); v != "" {
+		var err error
+		if share.MaxViews, err = strconv.ParseInt(v, 10, 64); err != nil || share.MaxViews < 0 {
+			return nil, formValueError("max_views")
+		}
+	}
+	return share, nil
+}
+
+// PostShare creates share link of image uploaded by the current user, share is returned as json
+// with URL of image that is served without authentication until share expires or is revoked.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 share will not be created.
+// Images of other users are reported as missing.
+// * filename (required) URL path parameter
+// * expires_in (default: 86400) form value with number of seconds share is valid for, up to 30 days
+// * max_views (default: 0) form value with number of times image can be viewed by share, 0 means no limit
+func (is *LocalImageServer) PostShare(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+	if len(is.shareSecret) == 0 {
+		requestLogger.Warn("share secret isn't configured")
+		util.JSONResponse(w, http.StatusNotImplemented, `{"error":"Sharing is disabled"}`, requestLogger)
+		return
+	}
+
+	img := &Image{Filename: pat.Param(r, "filename"), UserID: userID}
+	if err = is.storage.LoadImage(img); err != nil {
+		if err == sql.ErrNoRows {
+			util.JSONResponse(w, http.StatusNotFound, `{"error":"Image not found"}`, requestLogger)
+			return
+		}
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+
+	share, err := parseShare(r)
+	if err != nil {
+		requestLogger.Info(err)
+		body := fmt.Sprintf(`{"error":"Invalid form value %s"}`, string(err.(formValueError)))
+		util.JSONResponse(w, http.StatusUnprocessableEntity, body, requestLogger)
+		return
+	}
+	share.ImageID, share.UserID = img.ID, userID
+	if err = is.storage.CreateShare(share); err != nil {
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+
+	share.URL = is.shareURL(img.Filename, share)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err = json.NewEncoder(w).Encode(share); err != nil {
+		requestLogger.Error(err)
+	}
+}
+
+// DeleteShare revokes share of image uploaded by the current user, image is no longer served by its token.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 share will not be revoked.
+// Images of other users are reported as missing.
+// * filename (required) URL path parameter
+// * share (required) URL path parameter with share ID
+func (is *LocalImageServer) DeleteShare(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	img := &Image{Filename: pat.Param(r, "filename"), UserID: userID}
+	err = is.storage.LoadImage(img)
+	if err == nil {
+		var id uint64
+		if id, err = strconv.ParseUint(pat.Param(r, "share"), 10, 64); err != nil {
+			err = sql.ErrNoRows
+		} else {
+			err = is.storage.DeleteShare(id, img.ID)
+		}
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			util.JSONResponse(w, http.StatusNotFound, `{"error":"Image or share not found"}`, requestLogger)
+			return
+		}
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,35 @@
+package imgr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyShare(t *testing.T) {
+	is := &LocalImageServer{shareSecret: []byte("share secret")}
+	valid := is.signShare(&Share{ID: 7, ExpiresAt: time.Now().Add(time.Minute)})
+	expired := is.signShare(&Share{ID: 7, ExpiresAt: time.Now().Add(-time.Minute)})
+
+	for _, ex := range []struct {
+		name  string
+		is    *LocalImageServer
+		token string
+		id    uint64
+		err   error
+	}{
+		{"Valid token", is, valid, 7, nil},
+		{"Expired token", is, expired, 0, errShareExpired},
+		{"Token without signature", is, valid[:len(valid)-44], 0, errShareInvalid},
+		{"Token with changed expiration", is, "7.9999999999" + valid[len(valid)-44:], 0, errShareInvalid},
+		{"Malformed token", is, "token", 0, errShareInvalid},
+		{"Server without secret", &LocalImageServer{}, valid, 0, errShareInvalid},
+	} {
+		t.Run(ex.name, func(t *testing.T) {
+			id, err := ex.is.verifyShare(ex.token)
+			assert.Equal(t, ex.err, err, "Incorrect error")
+			assert.Equal(t, ex.id, id, "Incorrect share ID")
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package imgr
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sp4rd4/go-imager/util"
+	"goji.io/pat"
+)
+
+// maxImageTags is max number of tags of single image.
+const maxImageTags = 20
+
+// tagPattern matches valid tag names, tags are lowercased before matching.
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,49}$`)
+
+// ImageTag is tag of image that is stored in database.
+type ImageTag struct {
+	ImageID uint64 `db:"image_id"`
+	Tag     string `db:"tag"`
+}
+
+// TagCount describes tag used by user with number of images having it.
+type TagCount struct {
+	Tag   string `json:"tag" db:"tag"`
+	Count uint64 `json:"count" db:"count"`
+}
+
+// tagList is json envelope of user tags list.
+type tagList struct {
+	Items []TagCount `json:"items"`
+}
+
+// imageTags is json representation of image tags.
+type imageTags struct {
+	Tags []string `json:"tags"`
+}
+
+// parseTags returns sorted lowercased tags without duplicates.
+// Tags should consist of up to 50 letters, digits, hyphens and underscores, starting with letter or digit.
+func parseTags(values []string) ([]string, error) {
+	unique := make(map[string]bool, len(values))
+	tags := make([]string, 0, len(values))
+	for _, v := range values {
+		tag := strings.ToLower(strings.TrimSpace(v))
+		if !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("tag %q is invalid", v)
+		}
+		if !unique[tag] {
+			unique[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// setTags sets tags of listed images.
+func (is *LocalImageServer) setTags(images []Image) error {
+	if len(images) == 0 {
+		return nil
+	}
+	ids := make([]uint64, 0, len(images))
+	for _, image := range images {
+		ids = append(ids, image.ID)
+	}
+	tags := make([]ImageTag, 0)
+	if err := is.storage.LoadImageTags(&tags, ids); err != nil {
+		return err
+	}
+
+	imageTags := make(map[uint64][]string)
+	for _, tag := range tags {
+		imageTags[tag.ImageID] = append(imageTags[tag.ImageID], tag.Tag)
+	}
+	for i := range images {
+		images[i].Tags = imageTags[images[i].ID]
+	}
+	return nil
+}
+
+// PutImageTags replaces tags of image uploaded by the current user, resulting tags are returned as json.
+// Tags are lowercased, image can have up to 20 tags, passing no tags removes all tags of image.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 tags will not be changed.
+// Images of other users are reported as missing.
+// * filename (required) URL path parameter
+// * tag (default: none) form values with up to 50 letters, digits, hyphens and underscores
+func (is *LocalImageServer) PutImageTags(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	img := &Image{Filename: pat.Param(r, "filename"), UserID: userID}
+	if err = is.storage.LoadImage(img); err != nil {
+		if err == sql.ErrNoRows {
+			util.JSONResponse(w, http.StatusNotFound, `{"error":"Image not found"}`, requestLogger)
+			return
+		}
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+
+	var tags []string
+	if err = r.ParseForm(); err == nil {
+		tags, err = parseTags(r.PostForm["tag"])
+	}
+	if err == nil && len(tags) > maxImageTags {
+		err = fmt.Errorf("image can't have more than %d tags", maxImageTags)
+	}
+	if err != nil {
+		requestLogger.Info(err)
+		util.JSONResponse(w, http.StatusUnprocessableEntity, `{"error":"Tags are invalid"}`, requestLogger)
+		return
+	}
+	if err = is.storage.SetImageTags(img.ID, tags); err != nil {
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(imageTags{Tags: tags}); err != nil {
+		requestLogger.Error(err)
+	}
+}
+
+// ListTags returns json formatted list of tags used by the current user with numbers of images having them,
+// ordered by tag.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 no tags will be loaded.
+func (is *LocalImageServer) ListTags(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	list := tagList{Items: make([]TagCount, 0)}
+	if err = is.storage.LoadTagCounts(&list.Items, userID); err != nil && err != sql.ErrNoRows {
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(list); err != nil {
+		requestLogger.Error(err)
+	}
+}
@@ -0,0 +1,274 @@
+package imgr
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sp4rd4/go-imager/util"
+	"goji.io/pat"
+)
+
+// DefaultJPEGQuality is quality of JPEG images encoded by LocalImageServer.
+const DefaultJPEGQuality = 85
+
+// DefaultMaxRenditionDimension is max width and height of thumbnails served by LocalImageServer.
+const DefaultMaxRenditionDimension = 2048
+
+// maxCachedRenditions is max number of renditions cached for every image,
+// renditions requested after that are rendered for every request.
+const maxCachedRenditions = 32
+
+// WithMaxRenditionDimension is functional option for setting LocalImageServer max width and height of thumbnails,
+// that protects from renditions that take too much memory when rendered, default is DefaultMaxRenditionDimension.
+func WithMaxRenditionDimension(size int) Option {
+	return func(is *LocalImageServer) error {
+		if size <= 0 {
+			return errors.New("max rendition dimension should be positive")
+		}
+		is.maxRendition = size
+		return nil
+	}
+}
+
+// rendition describes resized or converted version of stored image, zero size means original size.
+type rendition struct {
+	width   int
+	height  int
+	fit     string
+	format  string
+	quality int
+}
+
+// key returns blob key rendition of image is cached under.
+// Renditions are keyed by image ID, so keys don't depend on characters of filename and aren't reused by other images.
+func (rn rendition) key(imageID uint64) string {
+	if rn.width == 0 && rn.height == 0 {
+		return fmt.Sprintf("renditions/%d/original-q%d.%s", imageID, rn.quality, rn.format)
+	}
+	return fmt.Sprintf("renditions/%d/%dx%d-%s-q%d.%s", imageID, rn.width, rn.height, rn.fit, rn.quality, rn.format)
+}
+
+// renditionsPrefix returns prefix of blob keys of all renditions of image.
+func renditionsPrefix(imageID uint64) string {
+	return fmt.Sprintf("renditions/%d/", imageID)
+}
+
+// parseRendition validates thumbnail query parameters,
+// queryParamError is returned for parameters with unknown values.
+func (is *LocalImageServer) parseRendition(params url.Values, img *Image) (rendition, error) {
+	rn := rendition{fit: FitContain, format: imageFormat(img), quality: DefaultJPEGQuality}
+	var err error
+	if v := params.Get("w"); v != "" {
+		if rn.width, err = strconv.Atoi(v); err != nil || rn.width <= 0 || rn.width > is.maxRendition {
+			return rn, queryParamError("w")
+		}
+	}
+	if v := params.Get("h"); v != "" {
+		if rn.height, err = strconv.Atoi(v); err != nil || rn.height <= 0 || rn.height > is.maxRendition {
+			return rn, queryParamError("h")
+		}
+	}
+	if rn.width == 0 && rn.height == 0 {
+		return rn, queryParamError("w")
+	}
+	if v := params.Get("fit"); v != "" {
+		if v != FitContain && v != FitCover {
+			return rn, queryParamError("fit")
+		}
+		rn.fit = v
+	}
+	if v := params.Get("format"); v != "" {
+		if _, ok := contentTypes[v]; !ok {
+			return rn, queryParamError("format")
+		}
+		rn.format = v
+	}
+	if rn.format != "jpeg" {
+		rn.quality = 0
+	}
+	return rn, nil
+}
+
+// GetThumbnail serves resized version of image uploaded by the current user.
+// Images are only scaled down, so thumbnails aren't bigger than image.
+// Renditions are cached in blob store, so every rendition is rendered once, up to 32 renditions of every image.
+// If context value defined by WithRequestUserKey doesn't contain variable
+// that implements User interface and returns ID()>0 image will not be served.
+// Images of other users are reported as missing.
+// * filename (required) URL path parameter
+// * w, h (at least one is required) Query parameters with size of rendition up to max rendition dimension,
+// missing one is calculated keeping aspect ratio
+// * fit (default: contain) Query parameter, contain fits image into size, cover fills size cropping image
+// * format (default: format of image) Query parameter, one of png, jpeg, gif
+func (is *LocalImageServer) GetThumbnail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	requestID, _ := ctx.Value(util.RequestIDKey).(string)
+	requestLogger := is.log.WithFields(log.Fields{"request_id": requestID})
+	userID, err := extracrtUserID(ctx)
+	if err != nil {
+		requestLogger.Warn(err)
+		util.JSONResponse(w, http.StatusUnauthorized, `{"error":"Unauthorized"}`, requestLogger)
+		return
+	}
+
+	img := &Image{Filename: pat.Param(r, "filename"), UserID: userID}
+	if err = is.storage.LoadImage(img); err != nil {
+		if err == sql.ErrNoRows {
+			util.JSONResponse(w, http.StatusNotFound, `{"error":"Image not found"}`, requestLogger)
+			return
+		}
+		requestLogger.Error(err)
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+
+	rn, err := is.parseRendition(r.URL.Query(), img)
+	if err != nil {
+		requestLogger.Info(err)
+		body := fmt.Sprintf(`{"error":"Invalid query parameter %s"}`, string(err.(queryParamError)))
+		util.JSONResponse(w, http.StatusBadRequest, body, requestLogger)
+		return
+	}
+
+	is.serveRendition(w, r, img, rn, requestLogger)
+}
+
+// serveRendition serves rendition of image, rendering it if it isn't cached yet.
+func (is *LocalImageServer) serveRendition(
+	w http.ResponseWriter, r *http.Request, img *Image, rn rendition, requestLogger *log.Entry,
+) {
+	key := rn.key(img.ID)
+	content, modTime, err := is.cachedRendition(r, key)
+	if err == ErrBlobNotFound {
+		content, modTime, err = is.renderRendition(r, img, key, rn, requestLogger)
+	}
+	if err != nil {
+		requestLogger.Error(err)
+		if err == ErrBlobNotFound {
+			util.JSONResponse(w, http.StatusNotFound, `{"error":"Image not found"}`, requestLogger)
+			return
+		}
+		util.JSONResponse(w, http.StatusInternalServerError, `{"error":"Internal server error"}`, requestLogger)
+		return
+	}
+	defer func() {
+		if err = content.Close(); err != nil {
+			requestLogger.Error(err)
+		}
+	}()
+
+	// Renditions are never modified, so checksum of their key is enough to be strong validator
+	w.Header().Set("Content-Type", contentTypes[rn.format])
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(key))))
+	http.ServeContent(w, r, key, modTime, content)
+}
+
+// cachedRendition opens rendition stored in blob store.
+func (is *LocalImageServer) cachedRendition(r *http.Request, key string) (io.ReadSeekCloser, time.Time, error) {
+	info, err := is.blobs.Stat(r.Context(), key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	content, err := is.blobs.Get(r.Context(), key)
+	return content, info.ModTime, err
+}
+
+// renderRendition resizes image and caches result in blob store,
+// rendition is served even if it can't be cached or cache of image is full.
+func (is *LocalImageServer) renderRendition(
+	r *http.Request, img *Image, key string, rn rendition, requestLogger *log.Entry,
+) (io.ReadSeekCloser, time.Time, error) {
+	content, err := is.render(r.Context(), img, rn)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	cached, err := is.blobs.List(r.Context(), renditionsPrefix(img.ID))
+	if err == nil && len(cached) >= maxCachedRenditions {
+		requestLogger.Infof("rendition %s isn't cached, %d renditions are cached already", key, len(cached))
+	} else if err == nil {
+		err = is.blobs.Put(r.Context(), key, bytes.NewReader(content))
+	}
+	if err != nil {
+		requestLogger.Error(err)
+	}
+	return memoryBlobReader{bytes.NewReader(content)}, time.Now(), nil
+}
+
+// render returns encoded rendition of stored image, image is only converted when rendition has no size.
+// Render waits for free render slot, so only maxConcurrentRenders images are decoded at once.
+func (is *LocalImageServer) render(ctx context.Context, img *Image, rn rendition) ([]byte, error) {
+	select {
+	case is.renderSlots <- struct{}{}:
+		defer func() { <-is.renderSlots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	blob, err := is.blobs.Get(ctx, img.blobKey())
+	if err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(blob)
+	if errC := blob.Close(); errC != nil && err == nil {
+		err = errC
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if rn.width > 0 || rn.height > 0 {
+		width, height, part := resizeDimensions(src.Bounds(), rn.width, rn.height, rn.fit)
+		src = resize(src, part, width, height)
+	}
+	buf := &bytes.Buffer{}
+	if err = encodeImage(buf, src, rn.format, rn.quality); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeImage writes image in given format, quality is used only by JPEG encoder.
+func encodeImage(w io.Writer, img image.Image, format string, quality int) error {
+	switch format {
+	case "png":
+		return png.Encode(w, img)
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "gif":
+		return gif.Encode(w, img, nil)
+	}
+	return fmt.Errorf("format %s isn't supported", format)
+}
+
+// imageFormat returns format of stored image.
+// Images uploaded before their content type was recorded are identified by filename extension,
+// PNG is used for unknown ones.
+func imageFormat(img *Image) string {
+	for format, contentType := range contentTypes {
+		if contentType == img.ContentType {
+			return format
+		}
+	}
+	switch strings.ToLower(path.Ext(img.Filename)) {
+	case ".jpg", ".jpeg":
+		return "jpeg"
+	case ".gif":
+		return "gif"
+	}
+	return "png"
+}
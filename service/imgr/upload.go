@@ -0,0 +1,262 @@
+package imgr
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"image"
+	// Decoders of supported formats are registered for image.DecodeConfig
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math/rand"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/oklog/ulid"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxHeaderSize limits amount of image data buffered while image header is decoded.
+const maxHeaderSize = 2 << 20
+
+// maxBatchImages is max number of images uploaded in single request.
+const maxBatchImages = 100
+
+// contentTypes maps supported image formats to their content types.
+var contentTypes = map[string]string{
+	"gif":  "image/gif",
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+}
+
+// uploadError is error caused by uploaded image, it is reported to client with given status and body.
+type uploadError struct {
+	status int
+	body   string
+	err    error
+}
+
+func (ue *uploadError) Error() string {
+	return ue.err.Error()
+}
+
+// errImageTooLarge is returned while reading uploaded image that exceeds max upload size.
+var errImageTooLarge = &uploadError{
+	http.StatusRequestEntityTooLarge,
+	`{"error":"Image is too large"}`,
+	errors.New("image exceeds max upload size"),
+}
+
+// errTooManyImages is returned for images exceeding max number of images uploaded in single request.
+var errTooManyImages = &uploadError{
+	http.StatusRequestEntityTooLarge,
+	`{"error":"Too many images in request"}`,
+	fmt.Errorf("request exceeds %d images", maxBatchImages),
+}
+
+// upload is image received in request, err is set when image isn't created.
+type upload struct {
+	key   string
+	image *Image
+	err   error
+}
+
+// imageData defines uploaded image data, content is streamed from request body.
+type imageData struct {
+	contentType string
+	width       int
+	height      int
+	capturedAt  *time.Time
+	data        io.Reader
+	digest      *digestWriter
+}
+
+// digestWriter counts size and checksum of data written to it.
+type digestWriter struct {
+	hash hash.Hash
+	size int64
+}
+
+func (dw *digestWriter) Write(p []byte) (int, error) {
+	dw.size += int64(len(p))
+	return dw.hash.Write(p)
+}
+
+// sum returns hex encoded checksum of written data.
+func (dw *digestWriter) sum() string {
+	return hex.EncodeToString(dw.hash.Sum(nil))
+}
+
+// sizeLimitReader reads up to limit bytes from underlying reader and fails with errImageTooLarge if there are more.
+type sizeLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+// receiveImages streams image file parts of multipart form to blob store under temporary keys,
+// without reading whole request body. Images are validated independently, parts that aren't images are skipped.
+// Images are uploaded as batch when they are sent as images[] parts or there are several of them.
+func (is *LocalImageServer) receiveImages(
+	r *http.Request, userID uint64, requestLogger *log.Entry,
+) (uploads []*upload, batch bool, err error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, false, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if len(uploads) == 0 {
+				return nil, false, err
+			}
+			// Images received before malformed part are still created
+			requestLogger.Info(err)
+			break
+		}
+		name := part.FormName()
+		if name != "image" && name != "images[]" || part.FileName() == "" {
+			continue
+		}
+		batch = batch || name == "images[]"
+		if len(uploads) >= maxBatchImages {
+			uploads = append(uploads, &upload{
+				image: &Image{OriginalName: filepath.Base(part.FileName())},
+				err:   errTooManyImages,
+			})
+			continue
+		}
+		uploads = append(uploads, is.receiveImage(r.Context(), part.FileName(), part, userID))
+	}
+	if len(uploads) == 0 {
+		return nil, false, errors.New("image is missing in form")
+	}
+	return uploads, batch || len(uploads) > 1, nil
+}
+
+// receiveImage validates image content and streams it to blob store under temporary key,
+// as its checksum is known only after it's read.
+func (is *LocalImageServer) receiveImage(ctx context.Context, name string, content io.Reader, userID uint64) *upload {
+	up := &upload{image: &Image{OriginalName: filepath.Base(name), UserID: userID}}
+	id, err := is.validateImage(&sizeLimitReader{content, is.maxUploadSize})
+	if err != nil {
+		if _, ok := err.(*uploadError); !ok {
+			err = &uploadError{http.StatusUnprocessableEntity, `{"error":"No image is present"}`, err}
+		}
+		up.err = err
+		return up
+	}
+
+	ulid, err := newULID()
+	if err != nil {
+		up.err = err
+		return up
+	}
+	up.key = uploadKey(ulid)
+	if up.err = is.blobs.Put(ctx, up.key, id.data); up.err != nil {
+		return up
+	}
+
+	up.image.Filename = ulid + up.image.OriginalName
+	up.image.ContentType = id.contentType
+	up.image.Size = id.digest.size
+	up.image.Width, up.image.Height = id.width, id.height
+	up.image.SHA256 = id.digest.sum()
+	up.image.CapturedAt = id.capturedAt
+	up.image.BlobKey = contentKey(id.digest.sum())
+	return up
+}
+
+// newULID returns unique lexicographically sortable identifier starting with current time.
+func newULID() (string, error) {
+	now := time.Now()
+	entropy := rand.New(rand.NewSource(now.UnixNano()))
+	id, err := ulid.New(ulid.Timestamp(now), entropy)
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// validateImage decodes image header and checks its format and dimensions,
+// metadata of JPEG images is sanitized before they are stored,
+// returned image data contains whole content including already decoded header,
+// its size and checksum are known after data is read.
+func (is *LocalImageServer) validateImage(content io.Reader) (*imageData, error) {
+	head := &bytes.Buffer{}
+	config, format, err := image.DecodeConfig(io.TeeReader(io.LimitReader(content, maxHeaderSize), head))
+	switch {
+	case err == errImageTooLarge:
+		return nil, errImageTooLarge
+	case err == image.ErrFormat:
+		return nil, &uploadError{http.StatusUnsupportedMediaType, `{"error":"Unsupported image format"}`, err}
+	case err != nil:
+		return nil, &uploadError{
+			http.StatusUnprocessableEntity,
+			`{"error":"Image is malformed"}`,
+			fmt.Errorf("image header is malformed: %s", err),
+		}
+	case !is.formats[format]:
+		return nil, &uploadError{
+			http.StatusUnsupportedMediaType,
+			`{"error":"Unsupported image format"}`,
+			fmt.Errorf("format %s isn't allowed", format),
+		}
+	case config.Width <= 0 || config.Height <= 0:
+		return nil, &uploadError{
+			http.StatusUnprocessableEntity,
+			`{"error":"Image is malformed"}`,
+			fmt.Errorf("image dimensions %dx%d are invalid", config.Width, config.Height),
+		}
+	case config.Width > is.maxWidth || config.Height > is.maxHeight:
+		return nil, &uploadError{
+			http.StatusUnprocessableEntity,
+			`{"error":"Image dimensions are too large"}`,
+			fmt.Errorf("image dimensions %dx%d exceed %dx%d", config.Width, config.Height, is.maxWidth, is.maxHeight),
+		}
+	}
+
+	id := &imageData{contentType: contentTypes[format], width: config.Width, height: config.Height}
+	data := io.MultiReader(head, content)
+	if format == "jpeg" {
+		// Image can be rotated by its orientation
+		if data, err = is.sanitizeJPEG(id, data); err != nil {
+			return nil, err
+		}
+		if id.width > is.maxWidth || id.height > is.maxHeight {
+			return nil, &uploadError{
+				http.StatusUnprocessableEntity,
+				`{"error":"Image dimensions are too large"}`,
+				fmt.Errorf("image dimensions %dx%d exceed %dx%d", id.width, id.height, is.maxWidth, is.maxHeight),
+			}
+		}
+	}
+	id.digest = &digestWriter{hash: sha256.New()}
+	id.data = io.TeeReader(data, id.digest)
+	return id, nil
+}
+
+func (l *sizeLimitReader) Read(p []byte) (n int, err error) {
+	if l.remaining <= 0 {
+		// One more byte is read to tell image of exactly limit size from bigger one
+		if n, err = l.r.Read(make([]byte, 1)); n > 0 {
+			return 0, errImageTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err = l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}